@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+)
+
+// severity of a rule, a breached critical rule fails the run
+type severity string
+
+const (
+	severityWarning  severity = "warning"
+	severityCritical severity = "critical"
+)
+
+// thresholds are the limits the final results are checked against
+type thresholds struct {
+	maxErrorRate   float64 // 5xx and network errors per completed request
+	maxLost        int64   // requests that never completed
+	minSuccessRate float64 // 201s per completed request, 0 disables the rule
+}
+
+// rule checks the final results. check returns whether the rule was breached and
+// the message explaining it.
+type rule struct {
+	name     string
+	severity severity
+	check    func(m *Metrics) (bool, string)
+}
+
+// verdict is the machine-readable outcome of the run, for CI
+type verdict struct {
+	Pass     bool     `json:"pass"`
+	Critical []string `json:"critical"` // names of the breached critical rules
+	Warnings []string `json:"warnings"` // names of the breached warning rules
+}
+
+// insightRules returns the rules of the final insights
+func insightRules(t thresholds) []rule {
+	return []rule{
+		{
+			name:     "error_rate",
+			severity: severityCritical,
+			check: func(m *Metrics) (bool, string) {
+				rate := m.errorRate()
+				return rate > t.maxErrorRate, fmt.Sprintf("Error rate %.2f%% (5xx + network) is above %.2f%%.", rate*100, t.maxErrorRate*100)
+			},
+		},
+		{
+			name:     "lost_requests",
+			severity: severityCritical,
+			check: func(m *Metrics) (bool, string) {
+				lost := atomic.LoadInt64(&m.requestsSent) - atomic.LoadInt64(&m.requestsCompleted)
+				return lost > t.maxLost, fmt.Sprintf("%d requests never completed. Possible timeout or connection issues.", lost)
+			},
+		},
+		{
+			name:     "success_rate",
+			severity: severityCritical,
+			check: func(m *Metrics) (bool, string) {
+				completed := atomic.LoadInt64(&m.requestsCompleted)
+				if t.minSuccessRate <= 0 || completed == 0 {
+					return false, ""
+				}
+				rate := float64(atomic.LoadInt64(&m.success201)) / float64(completed)
+				return rate < t.minSuccessRate, fmt.Sprintf("Success rate %.2f%% (201) is below %.2f%%.", rate*100, t.minSuccessRate*100)
+			},
+		},
+		{
+			name:     "server_errors",
+			severity: severityWarning,
+			check: func(m *Metrics) (bool, string) {
+				return atomic.LoadInt64(&m.serverErrors5xx) > 0, "Server errors detected! The server struggled under load."
+			},
+		},
+		{
+			name:     "network_errors",
+			severity: severityWarning,
+			check: func(m *Metrics) (bool, string) {
+				if atomic.LoadInt64(&m.networkErrors) <= int64(float64(atomic.LoadInt64(&m.requestsSent))*0.01) {
+					return false, ""
+				}
+				message := "High network error rate (>1%). Server might be dropping connections."
+				timeouts, refused := atomic.LoadInt64(&m.timeoutErrors), atomic.LoadInt64(&m.connRefusedErrors)
+				if timeouts > refused {
+					message += "\n⚠️  Mostly timeouts. Server is accepting connections but too slow to respond."
+				} else if refused > 0 {
+					message += "\n⚠️  Mostly refused connections. Server is down or its accept backlog is full."
+				}
+				return true, message
+			},
+		},
+		{
+			name:     "stock_tracking",
+			severity: severityWarning,
+			check: func(m *Metrics) (bool, string) {
+				return atomic.LoadInt64(&m.success201) < 10000 && atomic.LoadInt64(&m.soldOut409) == 0,
+					"Less than 10k items sold but no 'sold out' responses. Possible issue with stock tracking."
+			},
+		},
+	}
+}
+
+// printInsights evaluates the rules, prints the breached ones and the verdict
+func (m *Metrics) printInsights(rules []rule) verdict {
+	result := verdict{Pass: true, Critical: []string{}, Warnings: []string{}}
+
+	fmt.Printf("\n=== INSIGHTS ===\n")
+	for _, r := range rules {
+		breached, message := r.check(m)
+		if !breached {
+			continue
+		}
+		if r.severity == severityCritical {
+			fmt.Printf("❌ %s\n", message)
+			result.Pass = false
+			result.Critical = append(result.Critical, r.name)
+		} else {
+			fmt.Printf("⚠️  %s\n", message)
+			result.Warnings = append(result.Warnings, r.name)
+		}
+	}
+
+	// A single line, so CI can grep it
+	encoded, _ := json.Marshal(result)
+	fmt.Printf("\nVERDICT %s\n", encoded)
+	return result
+}
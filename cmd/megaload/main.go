@@ -3,10 +3,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -21,6 +26,12 @@ type Metrics struct {
 	serverErrors5xx int64 // 500+ (server failures)
 	networkErrors   int64 // Timeouts, connection refused, etc
 
+	// Network error breakdown
+	timeoutErrors      int64 // Request or dial timed out
+	connRefusedErrors  int64 // Server not accepting connections
+	dnsErrors          int64 // Host lookup failed
+	otherNetworkErrors int64 // Resets, EOFs, etc
+
 	// Specific errors we care about
 	soldOut409    int64 // Stock sold out
 	userLimit429  int64 // User hit 10 item limit
@@ -51,9 +62,22 @@ func (m *Metrics) recordResponse(statusCode int) {
 	}
 }
 
-func (m *Metrics) recordNetworkError() {
+func (m *Metrics) recordNetworkError(err error) {
 	atomic.AddInt64(&m.requestsCompleted, 1)
 	atomic.AddInt64(&m.networkErrors, 1)
+
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr):
+		atomic.AddInt64(&m.dnsErrors, 1)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		atomic.AddInt64(&m.timeoutErrors, 1)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		atomic.AddInt64(&m.connRefusedErrors, 1)
+	default:
+		atomic.AddInt64(&m.otherNetworkErrors, 1)
+	}
 }
 
 func (m *Metrics) printProgress(userNum int, totalUsers int) {
@@ -92,6 +116,10 @@ func (m *Metrics) printFinal(duration time.Duration) {
 	fmt.Printf("\n--- Server Issues ---\n")
 	fmt.Printf("5xx Server Errors: %d\n", atomic.LoadInt64(&m.serverErrors5xx))
 	fmt.Printf("Network Errors: %d\n", atomic.LoadInt64(&m.networkErrors))
+	fmt.Printf("  Timeouts: %d\n", atomic.LoadInt64(&m.timeoutErrors))
+	fmt.Printf("  Connection refused: %d\n", atomic.LoadInt64(&m.connRefusedErrors))
+	fmt.Printf("  DNS failures: %d\n", atomic.LoadInt64(&m.dnsErrors))
+	fmt.Printf("  Other: %d\n", atomic.LoadInt64(&m.otherNetworkErrors))
 
 	fmt.Printf("\n--- Performance ---\n")
 	fmt.Printf("Overall rate: %.2f req/s\n", float64(sent)/duration.Seconds())
@@ -99,6 +127,84 @@ func (m *Metrics) printFinal(duration time.Duration) {
 	fmt.Printf("Success rate: %.2f req/s\n", float64(atomic.LoadInt64(&m.success201))/duration.Seconds())
 }
 
+// sendCheckout sends a single checkout request for the user and records the outcome
+func sendCheckout(client *http.Client, metrics *Metrics, userNum int) {
+	userID := fmt.Sprintf("mega_user_%d", userNum)
+	url := fmt.Sprintf("http://localhost:8080/checkout?user_id=%s&id=%d", userID, userNum%100000+1)
+
+	resp, err := client.Post(url, "", nil)
+	if err != nil {
+		metrics.recordNetworkError(err)
+		return
+	}
+	defer resp.Body.Close()
+
+	// Read response body for debugging
+	var result map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&result)
+
+	metrics.recordResponse(resp.StatusCode)
+}
+
+// errorRate returns the share of completed requests that failed with 5xx or a network error
+func (m *Metrics) errorRate() float64 {
+	completed := atomic.LoadInt64(&m.requestsCompleted)
+	if completed == 0 {
+		return 0
+	}
+	failed := atomic.LoadInt64(&m.serverErrors5xx) + atomic.LoadInt64(&m.networkErrors)
+	return float64(failed) / float64(completed)
+}
+
+// runAdaptive doubles the concurrency every step until the error rate crosses the
+// threshold, then reports the max sustainable concurrency and throughput
+func runAdaptive(client *http.Client, start, max int, stepDuration time.Duration, errorThreshold float64) {
+	fmt.Printf("Starting adaptive load test: %d to %d concurrent, %v per step, error threshold %.2f%%\n",
+		start, max, stepDuration, errorThreshold*100)
+	fmt.Printf("\n%-12s %-12s %-12s %-12s\n", "Concurrency", "Req/s", "Success/s", "Error rate")
+
+	var userNum int64
+	bestConcurrency, bestThroughput := 0, 0.0
+
+	for concurrency := start; concurrency <= max; concurrency *= 2 {
+		var metrics Metrics
+		var wg sync.WaitGroup
+		deadline := time.Now().Add(stepDuration)
+
+		// Each worker holds one slot of the concurrency and sends requests back to back
+		for w := 0; w < concurrency; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for time.Now().Before(deadline) {
+					atomic.AddInt64(&metrics.requestsSent, 1)
+					sendCheckout(client, &metrics, int(atomic.AddInt64(&userNum, 1)))
+				}
+			}()
+		}
+		wg.Wait()
+
+		throughput := float64(atomic.LoadInt64(&metrics.requestsCompleted)) / stepDuration.Seconds()
+		successRate := float64(atomic.LoadInt64(&metrics.success201)) / stepDuration.Seconds()
+		errorRate := metrics.errorRate()
+		fmt.Printf("%-12d %-12.2f %-12.2f %.2f%%\n", concurrency, throughput, successRate, errorRate*100)
+
+		if errorRate > errorThreshold {
+			fmt.Printf("\nError rate crossed the threshold at %d concurrent\n", concurrency)
+			break
+		}
+		bestConcurrency, bestThroughput = concurrency, throughput
+	}
+
+	fmt.Printf("\n=== ADAPTIVE RESULTS ===\n")
+	if bestConcurrency == 0 {
+		fmt.Printf("⚠️  Error rate was above the threshold even at %d concurrent\n", start)
+		return
+	}
+	fmt.Printf("Max sustainable concurrency: %d\n", bestConcurrency)
+	fmt.Printf("Throughput at max sustainable concurrency: %.2f req/s\n", bestThroughput)
+}
+
 func main() {
 	var (
 		totalUsers = 1000000
@@ -106,10 +212,30 @@ func main() {
 		metrics    Metrics
 	)
 
+	requestTimeout := flag.Duration("timeout", 30*time.Second, "Timeout of each request, including connecting")
+	adaptive := flag.Bool("adaptive", false, "Search for the max sustainable concurrency instead of a fixed run")
+	adaptiveStart := flag.Int("adaptive-start", 50, "Concurrency of the first adaptive step")
+	adaptiveMax := flag.Int("adaptive-max", 8000, "Max concurrency tried by the adaptive search")
+	adaptiveStep := flag.Duration("adaptive-step", 10*time.Second, "Duration of each adaptive step")
+	errorThreshold := flag.Float64("error-threshold", 0.01, "Error rate (5xx + network) that ends the adaptive search")
+
+	var limits thresholds
+	flag.Float64Var(&limits.maxErrorRate, "max-error-rate", 0.01, "Error rate (5xx + network) above which the run fails")
+	flag.Int64Var(&limits.maxLost, "max-lost", 0, "Requests never completed above which the run fails")
+	flag.Float64Var(&limits.minSuccessRate, "min-success-rate", 0, "Share of 201 responses below which the run fails (0 disables)")
+	flag.Parse()
+
+	if *adaptive {
+		concurrent = *adaptiveMax
+	}
+
 	// More aggressive HTTP client settings
 	client := &http.Client{
-		Timeout: 30 * time.Second, // Increased timeout
+		Timeout: *requestTimeout,
 		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: *requestTimeout,
+			}).DialContext,
 			MaxIdleConns:        concurrent * 2,
 			MaxIdleConnsPerHost: concurrent,
 			MaxConnsPerHost:     concurrent,
@@ -117,6 +243,11 @@ func main() {
 		},
 	}
 
+	if *adaptive {
+		runAdaptive(client, *adaptiveStart, *adaptiveMax, *adaptiveStep, *errorThreshold)
+		return
+	}
+
 	fmt.Printf("Starting load test: %d users, %d concurrent\n", totalUsers, concurrent)
 	start := time.Now()
 
@@ -149,21 +280,7 @@ func main() {
 			defer wg.Done()
 			defer func() { <-sem }()
 
-			userID := fmt.Sprintf("mega_user_%d", userNum)
-			url := fmt.Sprintf("http://localhost:8080/checkout?user_id=%s&id=%d", userID, userNum%100000+1)
-
-			resp, err := client.Post(url, "", nil)
-			if err != nil {
-				metrics.recordNetworkError()
-				return
-			}
-			defer resp.Body.Close()
-
-			// Read response body for debugging
-			var result map[string]interface{}
-			json.NewDecoder(resp.Body).Decode(&result)
-
-			metrics.recordResponse(resp.StatusCode)
+			sendCheckout(client, &metrics, userNum)
 		}(i)
 
 		// Remove artificial delays - let the semaphore handle concurrency
@@ -175,20 +292,8 @@ func main() {
 
 	metrics.printFinal(duration)
 
-	// Additional insights
-	fmt.Printf("\n=== INSIGHTS ===\n")
-	if metrics.serverErrors5xx > 0 {
-		fmt.Printf("⚠️  Server errors detected! The server struggled under load.\n")
-	}
-	if metrics.networkErrors > int64(float64(metrics.requestsSent)*0.01) {
-		fmt.Printf("⚠️  High network error rate (>1%%). Server might be dropping connections.\n")
-	}
-	if metrics.success201 < 10000 && metrics.soldOut409 == 0 {
-		fmt.Printf("⚠️  Less than 10k items sold but no 'sold out' responses. Possible issue with stock tracking.\n")
-	}
-
-	lostRequests := metrics.requestsSent - metrics.requestsCompleted
-	if lostRequests > 0 {
-		fmt.Printf("⚠️  %d requests never completed. Possible timeout or connection issues.\n", lostRequests)
+	// Breached critical thresholds fail the run, so it can gate a deployment
+	if !metrics.printInsights(insightRules(limits)).Pass {
+		os.Exit(1)
 	}
 }
@@ -15,6 +15,7 @@ import (
 	"github.com/pcristin/golang_contest/internal/config"
 	"github.com/pcristin/golang_contest/internal/database"
 	myLogger "github.com/pcristin/golang_contest/internal/logger"
+	"github.com/pcristin/golang_contest/internal/utils"
 )
 
 func main() {
@@ -23,22 +24,11 @@ func main() {
 	defer cancel()
 
 	config := config.NewConfig()
-	config.ParseFlags()
+	configErr := config.ParseFlags()
 
-	// Parse log level
-	var logLevel slog.Level
-	switch strings.ToLower(config.GetLogLevel()) {
-	case "debug":
-		logLevel = slog.LevelDebug
-	case "info":
-		logLevel = slog.LevelInfo
-	case "warn":
-		logLevel = slog.LevelWarn
-	case "error":
-		logLevel = slog.LevelError
-	default:
-		logLevel = slog.LevelInfo
-	}
+	// Parse log level (kept in a LevelVar so it can be changed on reload)
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(parseLogLevel(config.GetLogLevel()))
 
 	// Set up slog with JSON handler and level
 	opts := slog.HandlerOptions{
@@ -47,10 +37,21 @@ func main() {
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, &opts))
 	slog.SetDefault(logger)
 
+	if configErr != nil {
+		logger.Error("config | invalid config", "error", configErr)
+		os.Exit(1)
+	}
 	logger.Info("config | config initialized", "config", config)
+	if err := config.Validate(); err != nil {
+		logger.Error("config | invalid config", "error", err)
+		os.Exit(1)
+	}
+
+	// Before any request ID is generated
+	utils.UseUUIDRequestIDs(config.GetUUIDRequestIDs())
 
 	// Initialize Redis
-	redis := database.NewRedisClient(ctx, config.RedisURL)
+	redis := database.NewRedisClient(ctx, config.RedisURL, config.GetRedisKeyPrefix(), config.GetRedisMaxScripts(), checkoutLimits(config))
 	// Fail fast if Redis is not connected
 	if err := redis.HealthCheck(ctx); err != nil {
 		logger.Error("redis | failed to connect to Redis", "error", err)
@@ -58,73 +59,153 @@ func main() {
 	}
 	defer redis.Close()
 
-	// Initialize Postgres
-	postgres, err := database.NewPostgresClient(ctx, config.PostgresURL)
-	if err != nil {
-		logger.Error("postgres | failed to connect to Postgres", "error", err)
-		os.Exit(1)
+	// Dial ahead of the first traffic, a partial warmup just leaves the rest to be dialed lazily
+	if warmup := config.GetRedisPoolWarmup(); warmup > 0 {
+		started := time.Now()
+		warmed, err := redis.WarmUp(ctx, warmup)
+		if err != nil {
+			logger.Warn("redis | pool warmup incomplete", "warmed", warmed, "requested", warmup, "error", err)
+		} else {
+			logger.Info("redis | pool warmed up", "connections", warmed, "duration", time.Since(started))
+		}
 	}
-	defer postgres.Close()
 
-	// Fail fast if Postgres is not connected
-	if err := postgres.HealthCheck(); err != nil {
-		logger.Error("postgres | failed to connect to Postgres", "error", err)
-		os.Exit(1)
-	}
+	// Initialize Postgres, unless load testing the Redis path alone
+	var postgres *database.PostgresClient
+	var err error
+	if config.GetNoPostgres() {
+		logger.Warn("postgres | TESTING ONLY: running without Postgres, checkout attempts and purchases are not stored")
+	} else {
+		postgres, err = database.NewPostgresClient(ctx, config.PostgresURL, config.GetPostgresStatementTimeout())
+		if err != nil {
+			logger.Error("postgres | failed to connect to Postgres", "error", err)
+			os.Exit(1)
+		}
+		defer postgres.Close()
 
-	// Create schema
-	if err := postgres.CreateTables(); err != nil {
-		logger.Error("postgres | failed to create tables", "error", err)
-		os.Exit(1)
+		// Fail fast if Postgres is not connected
+		if err := postgres.HealthCheck(ctx); err != nil {
+			logger.Error("postgres | failed to connect to Postgres", "error", err)
+			os.Exit(1)
+		}
+
+		// Create schema
+		if err := postgres.CreateTables(ctx); err != nil {
+			logger.Error("postgres | failed to create tables", "error", err)
+			os.Exit(1)
+		}
 	}
 
 	// Initialize router
 	mux := http.NewServeMux()
 
+	// Load the catalog of sale items
+	var catalog []utils.CatalogItem
+	if config.GetCatalogFile() != "" {
+		catalog, err = utils.LoadCatalog(config.GetCatalogFile())
+		if err != nil {
+			logger.Error("catalog | failed to load catalog", "path", config.GetCatalogFile(), "error", err)
+			os.Exit(1)
+		}
+		logger.Info("catalog | catalog loaded", "items", len(catalog))
+	}
+
 	// Initialize handler
-	handler := api.NewHandler(config, redis, postgres)
+	handler := api.NewHandler(config, redis, postgres, utils.NewItemGenerator(catalog))
+	if config.GetMaintenanceMode() {
+		logger.Warn("server | starting in maintenance mode, turn it off via POST /admin/maintenance?enabled=false")
+	}
 
 	// Start background workers
-	wg := sync.WaitGroup{}
-	wg.Add(4)
-	go func() {
-		defer wg.Done()
-		workerCtx := context.WithValue(ctx, myLogger.SourceKey, "checkout_worker")
-		handler.ProcessCheckoutAttempts(workerCtx)
-	}()
+	workers := newWorkerGroup()
+	handler.Background = func(name string, fn func(ctx context.Context)) {
+		workerCtx := context.WithValue(ctx, myLogger.SourceKey, name)
+		// Once shutting down the task runs right away, it sees the cancelled context
+		if !workers.Go(name, func() { fn(workerCtx) }) {
+			fn(workerCtx)
+		}
+	}
+	if postgres != nil {
+		startPostgresWorkers(ctx, config, handler, workers)
+	}
 
-	go func() {
-		defer wg.Done()
-		workerCtx := context.WithValue(ctx, myLogger.SourceKey, "expired_checkouts_worker")
-		handler.ProcessExpiredCheckouts(workerCtx)
-	}()
+	workers.Go("reservation_worker", func() {
+		workerCtx := context.WithValue(ctx, myLogger.SourceKey, "reservation_worker")
+		handler.ProcessReservationPruning(workerCtx)
+	})
+
+	workers.Go("sale_key_worker", func() {
+		workerCtx := context.WithValue(ctx, myLogger.SourceKey, "sale_key_worker")
+		handler.ProcessSaleKeyRefresh(workerCtx)
+	})
+
+	if config.GetPurchaseWebhookURL() != "" {
+		workers.Go("purchase_webhook_worker", func() {
+			workerCtx := context.WithValue(ctx, myLogger.SourceKey, "purchase_webhook_worker")
+			handler.ProcessPurchaseWebhooks(workerCtx)
+		})
+	}
 
-	go func() {
-		defer wg.Done()
-		workerCtx := context.WithValue(ctx, myLogger.SourceKey, "sale_scheduler")
-		handler.StartSaleScheduler(workerCtx)
-	}()
+	// Instances without the scheduler serve the sale created by the writer instance
+	if config.GetDisableScheduler() {
+		logger.Info("sale scheduler | scheduler disabled, no sales will be created by this instance")
+		schedulerCtx := context.WithValue(ctx, myLogger.SourceKey, "sale_scheduler")
+		handler.LoadSaleSchedule(schedulerCtx)
+		handler.WarmActiveSaleCache(schedulerCtx)
+		handler.MarkReady()
+	} else {
+		workers.Go("sale_scheduler", func() {
+			workerCtx := context.WithValue(ctx, myLogger.SourceKey, "sale_scheduler")
+			handler.StartSaleScheduler(workerCtx)
+		})
+	}
 
-	go func() {
-		defer wg.Done()
-		workerCtx := context.WithValue(ctx, myLogger.SourceKey, "purchase_worker")
-		handler.ProcessPurchaseInserts(workerCtx)
-	}()
+	// Admin routes get their own router when served on a separate port
+	adminMux := mux
+	if config.GetAdminPort() != "" {
+		adminMux = http.NewServeMux()
+	}
 
-	// Add routes
+	// Add routes (GET patterns match HEAD requests as well)
 	mux.HandleFunc("GET /health", handler.Health)
-	mux.HandleFunc("POST /checkout", handler.Checkout)
-	mux.HandleFunc("POST /purchase", handler.Purchase)
+	mux.HandleFunc("GET /ready", handler.Ready)
+	mux.Handle("POST /checkout", api.RequireJSONBody(http.HandlerFunc(handler.Checkout)))
+	mux.HandleFunc("POST /checkout/extend", handler.ExtendCheckout)
+	mux.Handle("POST /purchase", api.RequireJSONBody(http.HandlerFunc(handler.Purchase)))
+	mux.HandleFunc("GET /users/{user_id}/allowance", handler.Allowance)
+
+	// Admin routes, all behind the admin token
+	adminMux.HandleFunc("GET /admin/checkout/{code}", handler.InspectCheckoutCode)
+	adminMux.HandleFunc("POST /admin/add-stock", handler.AddStock)
+	adminMux.HandleFunc("POST /admin/reset-user", handler.ResetUser)
+	adminMux.HandleFunc("POST /admin/clear-reservations", handler.ClearReservations)
+	adminMux.HandleFunc("POST /admin/sweep-expired", handler.SweepExpired)
+	adminMux.HandleFunc("POST /admin/maintenance", handler.SetMaintenance)
+
+	// Routes reading from Postgres
+	if postgres != nil {
+		mux.HandleFunc("GET /users/{user_id}/purchased", handler.PurchasedItems)
+		adminMux.HandleFunc("GET /sales/{id}/purchases.csv", handler.ExportSalePurchases)
+		adminMux.HandleFunc("GET /users/{user_id}/attempts", handler.UserAttempts)
+		adminMux.HandleFunc("GET /sales/search", handler.SearchSales)
+	}
+
+	addr, err := config.GetListenAddr()
+	if err != nil {
+		logger.Error("server | invalid bind address", "error", err)
+		os.Exit(1)
+	}
 
 	// Graceful shutdown
-	// Initialize server
-	server := &http.Server{
-		Addr:           ":" + config.GetPort(),
-		Handler:        mux,
-		ReadTimeout:    5 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		IdleTimeout:    120 * time.Second,
-		MaxHeaderBytes: 1 << 20, // 1MB
+	// Initialize servers
+	servers := []*http.Server{newServer(addr, mux, config, handler)}
+	if adminMux != mux {
+		adminAddr, err := config.GetAdminListenAddr()
+		if err != nil {
+			logger.Error("server | invalid admin bind address", "error", err)
+			os.Exit(1)
+		}
+		servers = append(servers, newServer(adminAddr, adminMux, config, handler))
 	}
 
 	// Channel for notification the main goroutine that connections are closed
@@ -149,42 +230,169 @@ func main() {
 			cancel() // Stop workers
 
 			// Step 2 - Wait for workers to finish
-			wg.Wait()
+			workers.Wait()
 			logger.Info("server | workers finished")
 
-			// Step 3 - Shutdown server
-			if err := server.Shutdown(context.Background()); err != nil {
-				logger.Error("server error | could not shutdown server", "error", err)
+			// Step 3 - Shutdown servers
+			var shutdownWg sync.WaitGroup
+			for _, server := range servers {
+				shutdownWg.Add(1)
+				go func() {
+					defer shutdownWg.Done()
+					if err := server.Shutdown(context.Background()); err != nil {
+						logger.Error("server error | could not shutdown server", "addr", server.Addr, "error", err)
+					}
+				}()
 			}
+			shutdownWg.Wait()
 			logger.Info("server | HTTP server shutdown completed")
 
 			// Step 4 - Close shutdown complete channel
 			close(shutdownComplete)
 		}()
 
+		timedOut := false
 		select {
 		case <-shutdownComplete:
 			logger.Info("server | graceful shutdown completed")
 		case <-time.After(30 * time.Second):
+			timedOut = true
 			logger.Warn("server | graceful shutdown timed out (30 seconds)")
 			logger.Warn("server | WARNING: some operations may not been completed cleanly")
 		}
 
+		// One line with everything that was or wasn't done before exiting
+		finished, running := workers.Status()
+		summary := handler.ShutdownSummary()
+		logger.Info("server | shutdown summary",
+			"timed_out", timedOut,
+			"workers_finished", finished,
+			"workers_running", running,
+			"attempts_flushed", summary.AttemptsFlushed,
+			"purchases_flushed", summary.PurchasesFlushed,
+			"attempts_dropped", summary.AttemptsDropped,
+			"purchases_dropped", summary.PurchasesDropped,
+			"purchase_webhooks_dropped", summary.PurchaseWebhooksDropped,
+			"attempts_queued", summary.AttemptsQueued,
+			"purchases_queued", summary.PurchasesQueued,
+			"purchase_webhooks_queued", summary.PurchaseWebhooksQueued,
+		)
+
 		close(idleConnsClosed)
 	}()
 
-	// Start the server in a goroutine to allow graceful shutdown
+	// Reload the runtime-safe settings on SIGHUP
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
 	go func() {
-		logger.Info("server | running on port", "port", config.GetPort())
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logger.Error("server error | could not listen on port", "port", config.GetPort(), "error", err)
-			// Signal shutdown if server fails to start
-			sigint <- syscall.SIGTERM
+		for range sighup {
+			ignored, err := config.Reload()
+			if err != nil {
+				logger.Error("config | failed to reload config", "error", err)
+				continue
+			}
+			logLevel.Set(parseLogLevel(config.GetLogLevel()))
+			redis.SetCheckoutLimits(checkoutLimits(config))
+			if len(ignored) > 0 {
+				logger.Warn("config | changed settings require a restart and were ignored", "settings", ignored)
+			}
+			logger.Info("config | config reloaded", "log_level", config.GetLogLevel(), "user_checkout_limit", config.GetUserCheckoutLimit())
 		}
 	}()
 
+	// Start the servers in goroutines to allow graceful shutdown
+	for _, server := range servers {
+		go func() {
+			logger.Info("server | listening", "addr", server.Addr)
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("server error | could not listen", "addr", server.Addr, "error", err)
+				// Signal shutdown if a server fails to start, once is enough
+				select {
+				case sigint <- syscall.SIGTERM:
+				default:
+				}
+			}
+		}()
+	}
+
 	// Wait for idle connections to be closed
 	<-idleConnsClosed
 
 	logger.Info("server | server stopped")
 }
+
+// parseLogLevel parses the log level from the config, defaulting to info
+func parseLogLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "info":
+		return slog.LevelInfo
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// newServer creates an HTTP server with the shared middlewares and timeouts
+func newServer(addr string, mux *http.ServeMux, config *config.Config, handler *api.Handler) *http.Server {
+	return &http.Server{
+		Addr:           addr,
+		Handler:        api.Compress(api.Recover(handler.Maintenance(api.JSONErrors(mux)), config.GetDebugErrors()), config.GetCompressionMinSize(), config.GetCompressionTypes()),
+		ReadTimeout:    5 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		IdleTimeout:    120 * time.Second,
+		MaxHeaderBytes: 1 << 20, // 1MB
+	}
+}
+
+// checkoutLimits returns the limits of the checkouts from the config
+func checkoutLimits(config *config.Config) database.CheckoutLimits {
+	return database.CheckoutLimits{
+		MaxItemsPerUser: config.GetUserCheckoutLimit(),
+		MaxTotalItems:   config.GetSaleItemCap(),
+		Cooldown:        config.GetUserCheckoutCooldown(),
+	}
+}
+
+// startPostgresWorkers starts the background workers writing to Postgres
+func startPostgresWorkers(ctx context.Context, config *config.Config, handler *api.Handler, workers *workerGroup) {
+	// Each insert worker flushes its own batch on shutdown
+	for range config.GetAttemptWorkers() {
+		workers.Go("checkout_worker", func() {
+			workerCtx := context.WithValue(ctx, myLogger.SourceKey, "checkout_worker")
+			handler.ProcessCheckoutAttempts(workerCtx)
+		})
+	}
+
+	for range config.GetPurchaseWorkers() {
+		workers.Go("purchase_worker", func() {
+			workerCtx := context.WithValue(ctx, myLogger.SourceKey, "purchase_worker")
+			handler.ProcessPurchaseInserts(workerCtx)
+		})
+	}
+
+	workers.Go("expired_checkouts_worker", func() {
+		workerCtx := context.WithValue(ctx, myLogger.SourceKey, "expired_checkouts_worker")
+		handler.ProcessExpiredCheckouts(workerCtx)
+	})
+
+	workers.Go("retention_worker", func() {
+		workerCtx := context.WithValue(ctx, myLogger.SourceKey, "retention_worker")
+		handler.ProcessAttemptsRetention(workerCtx)
+	})
+
+	workers.Go("archival_worker", func() {
+		workerCtx := context.WithValue(ctx, myLogger.SourceKey, "archival_worker")
+		handler.ProcessPurchasesArchival(workerCtx)
+	})
+
+	workers.Go("user_count_worker", func() {
+		workerCtx := context.WithValue(ctx, myLogger.SourceKey, "user_count_worker")
+		handler.ProcessUserCountChecks(workerCtx)
+	})
+}
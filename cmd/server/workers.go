@@ -0,0 +1,71 @@
+package main
+
+import (
+	"slices"
+	"sync"
+)
+
+// workerGroup is a WaitGroup that knows the names of its running workers,
+// so a shutdown that times out can tell which workers were still busy
+type workerGroup struct {
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	running  map[string]int
+	finished int
+	closed   bool // set by Wait, no workers start after it
+}
+
+// newWorkerGroup creates an empty workerGroup
+func newWorkerGroup() *workerGroup {
+	return &workerGroup{running: make(map[string]int)}
+}
+
+// Go runs fn in a goroutine tracked under name. Several workers may share a name.
+// Returns false without running fn once Wait was called.
+func (g *workerGroup) Go(name string, fn func()) bool {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return false
+	}
+	g.running[name]++
+	g.wg.Add(1)
+	g.mu.Unlock()
+
+	go func() {
+		defer g.wg.Done()
+		defer g.done(name)
+		fn()
+	}()
+	return true
+}
+
+// done records that a worker finished
+func (g *workerGroup) done(name string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.running[name]--
+	if g.running[name] == 0 {
+		delete(g.running, name)
+	}
+	g.finished++
+}
+
+// Wait waits for all workers to finish. Workers can't be started afterwards.
+func (g *workerGroup) Wait() {
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+	g.wg.Wait()
+}
+
+// Status returns the number of finished workers and the sorted names of the running ones
+func (g *workerGroup) Status() (finished int, running []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for name := range g.running {
+		running = append(running, name)
+	}
+	slices.Sort(running)
+	return g.finished, running
+}
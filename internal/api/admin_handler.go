@@ -0,0 +1,480 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pcristin/golang_contest/internal/database"
+	myLogger "github.com/pcristin/golang_contest/internal/logger"
+	"github.com/pcristin/golang_contest/internal/utils"
+)
+
+// requireAdmin checks the admin token of the request and writes an error response if it's invalid.
+// Admin endpoints are disabled when no admin token is configured.
+func (h *Handler) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	adminToken := h.Config.GetAdminToken()
+	if adminToken == "" {
+		http.Error(w, "admin endpoints are disabled", http.StatusForbidden)
+		return false
+	}
+
+	if !h.isAdmin(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// isAdmin reports whether the request carries the admin token, for public
+// endpoints that show more details to admins
+func (h *Handler) isAdmin(r *http.Request) bool {
+	adminToken := h.Config.GetAdminToken()
+	if adminToken == "" {
+		return false
+	}
+	providedToken := r.Header.Get("X-Admin-Token")
+	return subtle.ConstantTimeCompare([]byte(providedToken), []byte(adminToken)) == 1
+}
+
+// Page sizes of the user attempts endpoint
+const (
+	defaultAttemptsLimit = 20
+	maxAttemptsLimit     = 100
+)
+
+// UserAttempts returns the checkout attempts of a user in a sale, the active one by
+// default, newest first. Attempts are inserted in the background, so the latest
+// ones may show up with a short delay.
+func (h *Handler) UserAttempts(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), myLogger.RequestIDKey, utils.GenerateRequestID())
+	logger := myLogger.FromContext(ctx, "admin")
+
+	// Codes of successful attempts can be purchased, so they are not public
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	userID := r.PathValue("user_id")
+	if userID == "" {
+		http.Error(w, "user_id is required", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	var saleID int
+	if saleIDStr := query.Get("sale_id"); saleIDStr != "" {
+		var err error
+		saleID, err = strconv.Atoi(saleIDStr)
+		if err != nil || saleID <= 0 {
+			http.Error(w, "invalid sale ID", http.StatusBadRequest)
+			return
+		}
+	} else {
+		activeSaleID, err := h.Redis.GetActiveSaleID(ctx)
+		if err != nil {
+			logger.Error("admin | failed to get active sale ID", "error", err)
+			http.Error(w, "no sale is active", http.StatusBadRequest)
+			return
+		}
+		saleID = activeSaleID
+	}
+
+	limit := defaultAttemptsLimit
+	if limitStr := query.Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxAttemptsLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxAttemptsLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	offset := 0
+	if offsetStr := query.Get("offset"); offsetStr != "" {
+		var err error
+		offset, err = strconv.Atoi(offsetStr)
+		if err != nil || offset < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Statuses are stored with spaces, "user_limit" reads better in a URL
+	var status *database.CheckoutStatus
+	if statusStr := query.Get("status"); statusStr != "" {
+		parsed, err := database.ParseCheckoutStatus(strings.ReplaceAll(statusStr, "_", " "))
+		if err != nil {
+			http.Error(w, "invalid status", http.StatusBadRequest)
+			return
+		}
+		status = &parsed
+	}
+
+	attempts, err := h.Postgres.GetAttemptsByUser(ctx, userID, saleID, status, limit, offset)
+	if err != nil {
+		logger.Error("admin | failed to get user attempts", "user_id", userID, "sale_id", saleID, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := UserAttemptsResponse{
+		UserID:   userID,
+		SaleID:   saleID,
+		Limit:    limit,
+		Offset:   offset,
+		Attempts: make([]AttemptInfo, 0, len(attempts)),
+	}
+	for _, attempt := range attempts {
+		response.Attempts = append(response.Attempts, AttemptInfo{
+			ID:        attempt.ID,
+			ItemID:    attempt.ItemID,
+			Code:      attempt.Code,
+			Status:    attempt.Status.String(),
+			CreatedAt: attempt.CreatedAt.UTC().Format(time.RFC3339),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// SearchSales looks up the sales of an item by its name, e.g. from a customer screenshot
+func (h *Handler) SearchSales(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), myLogger.RequestIDKey, utils.GenerateRequestID())
+	logger := myLogger.FromContext(ctx, "admin")
+
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	itemName := strings.TrimSpace(r.URL.Query().Get("item_name"))
+	if itemName == "" {
+		http.Error(w, "item_name is required", http.StatusBadRequest)
+		return
+	}
+
+	sales, err := h.Postgres.GetSaleByItemName(ctx, itemName)
+	if err != nil {
+		logger.Error("admin | failed to search sales", "item_name", itemName, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := SaleSearchResponse{
+		ItemName: itemName,
+		Sales:    make([]SaleRecordInfo, 0, len(sales)),
+	}
+	for _, sale := range sales {
+		info := SaleRecordInfo{
+			ID:        sale.ID,
+			ItemName:  sale.ItemName,
+			ImageURL:  sale.ImageURL,
+			StartedAt: sale.StartedAt.UTC().Format(time.RFC3339),
+		}
+		if sale.EndedAt != nil {
+			endedAt := sale.EndedAt.UTC().Format(time.RFC3339)
+			info.EndedAt = &endedAt
+		}
+		response.Sales = append(response.Sales, info)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// ExportSalePurchases writes all purchases of a sale as CSV
+func (h *Handler) ExportSalePurchases(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), myLogger.RequestIDKey, utils.GenerateRequestID())
+	logger := myLogger.FromContext(ctx, "admin")
+
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	saleID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || saleID <= 0 {
+		http.Error(w, "invalid sale ID", http.StatusBadRequest)
+		return
+	}
+
+	// Large exports take longer than the server write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		logger.Warn("admin | failed to clear write deadline", "error", err)
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"sale_%d_purchases.csv\"", saleID))
+
+	// Don't stream the whole sale just to throw it away
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"id", "user_id", "sale_id", "item_id", "purchased_at"})
+
+	// Rows are written as they are read, flushing every 1000 rows
+	rowsWritten := 0
+	err = h.Postgres.StreamPurchasesBySale(ctx, saleID, func(purchase database.Purchase) error {
+		if err := writer.Write([]string{
+			strconv.Itoa(purchase.ID),
+			purchase.UserID,
+			strconv.Itoa(purchase.SaleID),
+			purchase.ItemID,
+			purchase.PurchasedAt.UTC().Format(time.RFC3339),
+		}); err != nil {
+			return err
+		}
+		rowsWritten++
+		if rowsWritten%1000 == 0 {
+			writer.Flush()
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		}
+		return writer.Error()
+	})
+	writer.Flush()
+
+	// Headers are already sent, so the export can only be cut short
+	if err != nil {
+		logger.Error("admin | failed to export sale purchases", "sale_id", saleID, "rows_written", rowsWritten, "error", err)
+		return
+	}
+	logger.Info("admin | exported sale purchases", "sale_id", saleID, "rows_written", rowsWritten)
+}
+
+// InspectCheckoutCode returns the reservation of a checkout code without consuming it
+func (h *Handler) InspectCheckoutCode(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), myLogger.RequestIDKey, utils.GenerateRequestID())
+	logger := myLogger.FromContext(ctx, "admin")
+
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	code := r.PathValue("code")
+	if code == "" {
+		http.Error(w, "code is required", http.StatusBadRequest)
+		return
+	}
+
+	data, err := h.Redis.GetCheckoutCode(ctx, code)
+	if errors.Is(err, database.ErrCheckoutCodeNotFound) {
+		http.Error(w, "invalid or expired code", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Error("admin | failed to get checkout code", "code", code, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	ttl, err := h.Redis.GetCodeTTL(ctx, code)
+	if err != nil {
+		logger.Error("admin | failed to get checkout code TTL", "code", code, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := CheckoutCodeResponse{
+		Code:       code,
+		UserID:     data.UserID,
+		SaleID:     data.SaleID,
+		ItemID:     data.ItemID,
+		CreatedAt:  data.CreatedAt,
+		TTLSeconds: ttl,
+	}
+
+	switch ttl {
+	case database.TTLKeyMissing:
+		// The code expired between both reads
+		http.Error(w, "invalid or expired code", http.StatusNotFound)
+		return
+	case database.TTLNoExpire:
+		// Codes are always stored with a TTL, so this points at a bug or a manual edit
+		logger.Warn("admin | checkout code has no expiration", "code", code)
+		response.TTLSeconds = 0
+		response.NoExpiry = true
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// AddStock adds physical stock to the active sale and raises its item cap
+func (h *Handler) AddStock(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), myLogger.RequestIDKey, utils.GenerateRequestID())
+	logger := myLogger.FromContext(ctx, "admin")
+
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	amount, err := strconv.Atoi(r.URL.Query().Get("amount"))
+	if err != nil || amount <= 0 {
+		http.Error(w, "amount must be a positive integer", http.StatusBadRequest)
+		return
+	}
+
+	saleID, err := h.Redis.GetActiveSaleID(ctx)
+	if err != nil {
+		logger.Error("admin | failed to get active sale ID", "error", err)
+		http.Error(w, "no sale is active", http.StatusConflict)
+		return
+	}
+
+	totals, err := h.Redis.AddSaleStock(ctx, saleID, amount)
+	if errors.Is(err, database.ErrSaleKeysNotFound) {
+		http.Error(w, "no sale is active", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logger.Error("admin | failed to add stock", "sale_id", saleID, "amount", amount, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Otherwise restoring the sale's keys would lose the added stock
+	if h.Postgres != nil {
+		if err := h.Postgres.AddSaleStock(ctx, saleID, amount); err != nil {
+			logger.Error("admin | failed to record added stock, a restore of the sale would lose it", "sale_id", saleID, "amount", amount, "error", err)
+		}
+	}
+
+	// Sales created without an item cap key are capped by the config
+	itemCap := int(totals.ItemCap)
+	if itemCap == 0 {
+		itemCap = h.Config.GetSaleItemCap()
+	}
+
+	logger.Info("admin | added stock to active sale", "sale_id", saleID, "amount", amount,
+		"stock", totals.Stock, "initial_stock", totals.InitialStock)
+
+	response := AddStockResponse{
+		SaleID:       saleID,
+		Added:        amount,
+		Stock:        totals.Stock,
+		InitialStock: totals.InitialStock,
+		ItemCap:      itemCap,
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// ResetUser resets the checkout count of a user in the current sale.
+// Recovers users locked out by a count that couldn't be rolled back.
+func (h *Handler) ResetUser(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), myLogger.RequestIDKey, utils.GenerateRequestID())
+	logger := myLogger.FromContext(ctx, "admin")
+
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		http.Error(w, "user_id is required", http.StatusBadRequest)
+		return
+	}
+
+	previous, err := h.Redis.ResetUserCheckoutCount(ctx, userID)
+	if err != nil {
+		logger.Error("admin | failed to reset user checkout count", "user_id", userID, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("admin | reset user checkout count", "user_id", userID, "previous_count", previous)
+
+	response := ResetUserResponse{
+		UserID:        userID,
+		PreviousCount: previous,
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// ClearReservations force-expires all outstanding checkout codes and gives their
+// items back to the sale. Meant for incident recovery, running it again is safe.
+func (h *Handler) ClearReservations(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), myLogger.RequestIDKey, utils.GenerateRequestID())
+	logger := myLogger.FromContext(ctx, "admin")
+
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	saleID, err := h.Redis.GetActiveSaleID(ctx)
+	if err != nil {
+		logger.Error("admin | failed to get active sale ID", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	cleared, err := h.Redis.ClearReservations(ctx)
+	if err != nil {
+		// Codes cleared so far stay cleared, running it again finishes the job
+		logger.Error("admin | failed to clear reservations", "cleared", cleared, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger.Warn("admin | cleared all reservations", "sale_id", saleID, "cleared", cleared)
+
+	response := ClearReservationsResponse{
+		SaleID:  saleID,
+		Cleared: cleared,
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// SweepExpired runs the expired checkout sweep right away instead of waiting for
+// the next tick of the background workers: the items of expired codes go back to
+// the sale and, with Postgres, their attempts are marked expired. Running it again is safe.
+func (h *Handler) SweepExpired(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), myLogger.RequestIDKey, utils.GenerateRequestID())
+	logger := myLogger.FromContext(ctx, "admin")
+
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	saleID, err := h.Redis.GetActiveSaleID(ctx)
+	if err != nil {
+		logger.Error("admin | failed to get active sale ID", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	released, err := h.Redis.PruneReservations(ctx)
+	if err != nil {
+		logger.Error("admin | failed to prune expired reservations", "released", released, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Attempts are only tracked in Postgres
+	expired := 0
+	if h.Postgres != nil {
+		expired, err = h.CleanupExpiredCheckouts(ctx)
+		if err != nil {
+			logger.Error("admin | failed to clean up expired checkout attempts", "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	logger.Info("admin | swept expired checkouts", "sale_id", saleID, "expired", expired, "released", released)
+
+	response := SweepExpiredResponse{
+		SaleID:   saleID,
+		Expired:  expired,
+		Released: released,
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
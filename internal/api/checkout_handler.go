@@ -2,16 +2,24 @@ package api
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
 	"net/http"
 	"strconv"
 	"time"
 
+	"github.com/pcristin/golang_contest/internal/config"
 	"github.com/pcristin/golang_contest/internal/database"
 	myLogger "github.com/pcristin/golang_contest/internal/logger"
 	"github.com/pcristin/golang_contest/internal/utils"
 )
 
+// checkoutCodeTTL is how long a checkout code reserves an item (in seconds),
+// unless the catalog sets another TTL for the item
+const checkoutCodeTTL = 20
+
 func (h *Handler) Checkout(w http.ResponseWriter, r *http.Request) {
 
 	// Generate a request ID
@@ -25,9 +33,33 @@ func (h *Handler) Checkout(w http.ResponseWriter, r *http.Request) {
 	// Init logger for module
 	logger := myLogger.FromContext(ctx, "checkout")
 
-	// Check if the request method is POST
-	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	// Time the checkout phases, only at debug level to keep the hot path lean
+	timing := newCheckoutTiming(logger.Enabled(ctx, slog.LevelDebug))
+	if timing.enabled {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		w = recorder
+		defer func() { timing.log(logger, recorder.status) }()
+	}
+
+	// Checked first, a pinned client can't use a response it doesn't understand
+	version, ok := requestedAPIVersion(r)
+	if !ok {
+		rejectAPIVersion(w)
+		return
+	}
+
+	// The active sale isn't known until the startup recovery is done
+	if !h.ready.Load() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "server is starting, try again", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Fail loudly before the attempt of a reservation would be dropped
+	if h.attemptBackpressure() {
+		logger.Warn("checkout attempt queue is nearly full, refusing checkout", "queued", len(h.attemptsChan))
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
 		return
 	}
 
@@ -38,14 +70,16 @@ func (h *Handler) Checkout(w http.ResponseWriter, r *http.Request) {
 
 	logger.Debug("request received", "path", r.URL.Path, "method", r.Method, "userID", userID, "id", itemID)
 
-	// Check if user_id and id are present
-	if userID == "" || itemID == "" {
+	// Check if user_id and id are present, id may default to the single item of the sale
+	defaultItemID := h.Config.GetDefaultItemID()
+	if userID == "" || (itemID == "" && !defaultItemID) {
 		http.Error(w, "user_id and id are required", http.StatusBadRequest)
 		return
 	}
 
 	// Check if the sale is active
 	saleIDStr, err := h.Redis.GetSaleCurrentID(ctx)
+	timing.mark("sale_lookup")
 	if err != nil {
 		logger.Error("failed to get current sale ID", "error", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
@@ -54,7 +88,7 @@ func (h *Handler) Checkout(w http.ResponseWriter, r *http.Request) {
 
 	if saleIDStr == "" {
 		logger.Error("no sale is active")
-		http.Error(w, "no sale is active", http.StatusBadRequest)
+		h.writeNoSale(ctx, w)
 		return
 	}
 
@@ -65,129 +99,272 @@ func (h *Handler) Checkout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// An explicit id always wins, the default only applies to single-item sales
+	if itemID == "" {
+		singleItemID, ok, err := h.singleSaleItemID(ctx, saleID)
+		if err != nil {
+			logger.Error("failed to get sale item IDs", "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "id is required, the sale has more than one item", http.StatusBadRequest)
+			return
+		}
+		itemID = singleItemID
+	}
+
+	// Validate the item ID before touching any counters
+	providedItemID, err := strconv.ParseInt(itemID, 10, 64)
+	if err != nil || providedItemID <= 0 {
+		logger.Error("failed to parse item ID", "error", err)
+		http.Error(w, "invalid item ID", http.StatusBadRequest)
+		return
+	}
+	itemID = strconv.FormatInt(providedItemID, 10)
+
+	inSale, err := h.isItemInSale(ctx, saleID, itemID)
+	if err != nil {
+		logger.Error("failed to get sale item IDs", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !inSale {
+		http.Error(w, "item not in this sale", http.StatusBadRequest)
+		return
+	}
+
 	// Create a new checkout attempt
 	attempt := database.CheckoutAttempt{
 		UserID:    userID,
 		SaleID:    saleID,
 		ItemID:    itemID,
 		Code:      nil,
-		Status:    "pending",
-		CreatedAt: time.Now(),
+		Status:    database.CheckoutStatusPending,
+		CreatedAt: h.Clock.Now(),
 	}
 
+	// Set once the attempt was written inline, in sync purchase write mode
+	attemptStored := false
+
 	defer func() {
+		// Nobody stores attempts without Postgres
+		if h.Postgres == nil || attemptStored {
+			return
+		}
+		// Every outcome sets its status, only internal errors leave it pending
+		if attempt.Status == database.CheckoutStatusPending {
+			attempt.Status = database.CheckoutStatusUnknownError
+		}
 		select {
 		case h.attemptsChan <- attempt:
 			// Sent to the background worker
 		default:
-			logger.Error("dropped attempt: channel full")
+			h.attemptDrops.add(logger)
 		}
 	}()
 
-	// Decrement the stock
-	_, err = h.Redis.DecrementStockFastFail(ctx)
+	// Generate a checkout code
+	checkoutCode := utils.GenerateCode()
+	timing.mark("generate_code")
+
+	// Reserve the item and store the code in one step, a refused checkout changes nothing
+	limits := h.Redis.CheckoutLimits()
+	ttl := h.checkoutTTL(saleID)
+	status, err := h.Redis.AtomicCheckout(ctx, userID, itemID, checkoutCode, ttl)
+	timing.mark("reserve")
 	if err != nil {
-		logger.Error("failed to decrement stock", "error", err)
+		logger.Error("failed to check out", "error", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	// Increment the user checkout count to avoid race conditions
-	userCheckoutCount, err := h.Redis.IncrementUserCheckoutCount(ctx, userID)
-	if err != nil {
-		logger.Error("failed to increment user checkout count", "error", err)
-		if _, err := h.Redis.IncrementStockFastFail(ctx); err != nil {
-			logger.Error("failed to increment stock", "error", err)
-		}
-		if err := h.Redis.DecrementUserCheckoutCount(ctx, userID); err != nil {
-			logger.Error("failed to decrement user checkout count", "error", err)
+	switch status {
+	case database.CheckoutStatusUserLimit:
+		attempt.Status = database.CheckoutStatusUserLimit
+		http.Error(w, fmt.Sprintf("user has already checked out %d items", limits.MaxItemsPerUser), http.StatusTooManyRequests)
+		return
+	case database.CheckoutStatusCooldown:
+		attempt.Status = database.CheckoutStatusCooldown
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limits.Cooldown.Seconds()))))
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+		return
+	case database.CheckoutStatusSaleLimit:
+		// The cap may be below the stock to keep a buffer, so it fires before stock runs out
+		logger.Error("sale has reached the maximum number of items sold")
+		attempt.Status = database.CheckoutStatusSaleLimit
+		if h.Config.GetSaleAutoEnd() {
+			h.endSoldOutSale(ctx, saleID)
 		}
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		http.Error(w, "stock sold out", http.StatusConflict)
 		return
 	}
 
-	if userCheckoutCount > 10 {
-		// Send the attempt to the background worker
-		attempt.Status = "user limit"
-
-		// Decrement the user checkout count to avoid race conditions
-		if err := h.Redis.DecrementUserCheckoutCount(ctx, userID); err != nil {
-			logger.Error("failed to decrement user checkout count", "error", err)
+	// Send the attempt to the background worker
+	attempt.Status = database.CheckoutStatusSuccess
+	attempt.Code = &checkoutCode
+	attempt.TTL = ttl
+
+	// Sync purchases complete the attempt, so it must be stored before the code is handed out
+	if h.Config.GetPurchaseWriteMode() == config.PurchaseWriteModeSync {
+		err = h.Postgres.InsertSingleAttempt(ctx, attempt)
+		timing.mark("store_attempt")
+		if err != nil {
+			logger.Error("failed to store checkout attempt", "error", err)
+			attempt.Status = database.CheckoutStatusUnknownError
+			attempt.Code = nil
+			attempt.TTL = 0
+			if _, err := h.Redis.ReleaseReservation(ctx, checkoutCode); err != nil {
+				logger.Error("failed to release reservation", "error", err)
+			}
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
 		}
+		attemptStored = true
+	}
 
-		// Increment the stock to avoid race conditions
-		if _, err := h.Redis.IncrementStockFastFail(ctx); err != nil {
-			logger.Error("failed to increment stock", "error", err)
+	// Return the checkout code
+	response := CheckoutResponse{
+		Code: checkoutCode,
+	}
+
+	// Sale metadata comes from the cache only, a cold cache just leaves it out
+	if h.Config.GetCheckoutIncludeSale() {
+		if saleData, ok := h.saleCache.Load(saleID); ok {
+			response.ItemName = saleData.ItemName
+			response.ImageURL = saleData.ImageURL
 		}
 
-		http.Error(w, "user has already checked out 10 items", http.StatusTooManyRequests)
-		return
+		// The sale runs until the next one starts. Older sales may have no start time.
+		if startedAt, err := h.Redis.GetSaleStartedAt(ctx); err != nil {
+			logger.Warn("failed to get sale start time", "error", err)
+		} else if !startedAt.IsZero() {
+			response.SaleStartedAt = startedAt.UTC().Format(time.RFC3339)
+			response.SaleEndsAt = h.nextSaleStart(startedAt).UTC().Format(time.RFC3339)
+		}
 	}
 
-	// Validate the item ID
-	providedItemID, err := strconv.ParseInt(itemID, 10, 64)
-	if err != nil || providedItemID <= 0 {
-		logger.Error("failed to parse item ID", "error", err)
-		http.Error(w, "invalid item ID", http.StatusBadRequest)
-		return
+	writeVersionedJSON(w, http.StatusCreated, version, response)
+}
+
+// attemptBackpressure reports whether the attempt queue reached its high water mark.
+// Attempts are only queued with Postgres.
+func (h *Handler) attemptBackpressure() bool {
+	return h.Postgres != nil && h.attemptsHighWater > 0 && len(h.attemptsChan) >= h.attemptsHighWater
+}
+
+// writeNoSale answers a checkout while no sale is active. A sale closed within the current
+// slot has ended, otherwise the next one simply hasn't started yet.
+func (h *Handler) writeNoSale(ctx context.Context, w http.ResponseWriter) {
+	logger := myLogger.FromContext(ctx, "checkout_handler")
+
+	now := h.Clock.Now()
+	nextSale := h.nextSaleStart(now)
+	response := NoSaleResponse{
+		Error:           "no sale is active",
+		Reason:          NoSaleReasonNotStarted,
+		NextSaleAt:      nextSale.UTC().Format(time.RFC3339),
+		StartsInSeconds: int(math.Ceil(nextSale.Sub(now).Seconds())),
 	}
 
-	// Atomically increment the items sold count
-	actualItemsSold, err := h.Redis.IncrementItemsSoldCount(ctx)
+	// Unknown is reported as not started, the countdown is right either way
+	endedAt, err := h.Redis.GetSaleEndedAt(ctx)
 	if err != nil {
-		logger.Error("failed to increment items sold count", "error", err)
-		http.Error(w, "internal server error", http.StatusInternalServerError)
-		return
+		logger.Warn("failed to get sale end time", "error", err)
+	} else if !endedAt.IsZero() && !endedAt.Before(h.previousSaleStart(now)) {
+		response.Reason = NoSaleReasonEnded
+		response.EndedAt = endedAt.UTC().Format(time.RFC3339)
 	}
 
-	if actualItemsSold > 10000 {
-		logger.Error("sale has reached the maximum number of items sold")
-		if err := h.Redis.DecrementItemsSoldCount(ctx); err != nil {
-			logger.Error("failed to decrement items sold count", "error", err)
-		}
-		if _, err := h.Redis.IncrementStockFastFail(ctx); err != nil {
-			logger.Error("failed to increment stock", "error", err)
-		}
-		if err := h.Redis.DecrementUserCheckoutCount(ctx, userID); err != nil {
-			logger.Error("failed to decrement user checkout count", "error", err)
-		}
-		http.Error(w, "stock sold out", http.StatusConflict)
+	writeJSON(w, http.StatusBadRequest, response)
+}
+
+// checkoutTiming collects the duration of each checkout phase
+type checkoutTiming struct {
+	enabled bool
+	start   time.Time
+	last    time.Time
+	phases  []any
+}
+
+// newCheckoutTiming creates a checkoutTiming, which is a no-op when disabled
+func newCheckoutTiming(enabled bool) *checkoutTiming {
+	if !enabled {
+		return &checkoutTiming{}
+	}
+	now := time.Now()
+	return &checkoutTiming{enabled: enabled, start: now, last: now}
+}
+
+// mark records the time spent since the previous mark as the given phase
+func (t *checkoutTiming) mark(phase string) {
+	if !t.enabled {
 		return
 	}
+	now := time.Now()
+	t.phases = append(t.phases, phase, now.Sub(t.last))
+	t.last = now
+}
 
-	// Generate a checkout code
-	checkoutCode := utils.GenerateCode()
+// log writes a single line with the outcome and all recorded phases
+func (t *checkoutTiming) log(logger *slog.Logger, status int) {
+	logger.Debug("checkout outcome", "status", status, "total", time.Since(t.start), slog.Group("phases", t.phases...))
+}
 
-	// Store the checkout code in Redis (TTL is 20 seconds)
-	if err := h.Redis.SetCheckoutCode(ctx, userID, saleIDStr, itemID, checkoutCode, 20); err != nil {
-		logger.Error("failed to set checkout code", "error", err)
-		if _, err := h.Redis.IncrementStockFastFail(ctx); err != nil {
-			logger.Error("failed to increment stock", "error", err)
-		}
-		if err := h.Redis.DecrementUserCheckoutCount(ctx, userID); err != nil {
-			logger.Error("failed to decrement user checkout count", "error", err)
-		}
-		if err := h.Redis.DecrementItemsSoldCount(ctx); err != nil {
-			logger.Error("failed to decrement items sold count", "error", err)
-		}
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+// statusRecorder remembers the status code written to the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code and writes it to the response
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// ExtendCheckout extends the reservation of a checkout code by another TTL period,
+// up to the configured maximum reservation lifetime
+func (h *Handler) ExtendCheckout(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), myLogger.RequestIDKey, utils.GenerateRequestID())
+	logger := myLogger.FromContext(ctx, "checkout")
+
+	code := r.URL.Query().Get("code")
+
+	logger.Debug("extend | request received", "path", r.URL.Path, "method", r.Method, "code", code)
+
+	if code == "" {
+		http.Error(w, "code is required", http.StatusBadRequest)
 		return
 	}
 
-	// Send the attempt to the background worker
-	attempt.Status = "success"
-	attempt.Code = &checkoutCode
+	expiresAt, err := h.Redis.ExtendCheckoutCode(ctx, code, checkoutCodeTTL, h.Config.GetMaxReservationLifetime())
+	switch {
+	case errors.Is(err, database.ErrCheckoutCodeNotFound):
+		http.Error(w, "invalid or expired code", http.StatusNotFound)
+		return
+	case errors.Is(err, database.ErrReservationLifetimeExceeded):
+		// Clients have to start a new checkout
+		http.Error(w, "reservation reached its maximum lifetime, checkout again", http.StatusGone)
+		return
+	case err != nil:
+		logger.Error("extend | failed to extend checkout code", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
 
-	// Return the checkout code
-	response := CheckoutResponse{
-		Code: checkoutCode,
+	response := ExtendCheckoutResponse{
+		Code:             code,
+		ExpiresAt:        expiresAt.UTC().Format(time.RFC3339),
+		RemainingSeconds: int(expiresAt.Sub(h.Clock.Now()).Round(time.Second).Seconds()),
 	}
 
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(response)
+	writeJSON(w, http.StatusOK, response)
 }
 
-// processCheckoutAttempts processes the checkout attempts in background worker pattern
+// processCheckoutAttempts processes the checkout attempts in background worker pattern.
+// Several workers may drain the channel at once, each with its own batch, so
+// attempts are not guaranteed to be inserted in the order they were made.
 func (h *Handler) ProcessCheckoutAttempts(ctx context.Context) {
 	// Init logger for module
 	logger := myLogger.FromContext(ctx, "checkout_worker")
@@ -201,7 +378,8 @@ func (h *Handler) ProcessCheckoutAttempts(ctx context.Context) {
 			// Flush remaining attempts
 			if len(batch) > 0 {
 				logger.Debug("flushing attempts", "count", len(batch))
-				h.flushAttemptsBatch(ctx, batch)
+				// The worker context is cancelled already, the final flush must still run
+				h.attemptsFlushed.Add(h.flushAttemptsBatch(context.WithoutCancel(ctx), batch))
 			}
 			logger.Debug("context done")
 			return
@@ -220,22 +398,29 @@ func (h *Handler) ProcessCheckoutAttempts(ctx context.Context) {
 				h.flushAttemptsBatch(ctx, batch)
 				batch = batch[:0]
 			}
+			h.attemptDrops.report(logger, h.Config.GetDropLogInterval())
 		}
 	}
 
 }
 
-// flushBatch flushes the batch to the database
-func (h *Handler) flushAttemptsBatch(ctx context.Context, batch []database.CheckoutAttempt) {
+// flushBatch flushes the batch to the database and returns the number of attempts written
+func (h *Handler) flushAttemptsBatch(ctx context.Context, batch []database.CheckoutAttempt) int64 {
 	// Init loger for module
 	logger := myLogger.FromContext(ctx, "checkout_worker")
 
-	err := h.Postgres.BatchInsertAttempts(batch)
-	if err != nil {
-		for _, attempt := range batch {
-			if err := h.Postgres.InsertSingleAttempt(attempt); err != nil {
-				logger.Error("failed to insert checkout attempt", "error", err)
-			}
+	err := h.Postgres.BatchInsertAttempts(ctx, batch)
+	if err == nil {
+		return int64(len(batch))
+	}
+
+	var written int64
+	for _, attempt := range batch {
+		if err := h.Postgres.InsertSingleAttempt(ctx, attempt); err != nil {
+			logger.Error("failed to insert checkout attempt", "error", err)
+			continue
 		}
+		written++
 	}
+	return written
 }
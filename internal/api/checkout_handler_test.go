@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pcristin/golang_contest/internal/config"
+	"github.com/pcristin/golang_contest/internal/database"
+	"github.com/pcristin/golang_contest/internal/utils"
+)
+
+func TestNoSaleCountdown(t *testing.T) {
+	// Nothing listens on port 1, the end of the last sale is unknown
+	redis := database.NewRedisClient(context.Background(), "127.0.0.1:1", "test:", 0, database.CheckoutLimits{})
+	t.Cleanup(func() { redis.Close() })
+	noon := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		now         time.Time
+		wantSeconds int
+		wantNext    time.Time
+	}{
+		{"half a minute before", noon.Add(-30 * time.Second), 30, noon},
+		{"partial seconds round up", noon.Add(-1500 * time.Millisecond), 2, noon},
+		{"right after a start", noon, 3600, noon.Add(time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(config.NewConfig(), redis, nil, utils.NewItemGenerator(nil))
+			h.SetClock(newFakeClock(tt.now))
+
+			rec := httptest.NewRecorder()
+			h.writeNoSale(context.Background(), rec)
+
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+			}
+			var response NoSaleResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatalf("invalid JSON body %q: %v", rec.Body.String(), err)
+			}
+			if response.Reason != NoSaleReasonNotStarted {
+				t.Errorf("got reason %q, want %q", response.Reason, NoSaleReasonNotStarted)
+			}
+			if response.StartsInSeconds != tt.wantSeconds {
+				t.Errorf("got %d seconds to the start, want %d", response.StartsInSeconds, tt.wantSeconds)
+			}
+			if want := tt.wantNext.Format(time.RFC3339); response.NextSaleAt != want {
+				t.Errorf("got next sale at %s, want %s", response.NextSaleAt, want)
+			}
+		})
+	}
+}
+
+func TestSaleStartMissedAsClockAdvances(t *testing.T) {
+	saleStart := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := newFakeClock(saleStart)
+	h := newClockHandler(clock)
+
+	steps := []struct {
+		advance time.Duration
+		want    bool
+	}{
+		{0, false},
+		{59 * time.Minute, false},
+		{time.Minute, false}, // the next sale is due, not missed yet
+		{time.Second, true},
+	}
+	for _, step := range steps {
+		clock.Advance(step.advance)
+		if got := h.saleStartMissed(saleStart, clock.Now()); got != step.want {
+			t.Errorf("at %v: got missed %v, want %v", clock.Now(), got, step.want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pcristin/golang_contest/internal/utils"
+)
+
+// fakeClock is a utils.Clock whose time only moves when told to. Like the real clock
+// it has a wall clock, read by Now, and a monotonic one the timers run on, so a wall
+// clock jump doesn't fire timers.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time     // wall clock
+	elapsed time.Duration // monotonic clock
+	timers  []*fakeTimer
+}
+
+// newFakeClock creates a fakeClock reading now
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) utils.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	timer := &fakeTimer{clock: c, ch: make(chan time.Time, 1)}
+	timer.arm(d)
+	c.timers = append(c.timers, timer)
+	if d <= 0 {
+		timer.fire(c.now)
+	}
+	return timer
+}
+
+// Advance moves both clocks forward by d and fires the timers that are due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	c.elapsed += d
+	for _, timer := range c.timers {
+		if timer.armed && timer.deadline <= c.elapsed {
+			timer.fire(c.now)
+		}
+	}
+}
+
+// Jump moves the wall clock only, like an NTP correction. No timer fires.
+func (c *fakeClock) Jump(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// armed returns the number of timers that haven't fired or been stopped
+func (c *fakeClock) armed() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, timer := range c.timers {
+		if timer.armed {
+			n++
+		}
+	}
+	return n
+}
+
+// waitArmed waits until n timers are armed, i.e. the code under test is waiting on them
+func (c *fakeClock) waitArmed(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.armed() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d timers armed, want %d", c.armed(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// fakeTimer is a timer of a fakeClock
+type fakeTimer struct {
+	clock    *fakeClock
+	ch       chan time.Time
+	deadline time.Duration // on the monotonic clock
+	armed    bool
+}
+
+// arm sets the timer to fire in d, the clock must be locked
+func (t *fakeTimer) arm(d time.Duration) {
+	t.deadline = t.clock.elapsed + d
+	t.armed = true
+}
+
+// fire sends the time on the channel, the clock must be locked
+func (t *fakeTimer) fire(now time.Time) {
+	t.armed = false
+	select {
+	case t.ch <- now:
+	default:
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasArmed := t.armed
+	t.armed = false
+	return wasArmed
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasArmed := t.armed
+	t.arm(d)
+	if d <= 0 {
+		t.fire(t.clock.now)
+	}
+	return wasArmed
+}
@@ -0,0 +1,26 @@
+package api
+
+import (
+	"mime"
+	"net/http"
+)
+
+// RequireJSONBody answers requests that carry a body of another type than JSON with
+// 415, instead of letting them fall through to the query parameters. Requests
+// without a body, the query parameter only clients, pass as before.
+func RequireJSONBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// ContentLength is -1 for chunked bodies of unknown length
+		if r.ContentLength == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "application/json" {
+			writeJSON(w, http.StatusUnsupportedMediaType, ErrorResponse{Error: "request body must be application/json"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
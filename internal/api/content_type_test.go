@@ -0,0 +1,50 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequireJSONBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		target      string
+		body        string
+		contentType string
+		wantStatus  int
+	}{
+		{"JSON body", "/checkout", `{"user_id": "1", "id": "2"}`, "application/json", http.StatusOK},
+		{"JSON body with charset", "/checkout", `{"user_id": "1", "id": "2"}`, "application/json; charset=utf-8", http.StatusOK},
+		{"form body", "/checkout", "user_id=1&id=2", "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"body without content type", "/checkout", `{"user_id": "1", "id": "2"}`, "", http.StatusUnsupportedMediaType},
+		{"empty body with query params", "/checkout?user_id=1&id=2", "", "", http.StatusOK},
+		{"empty body with a form content type", "/checkout?user_id=1&id=2", "", "application/x-www-form-urlencoded", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reached := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+			})
+
+			req := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+			RequireJSONBody(next).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if reached != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("handler reached: %v", reached)
+			}
+			if tt.wantStatus == http.StatusUnsupportedMediaType && !strings.Contains(rec.Body.String(), `"error"`) {
+				t.Errorf("got body %q, want a JSON error", rec.Body.String())
+			}
+		})
+	}
+}
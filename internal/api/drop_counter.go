@@ -0,0 +1,38 @@
+package api
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// dropCounter rate-limits the logs of records dropped because a channel is full.
+// The first drop of an interval is logged right away, the rest as one aggregated line.
+type dropCounter struct {
+	record     string // e.g. "attempts"
+	dropped    atomic.Int64
+	total      atomic.Int64 // all drops since startup, never reset
+	lastReport atomic.Int64 // unix nanoseconds
+}
+
+// add counts a dropped record and logs it if it's the first since the last report
+func (d *dropCounter) add(logger *slog.Logger) {
+	d.total.Add(1)
+	if d.dropped.Add(1) == 1 {
+		logger.Error("dropped record: channel full, further drops are aggregated", "record", d.record)
+	}
+}
+
+// report logs the number of records dropped since the last report, at most once per interval
+func (d *dropCounter) report(logger *slog.Logger, interval time.Duration) {
+	now := time.Now()
+	last := time.Unix(0, d.lastReport.Load())
+	if now.Sub(last) < interval {
+		return
+	}
+	d.lastReport.Store(now.UnixNano())
+
+	if dropped := d.dropped.Swap(0); dropped > 0 {
+		logger.Error("dropped records: channel full", "record", d.record, "count", dropped, "since", last.Format(time.RFC3339))
+	}
+}
@@ -2,9 +2,13 @@ package api
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"time"
+
+	myLogger "github.com/pcristin/golang_contest/internal/logger"
 )
 
 // Health returns the health status and system statistics
@@ -13,57 +17,131 @@ func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
 
 	// Initialize health status
 	health := HealthStatus{
-		Status:    "healthy",
 		Timestamp: time.Now().UTC().Format(time.RFC3339),
-		Services:  make(map[string]string),
+		Ready:     h.ready.Load(),
 	}
 
-	// Check service health
-	health.Services["redis"] = h.checkRedisHealth(ctx)
-	health.Services["postgres"] = h.checkPostgresHealth()
+	// Check service health and determine overall status
+	health.Services = h.checkServices(ctx)
+	health.Status = h.overallStatus(health.Services)
 
-	// Determine overall status
-	for _, status := range health.Services {
-		if status != "healthy" {
-			health.Status = "degraded"
-			break
-		}
+	// Read the cache before getCurrentSaleInfo refreshes it
+	health.SaleCache = h.getSaleCacheInfo()
+
+	// The sale is read with plain Redis commands, which the check deadline doesn't bound.
+	// A Redis that failed its check would hang them, the sale is left out then.
+	if health.Services["redis"] == "healthy" {
+		// Get current sale info
+		health.Sale = h.getCurrentSaleInfo(ctx)
+
+		// Check sale counters for drift
+		health.Warnings = h.checkSaleConsistency(ctx, health.Sale)
 	}
 
-	// Get current sale info
-	health.Sale = h.getCurrentSaleInfo(ctx)
+	// The public gets a rounded stock, admins the exact counters
+	if step := h.Config.GetStockDisplayStep(); step > 1 && !h.isAdmin(r) {
+		health.Sale.Stock = roundStockUp(health.Sale.Stock, int64(step))
+		health.Sale.Sold = 0
+		health.Sale.Initial = 0
+		health.Sale.Reservations = 0
+	}
 
 	// Get performance stats
 	health.Performance = h.getPerformanceStats()
 
-	// Set appropriate status code
+	// Only critical outages fail the health check, the rest is degraded but serving
 	statusCode := http.StatusOK
-	if health.Status == "degraded" {
+	if health.Status == "unhealthy" {
 		statusCode = http.StatusServiceUnavailable
 	}
 
-	// Return JSON response
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
+	// Return JSON response, HEAD requests get the same headers without the body
+	writeJSON(w, statusCode, health)
+}
+
+// Ready reports whether the instance should get traffic: the startup recovery is done
+// and every critical service is up. Outages of the other services don't pull the instance.
+func (h *Handler) Ready(w http.ResponseWriter, r *http.Request) {
+	services := h.checkServices(r.Context())
+	ready := ReadyStatus{
+		Ready:    h.ready.Load() && h.overallStatus(services) != "unhealthy",
+		Services: services,
+	}
+
+	statusCode := http.StatusOK
+	if !ready.Ready {
+		statusCode = http.StatusServiceUnavailable
+	}
+	writeJSON(w, statusCode, ready)
+}
 
-	if err := json.NewEncoder(w).Encode(health); err != nil {
-		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
-		return
+// checkServices checks the health of every service
+func (h *Handler) checkServices(ctx context.Context) map[string]string {
+	return map[string]string{
+		"redis":    h.checkRedisHealth(ctx),
+		"postgres": h.checkPostgresHealth(ctx),
 	}
 }
 
+// healthCheckContext bounds a service check by the health check timeout, so a hung
+// service is reported promptly instead of after the client timeouts
+func (h *Handler) healthCheckContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout := h.Config.GetHealthCheckTimeout(); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// unhealthyStatus describes a service check that failed with err under ctx. Drivers
+// don't always wrap the context error, so the context itself is checked as well. Redis
+// turns the deadline into a socket deadline, which may expire just before the context.
+func unhealthyStatus(ctx context.Context, err error) string {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout()) {
+		return "unhealthy: timeout"
+	}
+	return "unhealthy: " + err.Error()
+}
+
+// overallStatus is "unhealthy" if a critical service is down, "degraded" if
+// only other services are, and "healthy" otherwise
+func (h *Handler) overallStatus(services map[string]string) string {
+	critical := h.Config.GetHealthCriticalServices()
+	status := "healthy"
+	for service, serviceStatus := range services {
+		if serviceStatus == "healthy" || serviceStatus == "disabled" {
+			continue
+		}
+		if critical[service] {
+			return "unhealthy"
+		}
+		status = "degraded"
+	}
+	return status
+}
+
 // checkRedisHealth checks if Redis is healthy
 func (h *Handler) checkRedisHealth(ctx context.Context) string {
+	ctx, cancel := h.healthCheckContext(ctx)
+	defer cancel()
+
 	if err := h.Redis.HealthCheck(ctx); err != nil {
-		return "unhealthy: " + err.Error()
+		return unhealthyStatus(ctx, err)
 	}
 	return "healthy"
 }
 
 // checkPostgresHealth checks if Postgres is healthy
-func (h *Handler) checkPostgresHealth() string {
-	if err := h.Postgres.HealthCheck(); err != nil {
-		return "unhealthy: " + err.Error()
+func (h *Handler) checkPostgresHealth(ctx context.Context) string {
+	if h.Postgres == nil {
+		return "disabled"
+	}
+	ctx, cancel := h.healthCheckContext(ctx)
+	defer cancel()
+
+	if err := h.Postgres.HealthCheck(ctx); err != nil {
+		return unhealthyStatus(ctx, err)
 	}
 	return "healthy"
 }
@@ -82,30 +160,121 @@ func (h *Handler) getCurrentSaleInfo(ctx context.Context) SaleInfo {
 
 	saleInfo.ID = activeSaleID
 	saleInfo.Active = true
+	saleInfo.ItemCap = h.Config.GetSaleItemCap()
+	if counters, err := h.Redis.GetSaleCounters(ctx, activeSaleID); err == nil && counters.ItemCap > 0 {
+		saleInfo.ItemCap = int(counters.ItemCap)
+	}
 
 	// Get stock information
-	if stock, err := h.Redis.GetSaleCurrentStock(ctx); err == nil {
+	stock, stockErr := h.Redis.GetSaleCurrentStock(ctx)
+	if stockErr == nil {
 		saleInfo.Stock = stock
 	}
 
-	if sold, err := h.Redis.GetItemsSoldCount(ctx); err == nil {
+	sold, soldErr := h.Redis.GetItemsSoldCount(ctx)
+	if soldErr == nil {
 		saleInfo.Sold = sold
 	}
 
-	// Get sale metadata from Postgres
-	if itemName, imageURL, err := h.Postgres.GetSaleByID(activeSaleID); err == nil {
-		saleInfo.ItemName = itemName
-		saleInfo.ImageURL = imageURL
+	if reservations, err := h.Redis.GetReservationCount(ctx); err != nil {
+		myLogger.FromContext(ctx, "health").Warn("health | failed to read reservation count", "sale_id", activeSaleID, "error", err)
+	} else {
+		saleInfo.Reservations = reservations
+	}
+
+	// Initial stock is left unset when a counter couldn't be read, so it isn't mistaken for drift
+	initial, initialErr := h.Redis.GetSaleInitialStock(ctx)
+	if err := errors.Join(stockErr, soldErr, initialErr); err != nil {
+		myLogger.FromContext(ctx, "health").Warn("health | failed to read sale counters", "sale_id", activeSaleID, "error", err)
+	} else {
+		saleInfo.Initial = initial
 	}
 
+	// Get sale metadata from the cache, or from Redis and then Postgres on a miss
+	saleData, ok := h.saleCache.Load(activeSaleID)
+	if !ok {
+		var err error
+		if saleData, err = h.loadSaleData(ctx, activeSaleID); err != nil {
+			myLogger.FromContext(ctx, "health").Warn("health | failed to load sale data", "sale_id", activeSaleID, "error", err)
+		}
+	}
+	saleInfo.ItemName = saleData.ItemName
+	saleInfo.ImageURL = saleData.ImageURL
+
 	return saleInfo
 }
 
+// roundStockUp rounds the stock up to a multiple of step, so it reads as
+// "at most N left". A sold out sale stays at 0.
+func roundStockUp(stock, step int64) int64 {
+	if stock <= 0 {
+		return 0
+	}
+	return (stock + step - 1) / step * step
+}
+
+// getSaleCacheInfo gets the cached active sale ID and its age, and the sale data cache stats
+func (h *Handler) getSaleCacheInfo() SaleCacheInfo {
+	info := SaleCacheInfo{
+		Sales:          h.saleCache.Len(),
+		MaxSales:       h.saleCache.Cap(),
+		PurchaseHits:   h.saleCacheHits.Load(),
+		PurchaseMisses: h.saleCacheMisses.Load(),
+	}
+
+	saleID, cachedAt := h.Redis.CachedSaleID()
+	if saleID == 0 {
+		return info
+	}
+	info.SaleID = saleID
+	info.CachedAt = cachedAt.UTC().Format(time.RFC3339)
+	info.AgeSeconds = time.Since(cachedAt).Seconds()
+	return info
+}
+
+// checkSaleConsistency verifies that the active sale counters add up.
+// Checkouts in flight may cause a short-lived mismatch, a persistent one means drift.
+func (h *Handler) checkSaleConsistency(ctx context.Context, sale SaleInfo) []string {
+	logger := myLogger.FromContext(ctx, "health")
+
+	// Sales created before the initial stock key existed can't be verified
+	if !sale.Active || sale.Initial == 0 {
+		return nil
+	}
+
+	var warnings []string
+	if sale.Stock+sale.Sold != sale.Initial {
+		warnings = append(warnings, fmt.Sprintf("sale %d: stock (%d) + items_sold (%d) != initial_stock (%d)",
+			sale.ID, sale.Stock, sale.Sold, sale.Initial))
+	}
+	if sale.Sold > sale.Initial {
+		warnings = append(warnings, fmt.Sprintf("sale %d: items_sold (%d) > initial_stock (%d)",
+			sale.ID, sale.Sold, sale.Initial))
+	}
+
+	if len(warnings) > 0 {
+		logger.Warn("health | sale counters are inconsistent", "sale_id", sale.ID,
+			"stock", sale.Stock, "items_sold", sale.Sold, "initial_stock", sale.Initial)
+	}
+	return warnings
+}
+
 // getPerformanceStats gets performance metrics
 func (h *Handler) getPerformanceStats() PerformanceStats {
+	scriptsInFlight, scriptsMax := h.Redis.ScriptStats()
 	return PerformanceStats{
 		AttemptQueueSize:  len(h.attemptsChan),
 		PurchaseQueueSize: len(h.purchasesChan),
+		PurchasesArchived: h.purchasesArchived.Load(),
+		PurchasesInFlight: h.purchasesInFlight.Load(),
+
+		AttemptBackpressure:   h.attemptBackpressure(),
+		AttemptQueueHighWater: h.attemptsHighWater,
+
+		RedisScriptsInFlight: scriptsInFlight,
+		RedisScriptsMax:      scriptsMax,
+
+		ReservationDuration: h.reservationDurations.snapshot(),
 		QueueCapacity: struct {
 			Attempts  int `json:"attempts_max"`
 			Purchases int `json:"purchases_max"`
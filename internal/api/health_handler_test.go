@@ -0,0 +1,78 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pcristin/golang_contest/internal/config"
+	"github.com/pcristin/golang_contest/internal/database"
+	"github.com/pcristin/golang_contest/internal/utils"
+)
+
+// hungListener accepts connections and never answers, like a hung Redis
+func hungListener(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		listener.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestHealthRedisHung(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.HealthCheckTimeout = 100 * time.Millisecond
+	redis := database.NewRedisClient(context.Background(), hungListener(t), "test:", 0, database.CheckoutLimits{})
+	t.Cleanup(func() { redis.Close() })
+	h := NewHandler(cfg, redis, nil, utils.NewItemGenerator(nil))
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	h.Health(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	// Well below the 3 second read timeout of the Redis connections
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("health check took %v, want it bounded by the %v check timeout", elapsed, cfg.HealthCheckTimeout)
+	}
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	var health HealthStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &health); err != nil {
+		t.Fatalf("invalid JSON body %q: %v", rec.Body.String(), err)
+	}
+	if got := health.Services["redis"]; got != "unhealthy: timeout" {
+		t.Errorf("got Redis status %q, want %q", got, "unhealthy: timeout")
+	}
+	if health.Sale.Active {
+		t.Error("got an active sale, want the sale left out while Redis is down")
+	}
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// durationHistogram counts durations into fixed cumulative buckets, safe for concurrent use
+type durationHistogram struct {
+	bounds  []time.Duration
+	buckets []atomic.Int64 // one per bound plus +Inf
+	count   atomic.Int64
+	sum     atomic.Int64 // nanoseconds
+}
+
+// newDurationHistogram creates a histogram with the given ascending bucket bounds
+func newDurationHistogram(bounds ...time.Duration) *durationHistogram {
+	return &durationHistogram{
+		bounds:  bounds,
+		buckets: make([]atomic.Int64, len(bounds)+1),
+	}
+}
+
+// observe records a duration
+func (d *durationHistogram) observe(duration time.Duration) {
+	i := 0
+	for i < len(d.bounds) && duration > d.bounds[i] {
+		i++
+	}
+	d.buckets[i].Add(1)
+	d.count.Add(1)
+	d.sum.Add(int64(duration))
+}
+
+// snapshot returns the cumulative bucket counts keyed by their upper bound in seconds
+func (d *durationHistogram) snapshot() HistogramStats {
+	stats := HistogramStats{
+		Buckets: make(map[string]int64, len(d.buckets)),
+		Count:   d.count.Load(),
+		SumMs:   d.sum.Load() / int64(time.Millisecond),
+	}
+
+	var cumulative int64
+	for i := range d.buckets {
+		cumulative += d.buckets[i].Load()
+		le := "+Inf"
+		if i < len(d.bounds) {
+			le = strconv.FormatFloat(d.bounds[i].Seconds(), 'f', -1, 64)
+		}
+		stats.Buckets[le] = cumulative
+	}
+	return stats
+}
@@ -0,0 +1,593 @@
+//go:build integration
+
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pcristin/golang_contest/internal/config"
+	"github.com/pcristin/golang_contest/internal/database"
+	"github.com/pcristin/golang_contest/internal/utils"
+)
+
+// The integration tests run against the Redis at TEST_REDIS_URL and the Postgres at
+// TEST_POSTGRES_URL, see make test-integration. They fail when these are unset.
+
+// testConfig returns the default config with fast scheduler retries
+func testConfig() *config.Config {
+	cfg := config.NewConfig()
+	cfg.SchedulerRetryBase = 10 * time.Millisecond
+	cfg.SchedulerRetryMax = 100 * time.Millisecond
+	return cfg
+}
+
+// testRedisPrefix returns a key prefix of its own for the test, whose keys are
+// deleted when the test ends
+func testRedisPrefix(t *testing.T) (address, prefix string) {
+	t.Helper()
+	address = os.Getenv("TEST_REDIS_URL")
+	if address == "" {
+		t.Fatal("TEST_REDIS_URL is not set, the integration tests need a Redis (see make test-integration)")
+	}
+	prefix = fmt.Sprintf("test:%s:%d:", strings.ReplaceAll(t.Name(), "/", "_"), time.Now().UnixNano())
+
+	t.Cleanup(func() {
+		conn, err := redis.Dial("tcp", address)
+		if err != nil {
+			t.Errorf("failed to delete the test keys: %v", err)
+			return
+		}
+		defer conn.Close()
+		keys, err := redis.Strings(conn.Do("KEYS", prefix+"*"))
+		if err != nil || len(keys) == 0 {
+			return
+		}
+		args := make([]any, len(keys))
+		for i, key := range keys {
+			args[i] = key
+		}
+		conn.Do("DEL", args...)
+	})
+	return address, prefix
+}
+
+// newTestRedis returns a client of the test Redis using the key prefix
+func newTestRedis(t *testing.T, cfg *config.Config, address, prefix string) *database.RedisClient {
+	t.Helper()
+	ctx := context.Background()
+	r := database.NewRedisClient(ctx, address, prefix, 0, database.CheckoutLimits{
+		MaxItemsPerUser: cfg.GetUserCheckoutLimit(),
+		MaxTotalItems:   cfg.GetSaleItemCap(),
+	})
+	if err := r.HealthCheck(ctx); err != nil {
+		t.Fatalf("test Redis at %s: %v", address, err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// newTestPostgres returns a client of the test Postgres with empty tables
+func newTestPostgres(t *testing.T) *database.PostgresClient {
+	t.Helper()
+	url := os.Getenv("TEST_POSTGRES_URL")
+	if url == "" {
+		t.Fatal("TEST_POSTGRES_URL is not set, the integration tests need a Postgres (see make test-integration)")
+	}
+
+	ctx := context.Background()
+	p, err := database.NewPostgresClient(ctx, url, 0)
+	if err != nil {
+		t.Fatalf("test Postgres: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+	if err := p.CreateTables(ctx); err != nil {
+		t.Fatalf("failed to create the tables: %v", err)
+	}
+
+	db := openTestDB(t)
+	_, err = db.ExecContext(ctx, "TRUNCATE sales, checkout_attempts, purchases, purchases_archive, sale_reconciliations RESTART IDENTITY CASCADE")
+	if err != nil {
+		t.Fatalf("failed to empty the tables: %v", err)
+	}
+	return p
+}
+
+// openTestDB opens the test Postgres for checking what the handler stored
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("postgres", os.Getenv("TEST_POSTGRES_URL"))
+	if err != nil {
+		t.Fatalf("test Postgres: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// countSales returns the number of sale rows
+func countSales(t *testing.T, db *sql.DB) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sales").Scan(&n); err != nil {
+		t.Fatalf("failed to count the sales: %v", err)
+	}
+	return n
+}
+
+// countPurchases returns the number of purchase rows of the user
+func countPurchases(t *testing.T, db *sql.DB, userID string) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM purchases WHERE user_id = $1", userID).Scan(&n); err != nil {
+		t.Fatalf("failed to count the purchases: %v", err)
+	}
+	return n
+}
+
+// checkoutCode checks out an item of the active sale and returns the code
+func checkoutCode(t *testing.T, h *Handler, userID string) string {
+	t.Helper()
+	code := utils.GenerateCode()
+	status, err := h.Redis.AtomicCheckout(context.Background(), userID, "1", code, 60)
+	if err != nil || status != database.CheckoutStatusSuccess {
+		t.Fatalf("checkout of %s: got %v, %v, want success", userID, status, err)
+	}
+	return code
+}
+
+// purchase purchases the code through the handler
+func purchase(t *testing.T, h *Handler, code string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.Purchase(rec, httptest.NewRequest(http.MethodPost, "/purchase?code="+code, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("purchase of %s: got status %d: %s", code, rec.Code, rec.Body.String())
+	}
+}
+
+func TestPurchaseRefillsSaleCache(t *testing.T) {
+	cfg := testConfig()
+	address, prefix := testRedisPrefix(t)
+	h := NewHandler(cfg, newTestRedis(t, cfg, address, prefix), nil, utils.NewItemGenerator(nil))
+	ctx := context.Background()
+
+	if err := h.executeNewSale(ctx); err != nil {
+		t.Fatalf("failed to start the sale: %v", err)
+	}
+	// Like an instance that didn't start the sale and hasn't cached it yet
+	h.saleCache = newSaleCache[SaleData](cfg.GetSaleCacheSize())
+
+	purchase(t, h, checkoutCode(t, h, "user1"))
+	if misses, hits := h.saleCacheMisses.Load(), h.saleCacheHits.Load(); misses != 1 || hits != 0 {
+		t.Fatalf("first purchase: got %d misses and %d hits, want 1 miss", misses, hits)
+	}
+
+	purchase(t, h, checkoutCode(t, h, "user2"))
+	if misses, hits := h.saleCacheMisses.Load(), h.saleCacheHits.Load(); misses != 1 || hits != 1 {
+		t.Errorf("second purchase: got %d misses and %d hits, want it served from the cache", misses, hits)
+	}
+}
+
+func TestConcurrentPurchaseOfOneCode(t *testing.T) {
+	cfg := testConfig()
+	address, prefix := testRedisPrefix(t)
+	h := NewHandler(cfg, newTestRedis(t, cfg, address, prefix), nil, utils.NewItemGenerator(nil))
+
+	if err := h.executeNewSale(context.Background()); err != nil {
+		t.Fatalf("failed to start the sale: %v", err)
+	}
+	code := checkoutCode(t, h, "user1")
+
+	const buyers = 50
+	statuses := make([]int, buyers)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			rec := httptest.NewRecorder()
+			h.Purchase(rec, httptest.NewRequest(http.MethodPost, "/purchase?code="+code, nil))
+			statuses[i] = rec.Code
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	counts := make(map[int]int)
+	for _, status := range statuses {
+		counts[status]++
+	}
+	if counts[http.StatusOK] != 1 || counts[http.StatusNotFound] != buyers-1 {
+		t.Errorf("got statuses %v, want one %d and %d %d", counts, http.StatusOK, buyers-1, http.StatusNotFound)
+	}
+}
+
+func TestPurchaseUnknownCode(t *testing.T) {
+	cfg := testConfig()
+	address, prefix := testRedisPrefix(t)
+	h := NewHandler(cfg, newTestRedis(t, cfg, address, prefix), nil, utils.NewItemGenerator(nil))
+
+	if err := h.executeNewSale(context.Background()); err != nil {
+		t.Fatalf("failed to start the sale: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	h.Purchase(rec, httptest.NewRequest(http.MethodPost, "/purchase?code="+utils.GenerateCode(), nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want %d: %s", rec.Code, http.StatusNotFound, rec.Body.String())
+	}
+	if got := rec.Header().Get("Retry-After"); got != "" {
+		t.Errorf("got Retry-After %q, want none for a missing code", got)
+	}
+}
+
+func TestPurchaseWriteModes(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       string
+		attempt    bool // the checkout attempt of the code is stored
+		wantStatus int
+		wantRows   int // purchase rows right after the response
+	}{
+		{"async", config.PurchaseWriteModeAsync, true, http.StatusOK, 0},
+		{"sync", config.PurchaseWriteModeSync, true, http.StatusOK, 1},
+		{"sync without attempt", config.PurchaseWriteModeSync, false, http.StatusInternalServerError, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.PurchaseWriteMode = tt.mode
+			address, prefix := testRedisPrefix(t)
+			postgres := newTestPostgres(t)
+			h := NewHandler(cfg, newTestRedis(t, cfg, address, prefix), postgres, utils.NewItemGenerator(nil))
+			ctx := context.Background()
+			db := openTestDB(t)
+
+			if err := h.executeNewSale(ctx); err != nil {
+				t.Fatalf("failed to start the sale: %v", err)
+			}
+			code := checkoutCode(t, h, "user1")
+			if tt.attempt {
+				checkoutData, err := h.Redis.GetCheckoutCode(ctx, code)
+				if err != nil {
+					t.Fatalf("failed to get the checkout code: %v", err)
+				}
+				saleID, _ := strconv.Atoi(checkoutData.SaleID)
+				err = postgres.InsertSingleAttempt(ctx, database.CheckoutAttempt{
+					UserID: "user1", SaleID: saleID, ItemID: checkoutData.ItemID, Code: &code,
+					Status: database.CheckoutStatusSuccess, CreatedAt: time.Now(), TTL: 60,
+				})
+				if err != nil {
+					t.Fatalf("failed to insert the checkout attempt: %v", err)
+				}
+			}
+
+			rec := httptest.NewRecorder()
+			h.Purchase(rec, httptest.NewRequest(http.MethodPost, "/purchase?code="+code, nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if n := countPurchases(t, db, "user1"); n != tt.wantRows {
+				t.Fatalf("got %d purchases after the response, want %d", n, tt.wantRows)
+			}
+
+			if rec.Code != http.StatusOK {
+				// The purchase failed, the code is left to purchase again
+				if _, err := h.Redis.GetCheckoutCode(ctx, code); err != nil {
+					t.Errorf("checkout code not restored: %v", err)
+				}
+				return
+			}
+
+			// The worker flushes the queued purchases every second
+			workerCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			go h.ProcessPurchaseInserts(workerCtx)
+			deadline := time.Now().Add(5 * time.Second)
+			for countPurchases(t, db, "user1") != 1 {
+				if time.Now().After(deadline) {
+					t.Fatal("the purchase wasn't flushed")
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestRecoveredSaleServedFromCache(t *testing.T) {
+	tests := []struct {
+		name      string
+		loseRedis bool // Redis lost the sale, it's restored from Postgres
+	}{
+		{"sale running in Redis", false},
+		{"sale restored from Postgres", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			address, prefix := testRedisPrefix(t)
+			postgres := newTestPostgres(t)
+			ctx := context.Background()
+
+			starter := NewHandler(cfg, newTestRedis(t, cfg, address, prefix), postgres, utils.NewItemGenerator(nil))
+			if err := starter.executeNewSale(ctx); err != nil {
+				t.Fatalf("failed to start the sale: %v", err)
+			}
+			saleID, err := starter.Redis.GetActiveSaleID(ctx)
+			if err != nil {
+				t.Fatalf("failed to get the sale ID: %v", err)
+			}
+			if tt.loseRedis {
+				if err := starter.Redis.PurgeSaleKeys(ctx, saleID); err != nil {
+					t.Fatalf("failed to purge the sale keys: %v", err)
+				}
+				if _, err := starter.Redis.ClearActiveSalePointer(ctx, saleID); err != nil {
+					t.Fatalf("failed to clear the active sale: %v", err)
+				}
+			}
+
+			// A restarted instance recovers the sale
+			h := NewHandler(cfg, newTestRedis(t, cfg, address, prefix), postgres, utils.NewItemGenerator(nil))
+			if err := h.recoverSaleState(ctx); err != nil {
+				t.Fatalf("failed to recover the sale: %v", err)
+			}
+			if _, ok := h.saleCache.Load(saleID); !ok {
+				t.Fatalf("sale %d isn't cached after the recovery", saleID)
+			}
+
+			purchase(t, h, checkoutCode(t, h, "user1"))
+			if misses := h.saleCacheMisses.Load(); misses != 0 {
+				t.Errorf("got %d sale cache misses, want the purchase served from the cache", misses)
+			}
+		})
+	}
+}
+
+func TestRestoredSaleKeepsRemainingStock(t *testing.T) {
+	tests := []struct {
+		name       string
+		addedStock int
+		wantStock  int64
+	}{
+		{"sale stock", 0, 7000},
+		{"stock added during the sale", 500, 7500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.InitialStock = 10000
+			cfg.AdminToken = "admin"
+			address, prefix := testRedisPrefix(t)
+			postgres := newTestPostgres(t)
+			ctx := context.Background()
+
+			starter := NewHandler(cfg, newTestRedis(t, cfg, address, prefix), postgres, utils.NewItemGenerator(nil))
+			if err := starter.executeNewSale(ctx); err != nil {
+				t.Fatalf("failed to start the sale: %v", err)
+			}
+			saleID, err := starter.Redis.GetActiveSaleID(ctx)
+			if err != nil {
+				t.Fatalf("failed to get the sale ID: %v", err)
+			}
+			if tt.addedStock > 0 {
+				rec := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/admin/add-stock?amount=%d", tt.addedStock), nil)
+				req.Header.Set("X-Admin-Token", cfg.AdminToken)
+				starter.AddStock(rec, req)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("failed to add stock: got status %d: %s", rec.Code, rec.Body.String())
+				}
+			}
+
+			// 3000 items are sold, then the instance crashes and Redis loses the sale
+			purchases := make([]database.Purchase, 3000)
+			for i := range purchases {
+				purchases[i] = database.Purchase{UserID: fmt.Sprintf("user%d", i), SaleID: saleID, ItemID: "1", PurchasedAt: time.Now()}
+			}
+			if err := postgres.BatchInsertPurchases(ctx, purchases); err != nil {
+				t.Fatalf("failed to insert the purchases: %v", err)
+			}
+			if err := starter.Redis.PurgeSaleKeys(ctx, saleID); err != nil {
+				t.Fatalf("failed to purge the sale keys: %v", err)
+			}
+			if _, err := starter.Redis.ClearActiveSalePointer(ctx, saleID); err != nil {
+				t.Fatalf("failed to clear the active sale: %v", err)
+			}
+
+			h := NewHandler(cfg, newTestRedis(t, cfg, address, prefix), postgres, utils.NewItemGenerator(nil))
+			if err := h.recoverSaleState(ctx); err != nil {
+				t.Fatalf("failed to recover the sale: %v", err)
+			}
+			resumed, err := h.Redis.GetActiveSaleID(ctx)
+			if err != nil || resumed != saleID {
+				t.Fatalf("got active sale %d, %v, want sale %d resumed", resumed, err, saleID)
+			}
+			stock, err := h.Redis.GetSaleCurrentStock(ctx)
+			if err != nil {
+				t.Fatalf("failed to get the stock: %v", err)
+			}
+			if stock != tt.wantStock {
+				t.Errorf("got stock %d, want %d", stock, tt.wantStock)
+			}
+			sold, err := h.Redis.GetItemsSoldCount(ctx)
+			if err != nil || sold != 3000 {
+				t.Errorf("got %d, %v items sold, want 3000", sold, err)
+			}
+		})
+	}
+}
+
+func TestConcurrentRecoveryStartsOneSale(t *testing.T) {
+	cfg := testConfig()
+	address, prefix := testRedisPrefix(t)
+	postgres := newTestPostgres(t)
+	ctx := context.Background()
+
+	// Two instances start at once without any sale
+	handlers := make([]*Handler, 2)
+	for i := range handlers {
+		handlers[i] = NewHandler(cfg, newTestRedis(t, cfg, address, prefix), postgres, utils.NewItemGenerator(nil))
+	}
+	errs := make([]error, len(handlers))
+	var wg sync.WaitGroup
+	for i, h := range handlers {
+		wg.Add(1)
+		go func(i int, h *Handler) {
+			defer wg.Done()
+			errs[i] = h.recoverSaleState(ctx)
+		}(i, h)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("recovery of instance %d: %v", i, err)
+		}
+	}
+	if n := countSales(t, openTestDB(t)); n != 1 {
+		t.Fatalf("got %d sales, want 1", n)
+	}
+
+	saleIDs := make([]int, len(handlers))
+	for i, h := range handlers {
+		saleID, err := h.Redis.GetActiveSaleID(ctx)
+		if err != nil {
+			t.Fatalf("instance %d: failed to get the sale ID: %v", i, err)
+		}
+		if _, ok := h.saleCache.Load(saleID); !ok {
+			t.Errorf("instance %d doesn't have sale %d cached", i, saleID)
+		}
+		saleIDs[i] = saleID
+	}
+	if saleIDs[0] != saleIDs[1] {
+		t.Errorf("the instances serve sales %d and %d, want the same one", saleIDs[0], saleIDs[1])
+	}
+}
+
+func TestRecoveryLockRefreshedWhileHeld(t *testing.T) {
+	cfg := testConfig()
+	cfg.RecoveryLockTTL = 300 * time.Millisecond
+	address, prefix := testRedisPrefix(t)
+	h := NewHandler(cfg, newTestRedis(t, cfg, address, prefix), nil, utils.NewItemGenerator(nil))
+	ctx := context.Background()
+
+	lockCtx, release, err := h.acquireRecoveryLock(ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire the recovery lock: %v", err)
+	}
+	defer release()
+
+	// Held well past its TTL, another instance still can't take it
+	time.Sleep(3 * cfg.RecoveryLockTTL)
+	acquired, err := h.Redis.AcquireLock(ctx, recoveryLock, "other", cfg.RecoveryLockTTL)
+	if err != nil || acquired {
+		t.Errorf("other instance got the lock %v, %v, want it still held", acquired, err)
+	}
+	if err := context.Cause(lockCtx); err != nil {
+		t.Errorf("recovery cancelled with %v while holding the lock", err)
+	}
+}
+
+func TestRecoveryLockWaitIsBounded(t *testing.T) {
+	cfg := testConfig()
+	cfg.RecoveryLockTTL = 100 * time.Millisecond
+	address, prefix := testRedisPrefix(t)
+	h := NewHandler(cfg, newTestRedis(t, cfg, address, prefix), nil, utils.NewItemGenerator(nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Another instance holds the lock for good, refreshing it
+	holder := newTestRedis(t, cfg, address, prefix)
+	if acquired, err := holder.AcquireLock(ctx, recoveryLock, "other", cfg.RecoveryLockTTL); err != nil || !acquired {
+		t.Fatalf("failed to take the lock for the other instance: %v, %v", acquired, err)
+	}
+	go func() {
+		for sleepContext(ctx, cfg.RecoveryLockTTL/4) {
+			holder.AcquireLock(ctx, recoveryLock, "other", cfg.RecoveryLockTTL)
+		}
+	}()
+
+	started := time.Now()
+	if _, _, err := h.acquireRecoveryLock(ctx); err == nil {
+		t.Fatal("got the lock held by the other instance")
+	}
+	if waited := time.Since(started); waited > 10*cfg.RecoveryLockTTL {
+		t.Errorf("waited %v for the lock, want about %v", waited, recoveryLockMaxWait*cfg.RecoveryLockTTL)
+	}
+}
+
+func TestRecoveryLeavesEndedSaleEnded(t *testing.T) {
+	cfg := testConfig()
+	address, prefix := testRedisPrefix(t)
+	postgres := newTestPostgres(t)
+	ctx := context.Background()
+
+	starter := NewHandler(cfg, newTestRedis(t, cfg, address, prefix), postgres, utils.NewItemGenerator(nil))
+	if err := starter.executeNewSale(ctx); err != nil {
+		t.Fatalf("failed to start the sale: %v", err)
+	}
+	saleID, err := starter.Redis.GetActiveSaleID(ctx)
+	if err != nil {
+		t.Fatalf("failed to get the sale ID: %v", err)
+	}
+	// The sale of the current slot ended in Postgres, and Redis lost its pointer
+	if err := postgres.EndSale(ctx, saleID); err != nil {
+		t.Fatalf("failed to end the sale: %v", err)
+	}
+	if err := starter.Redis.PurgeSaleKeys(ctx, saleID); err != nil {
+		t.Fatalf("failed to purge the sale keys: %v", err)
+	}
+	if _, err := starter.Redis.ClearActiveSalePointer(ctx, saleID); err != nil {
+		t.Fatalf("failed to clear the active sale: %v", err)
+	}
+
+	h := NewHandler(cfg, newTestRedis(t, cfg, address, prefix), postgres, utils.NewItemGenerator(nil))
+	if err := h.recoverSaleState(ctx); err != nil {
+		t.Fatalf("failed to recover the sale: %v", err)
+	}
+
+	// The next sale starts on schedule, the ended one isn't sold again
+	if n := countSales(t, openTestDB(t)); n != 1 {
+		t.Errorf("got %d sales, want no new sale before the next slot", n)
+	}
+	if activeID, err := h.Redis.GetActiveSaleID(ctx); err == nil && activeID != 0 {
+		t.Errorf("got active sale %d, want none", activeID)
+	}
+	if _, err := h.Redis.GetSaleCounters(ctx, saleID); !errors.Is(err, database.ErrSaleKeysNotFound) {
+		t.Errorf("got error %v, want the ended sale's keys left absent", err)
+	}
+}
+
+func TestFailedSaleStartLeavesNoSaleRow(t *testing.T) {
+	cfg := testConfig()
+	postgres := newTestPostgres(t)
+	ctx := context.Background()
+
+	// Nothing listens on port 1, the sale is inserted into Postgres but fails in Redis
+	unreachable := database.NewRedisClient(ctx, "127.0.0.1:1", "test:", 0, database.CheckoutLimits{})
+	t.Cleanup(func() { unreachable.Close() })
+	h := NewHandler(cfg, unreachable, postgres, utils.NewItemGenerator(nil))
+
+	db := openTestDB(t)
+	// Every retry inserts the sale again, none may stay behind
+	for attempt := 1; attempt <= 3; attempt++ {
+		if err := h.executeNewSale(ctx); err == nil {
+			t.Fatalf("attempt %d: the sale started without Redis", attempt)
+		}
+		if n := countSales(t, db); n != 0 {
+			t.Fatalf("attempt %d: got %d sales, want the failed sale deleted", attempt, n)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	myLogger "github.com/pcristin/golang_contest/internal/logger"
+	"github.com/pcristin/golang_contest/internal/utils"
+)
+
+// Maintenance answers all requests with 503 while maintenance mode is on. Health checks
+// stay up for orchestrators and admin requests pass, so maintenance can be turned off.
+// Only new requests are checked, those in flight when it's turned on complete normally.
+func (h *Handler) Maintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.maintenance.Load() || r.URL.Path == "/health" || r.URL.Path == "/ready" || h.isAdmin(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		retryAfter := h.Config.GetMaintenanceRetryAfter()
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeJSON(w, http.StatusServiceUnavailable, MaintenanceResponse{
+			Error:      "under maintenance",
+			RetryAfter: retryAfter,
+		})
+	})
+}
+
+// SetMaintenance turns maintenance mode on or off
+func (h *Handler) SetMaintenance(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), myLogger.RequestIDKey, utils.GenerateRequestID())
+	logger := myLogger.FromContext(ctx, "admin")
+
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+		return
+	}
+
+	previous := h.maintenance.Swap(enabled)
+	logger.Warn("admin | set maintenance mode", "enabled", enabled, "previous", previous)
+
+	writeJSON(w, http.StatusOK, MaintenanceStatusResponse{
+		Enabled:  enabled,
+		Previous: previous,
+	})
+}
@@ -2,25 +2,43 @@ package api
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"math/rand"
 	"net/http"
 	"strconv"
 	"time"
 
+	"github.com/pcristin/golang_contest/internal/config"
 	"github.com/pcristin/golang_contest/internal/database"
 	myLogger "github.com/pcristin/golang_contest/internal/logger"
 )
 
+// Retries of a purchase that lost the WATCH race on its checkout code. Usually the
+// code was purchased concurrently and the retry finds it gone.
+const (
+	purchaseContentionRetries = 3
+	purchaseContentionBackoff = 2 * time.Millisecond
+)
+
 func (h *Handler) Purchase(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	logger := myLogger.FromContext(ctx, "purchase_handler")
-	// Check if the request method is POST
-	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+	// Checked before the code is consumed, it couldn't be purchased again
+	version, ok := requestedAPIVersion(r)
+	if !ok {
+		rejectAPIVersion(w)
+		return
+	}
+
+	// Shed load instead of piling up on Redis WATCH contention
+	if !h.acquirePurchaseSlot() {
+		logger.Warn("purchase | too many purchases in flight")
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
 		return
 	}
+	defer h.releasePurchaseSlot()
 
 	// Parse the request body
 	code := r.URL.Query().Get("code")
@@ -34,29 +52,57 @@ func (h *Handler) Purchase(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get checkout data from Redis
-	checkoutData, err := h.Redis.GetAndDeleteCheckoutCodeAtomically(ctx, code)
-	if checkoutData == "" {
-		logger.Info("purchase | invalid or expired code", "code", code)
+	checkoutData, err := h.getAndDeleteCheckoutCode(ctx, code)
+	if errors.Is(err, database.ErrCheckoutCodeContention) {
+		logger.Warn("purchase | code not purchased", "code", code, "reason", "contention")
 		http.Error(w, "invalid or expired code", http.StatusNotFound)
 		return
 	}
 	if err != nil {
+		// Redis is unreachable, the code may still be valid so let the client retry
+		if database.IsConnectionError(err) {
+			logger.Error("purchase | redis is unavailable", "error", err)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		// The code is kept in Redis until it expires, counters are left as for an expired code
+		if errors.Is(err, database.ErrMalformedCheckoutData) {
+			logger.Error("purchase | malformed checkout data", "code", code, "error", err)
+			http.Error(w, "checkout data is corrupted, please checkout again", http.StatusInternalServerError)
+			return
+		}
 		logger.Error("purchase | failed to get checkout data", "error", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
-
-	// Parse JSON data from Redis
-	var data map[string]string
-	if err := json.Unmarshal([]byte(checkoutData), &data); err != nil {
-		logger.Error("purchase | failed to parse checkout data", "error", err)
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+	// Purchases completed from Postgres are stored already
+	persisted := false
+	if checkoutData == nil && h.Postgres != nil && h.Config.GetPurchasePostgresFallback() {
+		checkoutData, err = h.purchaseFromAttempt(ctx, code)
+		if err != nil {
+			logger.Error("purchase | failed to complete purchase from checkout attempt", "code", code, "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		persisted = checkoutData != nil
+	}
+	if checkoutData == nil {
+		logger.Info("purchase | invalid or expired code", "code", code, "reason", "not_found")
+		http.Error(w, "invalid or expired code", http.StatusNotFound)
 		return
 	}
 
-	userID := data["user_id"]
-	saleIDStr := data["sale_id"]
-	itemID := data["item_id"]
+	// How close users cut it against the checkout code TTL
+	if createdAt, err := time.Parse(time.RFC3339, checkoutData.CreatedAt); err != nil {
+		logger.Warn("purchase | failed to parse checkout creation time", "created_at", checkoutData.CreatedAt, "error", err)
+	} else {
+		h.reservationDurations.observe(h.Clock.Now().Sub(createdAt))
+	}
+
+	userID := checkoutData.UserID
+	saleIDStr := checkoutData.SaleID
+	itemID := checkoutData.ItemID
 	saleID, err := strconv.Atoi(saleIDStr)
 	if err != nil {
 		logger.Error("purchase | failed to convert sale ID to int", "error", err)
@@ -64,46 +110,64 @@ func (h *Handler) Purchase(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get sale data from cache
+	// Get sale data from cache, or from Redis and then Postgres on a miss
 	saleData, ok := h.saleCache.Load(saleID)
-	if !ok {
-		logger.Error("purchase | sale data not found in cache. Requesting sale data from Postgres", "sale_id", saleID)
-		itemName, imageURL, err := h.Postgres.GetSaleByID(saleID)
-		if err != nil {
-			logger.Error("purchase | failed to get sale data from Postgres", "error", err)
+	if ok {
+		h.saleCacheHits.Add(1)
+	} else {
+		h.saleCacheMisses.Add(1)
+		logger.Warn("purchase | sale data not found in cache, loading it", "sale_id", saleID)
+		saleData, err = h.loadSaleData(ctx, saleID)
+		if err != nil && h.Postgres == nil {
+			// Without Postgres the sale may only have lived in the cache, the purchase still goes through
+			logger.Warn("purchase | sale data not found in Redis", "sale_id", saleID, "error", err)
+		} else if err != nil {
+			logger.Error("purchase | failed to get sale data", "error", err)
 			http.Error(w, "internal server error", http.StatusInternalServerError)
 			return
 		}
-		h.saleCache.Store(saleID, SaleData{
-			ItemName: itemName,
-			ImageURL: imageURL,
-		})
-		saleData = SaleData{
-			ItemName: itemName,
-			ImageURL: imageURL,
+	}
+	itemName := saleData.ItemName
+	imageURL := saleData.ImageURL
+
+	// Sync mode answers only once the purchase is stored
+	if !persisted && h.Postgres != nil && h.Config.GetPurchaseWriteMode() == config.PurchaseWriteModeSync {
+		if err := h.Postgres.CompletePurchase(ctx, code, userID, saleID, itemID); err != nil {
+			logger.Error("purchase | failed to store purchase", "code", code, "error", err)
+			h.restoreCheckoutCode(ctx, code, checkoutData)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
 		}
+		persisted = true
 	}
-	itemName := saleData.(SaleData).ItemName
-	imageURL := saleData.(SaleData).ImageURL
 
 	defer func() {
+		if persisted || h.Postgres == nil {
+			return
+		}
 		select {
 		case h.purchasesChan <- database.Purchase{
 			UserID:      userID,
 			SaleID:      saleID,
 			ItemID:      itemID,
-			PurchasedAt: time.Now(),
+			PurchasedAt: h.Clock.Now(),
 		}:
 			// Sent to the background worker
 		default:
-			logger.Error("dropped purchase: channel full")
+			h.purchaseDrops.add(logger)
 		}
 	}()
 
 	logger.Info("purchase | purchase completed successfully", "user_id", userID, "item_id", itemID, "sale_id", saleID)
+	h.enqueuePurchaseWebhook(logger, PurchaseEvent{
+		UserID:      userID,
+		SaleID:      saleID,
+		ItemID:      itemID,
+		PurchasedAt: h.Clock.Now().UTC().Format(time.RFC3339),
+	})
 
 	metadata := ""
-	if rand.Intn(100) < 1 {
+	if h.Rand.Intn(100) < 1 {
 		metadata = "b64 aHR0cHM6Ly9naXRodWIuY29tL3BjcmlzdGluL2ZpbmRfd2hhdHNfaGlkZGVu"
 	}
 
@@ -115,8 +179,88 @@ func (h *Handler) Purchase(w http.ResponseWriter, r *http.Request) {
 		Metadata: metadata,
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(resp)
+	writeVersionedJSON(w, http.StatusOK, version, resp)
+}
+
+// acquirePurchaseSlot reserves a slot for a purchase, false if all slots are taken
+func (h *Handler) acquirePurchaseSlot() bool {
+	if h.purchaseSlots != nil {
+		select {
+		case h.purchaseSlots <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	h.purchasesInFlight.Add(1)
+	return true
+}
+
+// releasePurchaseSlot frees the slot of a finished purchase
+func (h *Handler) releasePurchaseSlot() {
+	h.purchasesInFlight.Add(-1)
+	if h.purchaseSlots != nil {
+		<-h.purchaseSlots
+	}
+}
+
+// restoreCheckoutCode puts a consumed code back for the rest of its TTL, so a purchase that
+// failed to be stored can be retried. Expired codes are left out, like any other expired code.
+func (h *Handler) restoreCheckoutCode(ctx context.Context, code string, checkoutData *database.CheckoutData) {
+	logger := myLogger.FromContext(ctx, "purchase_handler")
+
+	createdAt, err := time.Parse(time.RFC3339, checkoutData.CreatedAt)
+	if err != nil {
+		logger.Error("purchase | failed to restore checkout code", "code", code, "error", err)
+		return
+	}
+	ttl := checkoutData.TTL
+	if ttl <= 0 {
+		ttl = checkoutCodeTTL
+	}
+	remaining := ttl - int(h.Clock.Now().Sub(createdAt).Seconds())
+	if remaining <= 0 {
+		return
+	}
+	if err := h.Redis.SetCheckoutCode(ctx, *checkoutData, code, remaining); err != nil {
+		logger.Error("purchase | failed to restore checkout code", "code", code, "error", err)
+	}
+}
+
+// purchaseFromAttempt completes the purchase of a code missing in Redis from its checkout attempt.
+// Consumed codes are missing as well, so this only happens when the sale keys are gone too,
+// meaning Redis lost its data. Returns nil if the code can't be purchased.
+func (h *Handler) purchaseFromAttempt(ctx context.Context, code string) (*database.CheckoutData, error) {
+	logger := myLogger.FromContext(ctx, "purchase_handler")
+
+	attempt, err := h.Postgres.GetCheckoutAttemptByCode(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	if attempt == nil || attempt.Status != database.CheckoutStatusSuccess {
+		return nil, nil
+	}
+
+	if _, err := h.Redis.GetSaleItemsSoldCount(ctx, attempt.SaleID); !errors.Is(err, database.ErrSaleKeysNotFound) {
+		// The sale data is intact, so the code was consumed or has expired
+		return nil, nil
+	}
+
+	// Extensions aren't stored in Postgres, so only the initial TTL is trusted
+	attempt, err = h.Postgres.CompletePurchaseFromAttempt(ctx, code, checkoutCodeTTL*time.Second)
+	if errors.Is(err, database.ErrCheckoutCodeNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Warn("purchase | code missing in Redis, purchase completed from checkout attempt", "code", code, "sale_id", attempt.SaleID)
+	return &database.CheckoutData{
+		UserID:    attempt.UserID,
+		SaleID:    strconv.Itoa(attempt.SaleID),
+		ItemID:    attempt.ItemID,
+		CreatedAt: attempt.CreatedAt.Format(time.RFC3339),
+	}, nil
 }
 
 // ProcessExpiredCheckout processes expired checkout attempts in the background
@@ -132,28 +276,28 @@ func (h *Handler) ProcessExpiredCheckouts(ctx context.Context) {
 			logger.Info("purchase | background worker stopped")
 			return
 		case <-ticker.C:
-			err := h.CleanupExpiredCheckouts(ctx)
-			if err != nil {
+			if _, err := h.CleanupExpiredCheckouts(ctx); err != nil {
 				logger.Error("purchase | failed to cleanup expired checkout attempts", "error", err)
 			}
 		}
 	}
 }
 
-// CleanupExpiredCheckouts cleans up expired checkout attempts
-func (h *Handler) CleanupExpiredCheckouts(ctx context.Context) error {
+// CleanupExpiredCheckouts marks the checkout attempts whose code expired as expired.
+// Returns the number of marked attempts.
+func (h *Handler) CleanupExpiredCheckouts(ctx context.Context) (int, error) {
 	logger := myLogger.FromContext(ctx, "purchase_handler")
 
-	// Get potentialy expired attempts (older than 50 seconds to be safe)
-	attempts, err := h.Postgres.GetExpiredCheckoutAttempts(50 * time.Second)
+	// Get potentialy expired attempts (expired more than 30 seconds ago to be safe)
+	attempts, err := h.Postgres.GetExpiredCheckoutAttempts(ctx, 30*time.Second, checkoutCodeTTL*time.Second)
 	if err != nil {
 		logger.Error("purchase | failed to get expired checkout attempts", "error", err)
-		return err
+		return 0, err
 	}
 
 	if len(attempts) == 0 {
 		logger.Debug("purchase | no expired checkout attempts found")
-		return nil
+		return 0, nil
 	}
 
 	var expiredIDs []int
@@ -165,7 +309,7 @@ func (h *Handler) CleanupExpiredCheckouts(ctx context.Context) error {
 
 		// Check if code still exists in Redis
 		_, err := h.Redis.GetCheckoutCode(ctx, *attempt.Code)
-		if err != nil {
+		if errors.Is(err, database.ErrCheckoutCodeNotFound) {
 			// Code doesn't exist = expired
 			expiredIDs = append(expiredIDs, attempt.ID)
 		}
@@ -173,20 +317,43 @@ func (h *Handler) CleanupExpiredCheckouts(ctx context.Context) error {
 
 	if len(expiredIDs) == 0 {
 		logger.Debug("purchase | no expired checkout attempts found")
-		return nil
+		return 0, nil
 	}
 
 	// Update database
-	if err := h.Postgres.MarkAttemptsExpired(expiredIDs); err != nil {
+	if err := h.Postgres.MarkAttemptsExpired(ctx, expiredIDs); err != nil {
 		logger.Error("purchase | failed to mark attempts as expired", "error", err)
-		return fmt.Errorf("failed to mark attempts as expired: %v", err)
+		return 0, fmt.Errorf("failed to mark attempts as expired: %v", err)
 	}
 
 	logger.Info("expired checkouts | cleaned up expired attempts", "count", len(expiredIDs))
-	return nil
+	return len(expiredIDs), nil
 }
 
-// processPurchaseInserts processes the purchase inserts in background worker pattern
+// getAndDeleteCheckoutCode consumes the checkout code, retrying a few times with a
+// short backoff while it loses the WATCH race. Returns ErrCheckoutCodeContention
+// once the retries are exhausted.
+func (h *Handler) getAndDeleteCheckoutCode(ctx context.Context, code string) (*database.CheckoutData, error) {
+	backoff := purchaseContentionBackoff
+	for attempt := 0; ; attempt++ {
+		checkoutData, err := h.Redis.GetAndDeleteCheckoutCodeAtomically(ctx, code)
+		if !errors.Is(err, database.ErrCheckoutCodeContention) || attempt == purchaseContentionRetries {
+			return checkoutData, err
+		}
+
+		// Jitter keeps the racing requests from colliding again
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff + time.Duration(h.Rand.Int63n(int64(backoff)))):
+		}
+		backoff *= 2
+	}
+}
+
+// processPurchaseInserts processes the purchase inserts in background worker pattern.
+// Several workers may drain the channel at once, each with its own batch, so
+// purchases are not guaranteed to be inserted in the order they were made.
 func (h *Handler) ProcessPurchaseInserts(ctx context.Context) {
 	logger := myLogger.FromContext(ctx, "purchase_worker")
 
@@ -199,7 +366,8 @@ func (h *Handler) ProcessPurchaseInserts(ctx context.Context) {
 			// Flush remaining inserts
 			if len(batch) > 0 {
 				logger.Debug("flushing batch", "count", len(batch))
-				h.flushPurchaseBatch(ctx, batch)
+				// The worker context is cancelled already, the final flush must still run
+				h.purchasesFlushed.Add(h.flushPurchaseBatch(context.WithoutCancel(ctx), batch))
 			}
 			logger.Debug("context done")
 			return
@@ -218,21 +386,28 @@ func (h *Handler) ProcessPurchaseInserts(ctx context.Context) {
 				h.flushPurchaseBatch(ctx, batch)
 				batch = batch[:0]
 			}
+			h.purchaseDrops.report(logger, h.Config.GetDropLogInterval())
 		}
 	}
 }
 
-// flushPurchaseBatch flushes the batch to the database
-func (h *Handler) flushPurchaseBatch(ctx context.Context, batch []database.Purchase) {
+// flushPurchaseBatch flushes the batch to the database and returns the number of purchases written
+func (h *Handler) flushPurchaseBatch(ctx context.Context, batch []database.Purchase) int64 {
 	// Init loger for module
 	logger := myLogger.FromContext(ctx, "purchase_worker")
 
-	err := h.Postgres.BatchInsertPurchases(batch)
-	if err != nil {
-		for _, purchase := range batch {
-			if err := h.Postgres.InsertPurchase(purchase.UserID, purchase.SaleID, purchase.ItemID); err != nil {
-				logger.Error("purchase | failed to insert purchase", "error", err)
-			}
+	err := h.Postgres.BatchInsertPurchases(ctx, batch)
+	if err == nil {
+		return int64(len(batch))
+	}
+
+	var written int64
+	for _, purchase := range batch {
+		if err := h.Postgres.InsertPurchase(ctx, purchase.UserID, purchase.SaleID, purchase.ItemID); err != nil {
+			logger.Error("purchase | failed to insert purchase", "error", err)
+			continue
 		}
+		written++
 	}
+	return written
 }
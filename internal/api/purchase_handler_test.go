@@ -0,0 +1,29 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pcristin/golang_contest/internal/config"
+	"github.com/pcristin/golang_contest/internal/database"
+	"github.com/pcristin/golang_contest/internal/utils"
+)
+
+func TestPurchaseRedisUnavailable(t *testing.T) {
+	// Nothing listens on port 1, the code may still be valid
+	redis := database.NewRedisClient(context.Background(), "127.0.0.1:1", "test:", 0, database.CheckoutLimits{})
+	t.Cleanup(func() { redis.Close() })
+	h := NewHandler(config.NewConfig(), redis, nil, utils.NewItemGenerator(nil))
+
+	rec := httptest.NewRecorder()
+	h.Purchase(rec, httptest.NewRequest(http.MethodPost, "/purchase?code=abc", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusServiceUnavailable, rec.Body.String())
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("got Retry-After %q, want 1", got)
+	}
+}
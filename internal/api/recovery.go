@@ -0,0 +1,42 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	myLogger "github.com/pcristin/golang_contest/internal/logger"
+)
+
+// Recover turns panics of the handlers into 500 responses.
+// The stack only goes to the logs, the panic message is added to the response with debugErrors.
+func Recover(next http.Handler, debugErrors bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// Used by net/http to abort a response on purpose
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			logger := myLogger.FromContext(r.Context(), "recovery")
+			logger.Error("server | recovered from panic", "method", r.Method, "path", r.URL.Path,
+				"panic", recovered, "stack", string(debug.Stack()))
+
+			response := ErrorResponse{Error: "Internal server error"}
+			if debugErrors {
+				response.Panic = fmt.Sprint(recovered)
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(response)
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
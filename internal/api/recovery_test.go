@@ -0,0 +1,56 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecoverPanicMessage(t *testing.T) {
+	panicking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("secret internals")
+	})
+
+	tests := []struct {
+		name        string
+		debugErrors bool
+		wantPanic   string
+	}{
+		{"prod hides the panic", false, ""},
+		{"debug shows the panic", true, "secret internals"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			Recover(panicking, tt.debugErrors).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if rec.Code != http.StatusInternalServerError {
+				t.Fatalf("got status %d, want %d", rec.Code, http.StatusInternalServerError)
+			}
+			var response ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatalf("invalid JSON body %q: %v", rec.Body.String(), err)
+			}
+			if response.Error != "Internal server error" {
+				t.Errorf("got error %q, want the generic message", response.Error)
+			}
+			if response.Panic != tt.wantPanic {
+				t.Errorf("got panic %q, want %q", response.Panic, tt.wantPanic)
+			}
+		})
+	}
+}
+
+func TestRecoverRepanicsAbortHandler(t *testing.T) {
+	aborting := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})
+
+	defer func() {
+		if recovered := recover(); recovered != http.ErrAbortHandler {
+			t.Fatalf("got panic %v, want http.ErrAbortHandler", recovered)
+		}
+	}()
+	Recover(aborting, true).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
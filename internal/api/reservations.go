@@ -0,0 +1,39 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	myLogger "github.com/pcristin/golang_contest/internal/logger"
+)
+
+// reservationPruneInterval is how often expired codes are removed from the reservation count
+const reservationPruneInterval = 10 * time.Second
+
+// ProcessReservationPruning keeps the reservation count of the active sale in line
+// with the checkout codes that still exist, and gives the items of expired codes back
+// to the sale. Purchases and cleared reservations release their code right away,
+// expired codes are only caught here.
+func (h *Handler) ProcessReservationPruning(ctx context.Context) {
+	logger := myLogger.FromContext(ctx, "reservation_worker")
+
+	ticker := time.NewTicker(reservationPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("reservations | background worker stopped")
+			return
+		case <-ticker.C:
+			pruned, err := h.Redis.PruneReservations(ctx)
+			if err != nil {
+				logger.Error("reservations | failed to prune expired reservations", "error", err)
+				continue
+			}
+			if pruned > 0 {
+				logger.Info("reservations | released expired reservations", "count", pruned)
+			}
+		}
+	}
+}
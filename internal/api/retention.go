@@ -0,0 +1,101 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	myLogger "github.com/pcristin/golang_contest/internal/logger"
+)
+
+// ProcessAttemptsRetention periodically deletes old checkout attempts in the background
+func (h *Handler) ProcessAttemptsRetention(ctx context.Context) {
+	logger := myLogger.FromContext(ctx, "retention_worker")
+
+	if h.Config.GetAttemptsRetention() == 0 {
+		logger.Info("retention | checkout attempts retention disabled")
+		return
+	}
+
+	ticker := time.NewTicker(h.Config.GetRetentionInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("retention | background worker stopped")
+			return
+		case <-ticker.C:
+			h.pruneAttempts(ctx)
+		}
+	}
+}
+
+// ProcessPurchasesArchival periodically moves old purchases to the archive table in the background
+func (h *Handler) ProcessPurchasesArchival(ctx context.Context) {
+	logger := myLogger.FromContext(ctx, "archival_worker")
+
+	if h.Config.GetPurchasesArchival() == 0 {
+		logger.Info("archival | purchases archival disabled")
+		return
+	}
+
+	ticker := time.NewTicker(h.Config.GetRetentionInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("archival | background worker stopped")
+			return
+		case <-ticker.C:
+			h.archivePurchases(ctx)
+		}
+	}
+}
+
+// archivePurchases moves old purchases to the archive table in bounded batches
+func (h *Handler) archivePurchases(ctx context.Context) {
+	logger := myLogger.FromContext(ctx, "archival_worker")
+
+	cutoff := time.Now().Add(-h.Config.GetPurchasesArchival())
+	batchSize := h.Config.GetRetentionBatchSize()
+
+	var archived int64
+	for ctx.Err() == nil {
+		moved, err := h.Postgres.ArchiveOldPurchases(ctx, cutoff, batchSize)
+		if err != nil {
+			logger.Error("archival | failed to archive old purchases", "error", err)
+			break
+		}
+		archived += moved
+		h.purchasesArchived.Add(moved)
+		if moved < int64(batchSize) {
+			break
+		}
+	}
+
+	logger.Info("archival | archived purchases", "count", archived, "cutoff", cutoff)
+}
+
+// pruneAttempts deletes old checkout attempts in bounded batches to avoid long locks
+func (h *Handler) pruneAttempts(ctx context.Context) {
+	logger := myLogger.FromContext(ctx, "retention_worker")
+
+	cutoff := time.Now().Add(-h.Config.GetAttemptsRetention())
+	batchSize := h.Config.GetRetentionBatchSize()
+
+	var pruned int64
+	for ctx.Err() == nil {
+		deleted, err := h.Postgres.DeleteOldAttempts(ctx, cutoff, batchSize)
+		if err != nil {
+			logger.Error("retention | failed to delete old checkout attempts", "error", err)
+			break
+		}
+		pruned += deleted
+		if deleted < int64(batchSize) {
+			break
+		}
+	}
+
+	logger.Info("retention | pruned checkout attempts", "count", pruned, "cutoff", cutoff)
+}
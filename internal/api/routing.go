@@ -0,0 +1,48 @@
+package api
+
+import (
+	"net/http"
+)
+
+// JSONErrors answers the requests the mux has no route for with a JSON ErrorResponse
+// instead of the plain text body of net/http. The mux still picks the status, 404 for
+// unknown paths and 405 with the Allow header for known paths with another method.
+func JSONErrors(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// An empty pattern means no route matched, redirects have one
+		if _, pattern := mux.Handler(r); pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		unmatched := &unmatchedRecorder{header: make(http.Header), status: http.StatusNotFound}
+		mux.ServeHTTP(unmatched, r)
+
+		if allow := unmatched.header.Get("Allow"); allow != "" {
+			w.Header().Set("Allow", allow)
+		}
+		message := "not found"
+		if unmatched.status == http.StatusMethodNotAllowed {
+			message = "method not allowed"
+		}
+		writeJSON(w, unmatched.status, ErrorResponse{Error: message})
+	})
+}
+
+// unmatchedRecorder keeps the status and headers of the mux's own error response and drops its body
+type unmatchedRecorder struct {
+	header http.Header
+	status int
+}
+
+func (u *unmatchedRecorder) Header() http.Header {
+	return u.header
+}
+
+func (u *unmatchedRecorder) WriteHeader(status int) {
+	u.status = status
+}
+
+func (u *unmatchedRecorder) Write(b []byte) (int, error) {
+	return len(b), nil
+}
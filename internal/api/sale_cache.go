@@ -0,0 +1,55 @@
+package api
+
+import "sync"
+
+// saleCache caches per-sale values by sale ID, keeping at most maxSales entries.
+// Sale IDs grow with every sale, so the lowest ID is evicted first.
+// It's typed so that callers can't store or read anything else.
+type saleCache[V any] struct {
+	mu       sync.RWMutex
+	entries  map[int]V
+	maxSales int
+}
+
+// newSaleCache creates a cache holding up to maxSales sales
+func newSaleCache[V any](maxSales int) *saleCache[V] {
+	return &saleCache[V]{
+		entries:  make(map[int]V),
+		maxSales: max(maxSales, 1),
+	}
+}
+
+// Load returns the cached value of the sale
+func (c *saleCache[V]) Load(saleID int) (V, bool) {
+	c.mu.RLock()
+	value, ok := c.entries[saleID]
+	c.mu.RUnlock()
+	return value, ok
+}
+
+// Store caches the value of the sale, evicting the oldest sale if the cache is full
+func (c *saleCache[V]) Store(saleID int, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[saleID] = value
+	for len(c.entries) > c.maxSales {
+		oldest := saleID
+		for id := range c.entries {
+			oldest = min(oldest, id)
+		}
+		delete(c.entries, oldest)
+	}
+}
+
+// Cap returns the max number of cached sales
+func (c *saleCache[V]) Cap() int {
+	return c.maxSales
+}
+
+// Len returns the number of cached sales
+func (c *saleCache[V]) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.entries)
+}
@@ -0,0 +1,51 @@
+package api
+
+import "testing"
+
+func TestSaleCacheStaysBounded(t *testing.T) {
+	const maxSales = 4
+	cache := newSaleCache[SaleData](maxSales)
+
+	// Every rollover caches the new sale
+	for saleID := 1; saleID <= 1000; saleID++ {
+		cache.Store(saleID, SaleData{ItemName: "item"})
+		if cache.Len() > maxSales {
+			t.Fatalf("cache holds %d sales after sale %d, want at most %d", cache.Len(), saleID, maxSales)
+		}
+	}
+
+	// The newest sales are kept, the older ones evicted
+	for saleID := 997; saleID <= 1000; saleID++ {
+		if _, ok := cache.Load(saleID); !ok {
+			t.Errorf("sale %d was evicted", saleID)
+		}
+	}
+	if _, ok := cache.Load(996); ok {
+		t.Error("sale 996 is still cached")
+	}
+}
+
+func TestSaleCacheStoreReplaces(t *testing.T) {
+	cache := newSaleCache[SaleData](2)
+	cache.Store(1, SaleData{ItemName: "stale"})
+	cache.Store(1, SaleData{ItemName: "fresh"})
+
+	if cache.Len() != 1 {
+		t.Fatalf("cache holds %d sales, want 1", cache.Len())
+	}
+	if saleData, _ := cache.Load(1); saleData.ItemName != "fresh" {
+		t.Errorf("got item %q, want %q", saleData.ItemName, "fresh")
+	}
+}
+
+func TestSaleCacheMinimumSize(t *testing.T) {
+	cache := newSaleCache[SaleData](0)
+	if cache.Cap() != 1 {
+		t.Fatalf("got cap %d, want 1", cache.Cap())
+	}
+	cache.Store(1, SaleData{})
+	cache.Store(2, SaleData{})
+	if _, ok := cache.Load(2); !ok || cache.Len() != 1 {
+		t.Errorf("cache of size 0 should keep the latest sale only, has %d", cache.Len())
+	}
+}
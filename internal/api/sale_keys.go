@@ -0,0 +1,44 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	myLogger "github.com/pcristin/golang_contest/internal/logger"
+)
+
+// saleKeyRefreshInterval is how often the TTL of the active sale's keys is renewed,
+// well within saleKeyTTL so a missed refresh or two can't let them expire
+const saleKeyRefreshInterval = 5 * time.Minute
+
+// saleKeyTTL is the TTL the sale keys are renewed to, the one they are created with
+const saleKeyTTL = time.Hour
+
+// ProcessSaleKeyRefresh keeps the keys of the active sale from expiring while it runs.
+// They are created with a one hour TTL, but a sale of a daily schedule can run longer.
+// A closed sale is no longer refreshed, so its keys expire as before.
+func (h *Handler) ProcessSaleKeyRefresh(ctx context.Context) {
+	logger := myLogger.FromContext(ctx, "sale_key_worker")
+
+	ticker := time.NewTicker(saleKeyRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("sale keys | background worker stopped")
+			return
+		case <-ticker.C:
+			saleID, err := h.Redis.GetActiveSaleID(ctx)
+			if err != nil || saleID == 0 {
+				continue
+			}
+			refreshed, err := h.Redis.RefreshSaleKeys(ctx, saleID, saleKeyTTL)
+			if err != nil {
+				logger.Error("sale keys | failed to refresh sale keys", "sale_id", saleID, "error", err)
+				continue
+			}
+			logger.Debug("sale keys | refreshed sale keys", "sale_id", saleID, "refreshed", refreshed)
+		}
+	}
+}
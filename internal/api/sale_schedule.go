@@ -0,0 +1,69 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// saleSchedule holds the daily wall-clock times sales start at
+type saleSchedule struct {
+	times    []time.Duration // offsets from midnight, sorted
+	location *time.Location
+}
+
+// parseSaleSchedule parses comma separated HH:MM times in the given timezone
+func parseSaleSchedule(times string, timezone string) (*saleSchedule, error) {
+	location := time.Local
+	if timezone != "" {
+		var err error
+		location, err = time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sale timezone %q: %v", timezone, err)
+		}
+	}
+
+	schedule := &saleSchedule{location: location}
+	for _, value := range strings.Split(times, ",") {
+		clock, err := time.Parse("15:04", strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid sale time %q: %v", value, err)
+		}
+		schedule.times = append(schedule.times, time.Duration(clock.Hour())*time.Hour+time.Duration(clock.Minute())*time.Minute)
+	}
+	sort.Slice(schedule.times, func(i, j int) bool { return schedule.times[i] < schedule.times[j] })
+
+	return schedule, nil
+}
+
+// at returns the scheduled time of the day offset from now's date.
+// time.Date shifts times skipped by a DST transition forward.
+func (s *saleSchedule) at(now time.Time, dayOffset int, offset time.Duration) time.Time {
+	return time.Date(now.Year(), now.Month(), now.Day()+dayOffset,
+		int(offset/time.Hour), int(offset%time.Hour/time.Minute), 0, 0, s.location)
+}
+
+// next returns the first scheduled time after now
+func (s *saleSchedule) next(now time.Time) time.Time {
+	now = now.In(s.location)
+	for dayOffset := 0; ; dayOffset++ {
+		for _, offset := range s.times {
+			if candidate := s.at(now, dayOffset, offset); candidate.After(now) {
+				return candidate
+			}
+		}
+	}
+}
+
+// previous returns the last scheduled time at or before now
+func (s *saleSchedule) previous(now time.Time) time.Time {
+	now = now.In(s.location)
+	for dayOffset := 0; ; dayOffset-- {
+		for i := len(s.times) - 1; i >= 0; i-- {
+			if candidate := s.at(now, dayOffset, s.times[i]); !candidate.After(now) {
+				return candidate
+			}
+		}
+	}
+}
@@ -2,40 +2,98 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
+	"unicode/utf8"
 
+	"github.com/pcristin/golang_contest/internal/database"
 	myLogger "github.com/pcristin/golang_contest/internal/logger"
 	"github.com/pcristin/golang_contest/internal/utils"
 )
 
-// StartSaleScheduler starts the sale scheduler exactly at :00 on the running machine
+// StartSaleScheduler starts the sale scheduler exactly at :00 on the running machine,
+// or at the configured daily times
 func (h *Handler) StartSaleScheduler(ctx context.Context) {
 	logger := myLogger.FromContext(ctx, "sale_scheduler")
 	logger.Info("sale scheduler | starting sale scheduler with recovery check")
 
+	h.LoadSaleSchedule(ctx)
+
 	// Reovery check on startup
 	if err := h.recoverSaleState(ctx); err != nil {
 		logger.Error("sale scheduler | recovery failed, will retry", "error", err)
 		// !!! DO NOT FAIL STARTUP, CONTINUE WITH NORMAL SCHEDULING !!!
 	}
 
-	// Calculate time until next hour boundary
-	h.waitForNextHourAndStart(ctx)
+	// The sale is active now, or intentionally absent if the recovery failed
+	h.MarkReady()
+
+	// Calculate time until next sale start
+	h.waitForNextSaleAndStart(ctx)
+}
+
+// MarkReady lets checkouts in once the sale state is known
+func (h *Handler) MarkReady() {
+	if !h.ready.Swap(true) {
+		myLogger.FromContext(context.Background(), "sale_scheduler").Info("sale scheduler | ready to serve checkouts")
+	}
+}
+
+// LoadSaleSchedule parses the configured daily sale times. Sales are hourly without them.
+// Instances that don't run the scheduler still need it for the sale end times of checkouts.
+func (h *Handler) LoadSaleSchedule(ctx context.Context) {
+	logger := myLogger.FromContext(ctx, "sale_scheduler")
+
+	times := h.Config.GetSaleScheduleTimes()
+	if times == "" {
+		return
+	}
+
+	schedule, err := parseSaleSchedule(times, h.Config.GetSaleTimezone())
+	if err != nil {
+		logger.Error("sale scheduler | invalid sale schedule, falling back to hourly sales", "error", err)
+		return
+	}
+	logger.Info("sale scheduler | using daily sale schedule", "times", times, "timezone", schedule.location.String())
+	h.saleSchedule.Store(schedule)
 }
 
-// recoverSaleState checks if we need to start a new sale immediately
+// recoveryLock is the Redis lock held while an instance recovers the sale at startup
+const recoveryLock = "sale_recovery"
+
+// recoveryLockMaxWait is how many lock TTLs an instance waits for another one to
+// finish the recovery before giving up
+const recoveryLockMaxWait = 3
+
+// errRecoveryLockLost stops a recovery whose lock expired or was taken over
+var errRecoveryLockLost = errors.New("recovery lock lost")
+
+// recoverSaleState checks if we need to start a new sale immediately.
+// Instances recover one at a time, the ones waiting find the sale the first one
+// recovered and only warm their cache.
 func (h *Handler) recoverSaleState(ctx context.Context) error {
 	logger := myLogger.FromContext(ctx, "sale_scheduler")
 
+	ctx, release, err := h.acquireRecoveryLock(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	maxRetries := 3
+	backoff := h.schedulerBackoff()
+	started := time.Now()
 	for attempt := 1; attempt <= maxRetries; attempt++ {
 		if err := h.tryRecoverSaleState(ctx); err != nil {
 			logger.Error("sale scheduler | recovery attempt failed", "attempt", attempt, "max_retries", maxRetries, "error", err)
 			if attempt == maxRetries {
+				logger.Error("sale scheduler | recovery retries exhausted", "total_retry_time", time.Since(started))
 				return err
 			}
-			time.Sleep(time.Duration(attempt) * time.Second) // Exponential backoff
+			if !sleepContext(ctx, backoff.Delay(attempt)) {
+				return context.Cause(ctx)
+			}
 			continue
 		}
 		return nil
@@ -43,64 +101,296 @@ func (h *Handler) recoverSaleState(ctx context.Context) error {
 	return fmt.Errorf("failed to recover sale state after %d attempts", maxRetries)
 }
 
+// acquireRecoveryLock waits until this instance holds the recovery lock. A holder that
+// crashed loses the lock once it expires, a live one refreshes it until it's released.
+// Returns a context that is cancelled if the lock is lost, and the function releasing
+// the lock.
+func (h *Handler) acquireRecoveryLock(ctx context.Context) (context.Context, func(), error) {
+	logger := myLogger.FromContext(ctx, "sale_scheduler")
+
+	ttl := h.Config.GetRecoveryLockTTL()
+	if ttl <= 0 {
+		return ctx, func() {}, nil
+	}
+
+	backoff := h.schedulerBackoff()
+	deadline := time.Now().Add(recoveryLockMaxWait * ttl)
+	for attempt := 1; ; attempt++ {
+		acquired, err := h.Redis.AcquireLock(ctx, recoveryLock, h.lockOwner, ttl)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to acquire recovery lock: %v", err)
+		}
+		if acquired {
+			break
+		}
+		if attempt == 1 {
+			logger.Info("sale scheduler | another instance is recovering the sale, waiting for it")
+		}
+		if time.Now().After(deadline) {
+			return nil, nil, fmt.Errorf("gave up waiting for the recovery lock after %v", recoveryLockMaxWait*ttl)
+		}
+		if !sleepContext(ctx, backoff.Delay(attempt)) {
+			return nil, nil, ctx.Err()
+		}
+	}
+
+	lockCtx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.refreshRecoveryLock(lockCtx, cancel, ttl)
+	}()
+	return lockCtx, func() {
+		cancel(nil)
+		<-done
+		// Released even on shutdown, so the next instance doesn't wait for the TTL
+		if err := h.Redis.ReleaseLock(context.WithoutCancel(ctx), recoveryLock, h.lockOwner); err != nil {
+			logger.Warn("sale scheduler | failed to release recovery lock", "error", err)
+		}
+	}, nil
+}
+
+// refreshRecoveryLock extends the recovery lock every third of its TTL until ctx is
+// done, so a recovery slowed by retries keeps it. Cancels the recovery if the lock
+// was lost.
+func (h *Handler) refreshRecoveryLock(ctx context.Context, cancel context.CancelCauseFunc, ttl time.Duration) {
+	logger := myLogger.FromContext(ctx, "sale_scheduler")
+
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			held, err := h.Redis.AcquireLock(ctx, recoveryLock, h.lockOwner, ttl)
+			if err != nil {
+				// Tried again on the next tick, the lock lasts until its TTL runs out
+				logger.Warn("sale scheduler | failed to refresh recovery lock", "error", err)
+				continue
+			}
+			if !held {
+				logger.Error("sale scheduler | lost the recovery lock, stopping the recovery")
+				cancel(errRecoveryLockLost)
+				return
+			}
+		}
+	}
+}
+
 // tryRecoverSaleState checks if we need to start a new sale immediately
 func (h *Handler) tryRecoverSaleState(ctx context.Context) error {
 	logger := myLogger.FromContext(ctx, "sale_scheduler")
 
+	if h.Postgres == nil {
+		return h.tryRecoverSaleStateFromRedis(ctx)
+	}
+
 	// Check when last sale started
-	lastSaleStartTime, err := h.Postgres.GetLastSaleStartTime()
+	lastSaleStartTime, err := h.Postgres.GetLastSaleStartTime(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to get last sale start time: %v", err)
 	}
-	// If no previous or last sale was more than 1 hour ago, start a new sale
-	if lastSaleStartTime.IsZero() || time.Since(lastSaleStartTime) > time.Hour {
+	// If no previous sale or a sale start was missed, start a new sale
+	if lastSaleStartTime.IsZero() || h.saleStartMissed(lastSaleStartTime, h.Clock.Now()) {
 		return h.executeNewSale(ctx)
 	}
 
-	// Check if current sale is properly set up in Redis
+	// Check if current sale is properly set up in Redis. A running sale keeps its
+	// counters, only a sale whose keys are gone is restored.
 	currentSaleID, err := h.Redis.GetActiveSaleID(ctx)
-	if err != nil || currentSaleID == 0 {
-		logger.Error("sale scheduler | Redis sale state missing, restoring....")
-		// Get the active sale ID from the database
-		activeSaleID, err := h.Postgres.GetActiveSaleID()
-		if err != nil {
-			return fmt.Errorf("failed to get active sale ID: %v", err)
+	if err == nil && currentSaleID != 0 {
+		_, err := h.Redis.GetSaleCounters(ctx, currentSaleID)
+		if err != nil && !errors.Is(err, database.ErrSaleKeysNotFound) {
+			return fmt.Errorf("failed to get counters of current sale: %v", err)
 		}
-		// If no active sale in database, start a new sale
-		if activeSaleID == 0 {
-			return h.executeNewSale(ctx)
+		if err == nil {
+			logger.Info("sale scheduler | current sale is active", "sale_id", currentSaleID)
+
+			// Checkouts and purchases shouldn't need Postgres for the sale data
+			h.warmSaleCache(ctx, currentSaleID)
+			return nil
 		}
-		// Restore Redis state for existing sale
-		return h.restoreRedisSaleState(ctx, activeSaleID)
 	}
+
+	logger.Error("sale scheduler | Redis sale state missing, restoring....")
+	// Get the active sale ID from the database
+	activeSaleID, err := h.Postgres.GetActiveSaleID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get active sale ID: %v", err)
+	}
+	// The sale of the current slot ended early (e.g. sold out and purged), the next
+	// one starts on schedule
+	if activeSaleID == 0 {
+		logger.Info("sale scheduler | sale of the current slot has ended, waiting for the next one", "started_at", lastSaleStartTime)
+		return nil
+	}
+
+	// A sale left over from an earlier slot (e.g. its EndSale failed) would be sold
+	// past its slot. It's replaced by a fresh sale instead of being resumed.
+	sale, err := h.Postgres.GetSaleRecord(ctx, activeSaleID)
+	if err != nil {
+		return fmt.Errorf("failed to get active sale: %v", err)
+	}
+	if sale.EndedAt != nil || h.saleStartMissed(sale.StartedAt, h.Clock.Now()) {
+		logger.Warn("sale scheduler | active sale is stale, starting a new sale instead of restoring it", "sale_id", activeSaleID, "started_at", sale.StartedAt)
+		return h.executeNewSale(ctx)
+	}
+
+	// Restore Redis state for existing sale
+	return h.restoreRedisSaleState(ctx, sale)
+}
+
+// tryRecoverSaleState checks if we need to start a new sale immediately when running without Postgres.
+// The sale record only lives in Redis then.
+func (h *Handler) tryRecoverSaleStateFromRedis(ctx context.Context) error {
+	logger := myLogger.FromContext(ctx, "sale_scheduler")
+
+	currentSaleID, err := h.Redis.GetActiveSaleID(ctx)
+	if err != nil || currentSaleID == 0 {
+		return h.executeNewSale(ctx)
+	}
+
+	startedAt, err := h.Redis.GetSaleStartedAt(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get sale start time: %v", err)
+	}
+	if startedAt.IsZero() || h.saleStartMissed(startedAt, h.Clock.Now()) {
+		return h.executeNewSale(ctx)
+	}
+
 	logger.Info("sale scheduler | current sale is active", "sale_id", currentSaleID)
 	return nil
 }
 
-// waitForNextHourAndStart waits until the next hour boundary and starts a new sale
-func (h *Handler) waitForNextHourAndStart(ctx context.Context) {
+// previousSaleID returns the ID of the sale a new sale replaces, 0 if there is none
+func (h *Handler) previousSaleID(ctx context.Context) (int, error) {
+	if h.Postgres == nil {
+		// A missing pointer just means there was no sale
+		saleID, err := h.Redis.GetActiveSaleID(ctx)
+		if err != nil {
+			return 0, nil
+		}
+		return saleID, nil
+	}
+	return h.Postgres.GetActiveSaleID(ctx)
+}
+
+// insertSale records a new sale and returns its ID.
+// Without Postgres the ID simply follows the previous sale.
+func (h *Handler) insertSale(ctx context.Context, itemName, imageURL string, previousSaleID int) (int, error) {
+	if h.Postgres == nil {
+		return previousSaleID + 1, nil
+	}
+	return h.Postgres.InsertSale(ctx, itemName, imageURL)
+}
+
+// saleStartMissed reports whether a sale should have started since the last one
+func (h *Handler) saleStartMissed(lastSaleStartTime time.Time, now time.Time) bool {
+	schedule := h.saleSchedule.Load()
+	if schedule == nil {
+		return now.Sub(lastSaleStartTime) > time.Hour
+	}
+	return lastSaleStartTime.Before(schedule.previous(now))
+}
+
+// nextSaleStart returns when the next sale starts
+func (h *Handler) nextSaleStart(now time.Time) time.Time {
+	schedule := h.saleSchedule.Load()
+	if schedule == nil {
+		// Next :00 hour
+		return time.Date(now.Year(), now.Month(), now.Day(), now.Hour()+1, 0, 0, 0, now.Location())
+	}
+	return schedule.next(now)
+}
+
+// previousSaleStart returns when the current sale slot started
+func (h *Handler) previousSaleStart(now time.Time) time.Time {
+	schedule := h.saleSchedule.Load()
+	if schedule == nil {
+		// Last :00 hour
+		return time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, now.Location())
+	}
+	return schedule.previous(now)
+}
+
+// nextSaleAfter returns when the next sale after the one started at lastSaleStart
+// starts. After the clock jumped backward the sale that just started would start again.
+func (h *Handler) nextSaleAfter(now time.Time, lastSaleStart time.Time) time.Time {
+	nextSale := h.nextSaleStart(now)
+	if !nextSale.After(lastSaleStart) {
+		nextSale = h.nextSaleStart(lastSaleStart)
+	}
+	return nextSale
+}
+
+// skewCheckInterval is how often the scheduler compares the wall clock with the next
+// sale start. Timers run on the monotonic clock, so alone they miss wall clock jumps.
+const skewCheckInterval = 30 * time.Second
+
+// skewTolerance is how far the timer may disagree with the wall clock before it is
+// logged as clock skew
+const skewTolerance = 2 * time.Second
+
+// waitForNextSaleAndStart waits until the next sale start and starts a new sale
+func (h *Handler) waitForNextSaleAndStart(ctx context.Context) {
 	logger := myLogger.FromContext(ctx, "sale_scheduler")
 
+	var lastSaleStart time.Time
 	for {
-		// Calculate time untill next :00 hour
-		now := time.Now()
-		nextHour := time.Date(now.Year(), now.Month(), now.Day(), now.Hour()+1, 0, 0, 0, now.Location())
-		timeUntilNextHour := nextHour.Sub(now)
+		// Calculate time untill next sale start
+		now := h.Clock.Now()
+		nextSale := h.nextSaleAfter(now, lastSaleStart)
 
-		logger.Info("sale scheduler | waiting until next hour", "time_until_next_hour", timeUntilNextHour, "next_hour", nextHour)
+		logger.Info("sale scheduler | waiting until next sale", "time_until_next_sale", nextSale.Sub(now), "next_sale", nextSale)
 
-		// Wait until the next hour boundary
-		timer := time.NewTimer(timeUntilNextHour)
-		select {
-		case <-timer.C:
-			// Start a new sale
-			h.startNewSaleWithRetries(ctx)
-			// Continue to next hour
-		case <-ctx.Done():
-			timer.Stop()
+		if !h.waitForSaleStart(ctx, nextSale) {
 			logger.Info("sale scheduler | context cancelled, stopping")
 			return
 		}
+
+		// Start a new sale
+		h.startNewSaleWithRetries(ctx)
+		lastSaleStart = nextSale
+		// Continue to next sale
+	}
+}
+
+// waitForSaleStart waits until the wall clock reaches the sale start, catching up as
+// soon as the periodic check notices a forward jump and waiting on after a backward one.
+// Returns false if the context was cancelled.
+func (h *Handler) waitForSaleStart(ctx context.Context, saleStart time.Time) bool {
+	logger := myLogger.FromContext(ctx, "sale_scheduler")
+
+	timer := h.Clock.NewTimer(saleStart.Sub(h.Clock.Now()))
+	defer timer.Stop()
+	check := h.Clock.NewTimer(skewCheckInterval)
+	defer check.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C():
+			early := saleStart.Sub(h.Clock.Now())
+			if early <= 0 {
+				return true
+			}
+			if early > skewTolerance {
+				logger.Warn("sale scheduler | clock skew detected, timer fired before the sale start", "next_sale", saleStart, "early_by", early)
+			}
+			timer.Reset(early)
+		case <-check.C():
+			late := h.Clock.Now().Sub(saleStart)
+			if late < 0 {
+				check.Reset(skewCheckInterval)
+				continue
+			}
+			if late > skewTolerance {
+				logger.Warn("sale scheduler | clock skew detected, sale start passed without the timer firing", "next_sale", saleStart, "late_by", late)
+			}
+			return true
+		}
 	}
 }
 
@@ -109,14 +399,18 @@ func (h *Handler) startNewSaleWithRetries(ctx context.Context) {
 	logger := myLogger.FromContext(ctx, "sale_scheduler")
 
 	maxRetries := 5
+	backoff := h.schedulerBackoff()
+	started := time.Now()
 	for attempt := 1; attempt <= maxRetries; attempt++ {
 		if err := h.executeNewSale(ctx); err != nil {
 			logger.Error("sale scheduler | failed to start new sale", "attempt", attempt, "max_retries", maxRetries, "error", err)
 			if attempt == maxRetries {
-				logger.Error("sale scheduler | CRITICAL: failed to start new sale after max attempts", "max_retries", maxRetries)
+				logger.Error("sale scheduler | CRITICAL: failed to start new sale after max attempts", "max_retries", maxRetries, "total_retry_time", time.Since(started))
+				return
+			}
+			if !sleepContext(ctx, backoff.Delay(attempt)) {
 				return
 			}
-			time.Sleep(time.Duration(attempt*2) * time.Second) // Exponential backoff
 			continue
 		}
 		logger.Info("sale scheduler | new sale started successfully", "attempt", attempt, "max_retries", maxRetries)
@@ -128,85 +422,509 @@ func (h *Handler) startNewSaleWithRetries(ctx context.Context) {
 func (h *Handler) executeNewSale(ctx context.Context) error {
 	logger := myLogger.FromContext(ctx, "sale_scheduler")
 
-	// 1. Generate a new sale ID and item details and cache the sale data
-	saleID := generateSaleID()
-	itemName, imageURL := utils.GenerateItem(saleID, time.Now())
+	// 1. Remember the sale being replaced and read its final counters before its keys expire
+	previousSaleID, err := h.previousSaleID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get active sale ID: %v", err)
+	}
+	var previousCounters database.SaleCounters
+	var previousCountersErr error
+	if previousSaleID != 0 {
+		previousCounters, previousCountersErr = h.Redis.GetSaleCounters(ctx, previousSaleID)
+	}
+
+	// 2. Generate a new sale ID and item details and cache the sale data
+	now := h.Clock.Now()
+	saleID := generateSaleID(now)
+	itemName, imageURL, stock := h.Items.GenerateItem(saleID, now)
+	if stock == 0 {
+		stock = h.Config.GetInitialStock()
+	}
+	// The catalog knows the item by its full name
+	itemIDs := h.Items.ItemIDsFor(itemName)
+	itemName, imageURL = fitSaleItem(ctx, itemName, imageURL)
 
-	// 2. Insert the new sale into the database
-	actualSaleID, err := h.Postgres.InsertSale(itemName, imageURL)
+	// 3. Insert the new sale into the database
+	actualSaleID, err := h.insertSale(ctx, itemName, imageURL, previousSaleID)
 	if err != nil {
 		return fmt.Errorf("failed to insert new sale: %v", err)
 	}
 
-	// 3. Cache the sale data
+	// 4. Cache the sale data
 	h.saleCache.Store(actualSaleID, SaleData{
 		ItemName: itemName,
 		ImageURL: imageURL,
+		Stock:    stock,
 	})
 
-	// 4. Update the Redis active sale pointer
+	// 5. Set up the sale in Redis before it becomes active. Nothing refers to the new
+	// sale yet, so a failure discards it and the retry starts over without a stray row
+	// that would be taken for the previous sale.
+	if err := h.createRedisSale(ctx, actualSaleID, itemName, imageURL, itemIDs, stock); err != nil {
+		h.discardSale(ctx, actualSaleID)
+		return err
+	}
+
+	// 6. Update the Redis active sale pointer
 	if err := h.Redis.UpdateActiveSalePointer(ctx, actualSaleID); err != nil {
+		h.discardSale(ctx, actualSaleID)
 		return fmt.Errorf("failed to update Redis active sale pointer: %v", err)
 	}
+	// Otherwise checkouts keep using the previous sale's keys until the cache expires
+	h.Redis.InvalidateSaleCache()
+
+	// 7. Clean up the old sales in Redis, in the background so a slow cleanup never delays the sale
+	h.startOldSaleCleanup(ctx, actualSaleID)
+
+	// 8. End the previous sale and reconcile it (optional - won't fail if none exists)
+	if previousSaleID == 0 {
+		logger.Info("sale scheduler | no active sale found to end")
+	} else if h.Postgres != nil {
+		logger.Info("sale scheduler | ending active sale", "sale_id", previousSaleID)
+		if err := h.Postgres.EndSale(ctx, previousSaleID); err != nil {
+			logger.Error("sale scheduler | failed to end active sale", "sale_id", previousSaleID, "error", err)
+		}
+		if previousCountersErr != nil {
+			logger.Warn("sale scheduler | skipping reconciliation, items sold count unavailable", "sale_id", previousSaleID, "error", previousCountersErr)
+		} else {
+			h.reconcileSale(ctx, previousSaleID, previousCounters.ItemsSold)
+		}
+	}
+	if previousSaleID != 0 && previousCountersErr == nil {
+		h.logSaleSummary(ctx, previousSaleID, previousCounters, h.Clock.Now())
+	}
+
+	logger.Info("sale scheduler | new sale started successfully", "sale_id", actualSaleID)
+
+	if h.OnSaleStarted != nil {
+		h.OnSaleStarted(ctx, SaleStartedEvent{
+			SaleID:    actualSaleID,
+			ItemName:  itemName,
+			ImageURL:  imageURL,
+			StartedAt: h.Clock.Now().UTC().Format(time.RFC3339),
+		})
+	}
+	return nil
+}
 
-	// 5. Create the new sale in Redis
-	if err := h.Redis.CreateNewSaleKeys(ctx, actualSaleID); err != nil {
+// createRedisSale stores the item, its valid IDs and the counters of a new sale
+func (h *Handler) createRedisSale(ctx context.Context, saleID int, itemName, imageURL string, itemIDs []int64, stock int) error {
+	if err := h.Redis.SetSaleItem(ctx, saleID, itemName, imageURL); err != nil {
+		return fmt.Errorf("failed to set sale item in Redis: %v", err)
+	}
+	if err := h.Redis.SetSaleItemIDs(ctx, saleID, itemIDs); err != nil {
+		return fmt.Errorf("failed to set sale item IDs in Redis: %v", err)
+	}
+	if err := h.Redis.CreateNewSaleKeys(ctx, saleID, stock, h.saleItemCap(stock)); err != nil {
 		return fmt.Errorf("failed to create new sale keys in Redis: %v", err)
 	}
+	return nil
+}
 
-	// 6. Clean up the old sale in Redis
-	if err := h.Redis.CleanupOldSaleData(ctx); err != nil {
-		return fmt.Errorf("failed to cleanup old sale data in Redis: %v", err)
+// discardSale deletes the record of a sale that failed to start. Without Postgres the
+// sale ID is only derived from the previous sale, there is nothing to delete.
+func (h *Handler) discardSale(ctx context.Context, saleID int) {
+	logger := myLogger.FromContext(ctx, "sale_scheduler")
+
+	if h.Postgres == nil {
+		return
+	}
+	if err := h.Postgres.DeleteSale(ctx, saleID); err != nil {
+		logger.Error("sale scheduler | failed to discard sale that failed to start", "sale_id", saleID, "error", err)
+		return
 	}
+	logger.Warn("sale scheduler | discarded sale that failed to start", "sale_id", saleID)
+}
+
+// startOldSaleCleanup deletes the Redis keys of the previous sales in the background.
+// Only one cleanup runs at a time, it is skipped while the previous one is still
+// running. The next rollover catches whatever it skipped.
+func (h *Handler) startOldSaleCleanup(ctx context.Context, activeSaleID int) {
+	logger := myLogger.FromContext(ctx, "sale_scheduler")
 
-	// 7. End any active sale (optional - won't fail if none exists)
-	if err := h.endAnyActiveSale(ctx); err != nil {
-		logger.Error("sale scheduler | failed to end any active sale", "error", err)
+	if !h.cleanupRunning.CompareAndSwap(false, true) {
+		logger.Warn("sale scheduler | previous Redis cleanup still running, skipping", "sale_id", activeSaleID)
+		return
 	}
 
-	logger.Info("sale scheduler | new sale started successfully", "sale_id", actualSaleID)
-	return nil
+	// Stopped on shutdown, the next rollover picks up where it left off
+	h.goBackground(ctx, "sale_cleanup", func(serverCtx context.Context) {
+		defer h.cleanupRunning.Store(false)
+		started := time.Now()
+		if err := h.Redis.CleanupOldSaleData(serverCtx, activeSaleID); err != nil {
+			logger.Error("sale scheduler | failed to cleanup old sale data in Redis", "error", err)
+			return
+		}
+		logger.Info("sale scheduler | cleaned up old sale data in Redis", "duration", time.Since(started))
+	})
+}
+
+// endSoldOutSale ends the sale once it reached its item cap, so it stops taking doomed
+// checkouts until the next sale starts. Only the first checkout over the cap ends it.
+// Codes handed out before can still be purchased, so the reconciliation waits for them.
+func (h *Handler) endSoldOutSale(ctx context.Context, saleID int) {
+	previous := h.soldOutSaleID.Load()
+	if previous == int64(saleID) || !h.soldOutSaleID.CompareAndSwap(previous, int64(saleID)) {
+		return
+	}
+	logger := myLogger.FromContext(ctx, "sale_scheduler")
+	logger.Info("sale scheduler | sale reached its item cap, ending it", "sale_id", saleID)
+
+	// The checkout is answered right away, the sale ends in the background
+	h.goBackground(ctx, "sold_out_sale", func(serverCtx context.Context) {
+		// Ending the sale is finished even if the server is shutting down
+		ctx := context.WithoutCancel(ctx)
+		if err := h.Redis.CloseSale(ctx, saleID); err != nil {
+			logger.Error("sale scheduler | failed to close sold out sale", "sale_id", saleID, "error", err)
+			// Let the next checkout over the cap try again
+			h.soldOutSaleID.CompareAndSwap(int64(saleID), previous)
+			return
+		}
+		if h.Postgres != nil {
+			if err := h.Postgres.EndSale(ctx, saleID); err != nil {
+				logger.Error("sale scheduler | failed to end sold out sale", "sale_id", saleID, "error", err)
+			}
+		}
+
+		// The next sale start won't report on a sale that has ended already. The
+		// report waits for the codes handed out before, unless the server stops first.
+		endedAt := h.Clock.Now()
+		if !h.sleep(serverCtx, h.Config.GetMaxReservationLifetime()) {
+			logger.Warn("sale scheduler | shutting down, skipping report of sold out sale", "sale_id", saleID)
+			return
+		}
+		counters, err := h.Redis.GetSaleCounters(ctx, saleID)
+		if err != nil {
+			logger.Warn("sale scheduler | skipping reconciliation, items sold count unavailable", "sale_id", saleID, "error", err)
+		} else {
+			if h.Postgres != nil {
+				h.reconcileSale(ctx, saleID, counters.ItemsSold)
+			}
+			h.logSaleSummary(ctx, saleID, counters, endedAt)
+		}
+
+		if h.Config.GetSaleEndPurge() {
+			h.purgeEndedSale(ctx, saleID)
+		}
+	})
 }
 
-// endAnyActiveSale ends any active sale
-func (h *Handler) endAnyActiveSale(ctx context.Context) error {
+// goBackground runs fn in the background with the server context, through Background
+// when it's set so the shutdown waits for it
+func (h *Handler) goBackground(ctx context.Context, name string, fn func(ctx context.Context)) {
+	if h.Background != nil {
+		h.Background(name, fn)
+		return
+	}
+	go fn(context.WithoutCancel(ctx))
+}
+
+// purgeEndedSale deletes the Redis keys of an ended sale and clears the active sale
+// pointer, so the sale stops showing as active before its keys would expire
+func (h *Handler) purgeEndedSale(ctx context.Context, saleID int) {
 	logger := myLogger.FromContext(ctx, "sale_scheduler")
 
-	activeSaleID, err := h.Postgres.GetActiveSaleID()
+	if err := h.Redis.PurgeSaleKeys(ctx, saleID); err != nil {
+		logger.Error("sale scheduler | failed to purge ended sale", "sale_id", saleID, "error", err)
+		return
+	}
+	cleared, err := h.Redis.ClearActiveSalePointer(ctx, saleID)
 	if err != nil {
-		return err
+		logger.Error("sale scheduler | failed to clear active sale pointer", "sale_id", saleID, "error", err)
+		return
+	}
+	logger.Info("sale scheduler | purged ended sale", "sale_id", saleID, "pointer_cleared", cleared)
+}
+
+// reconcileSale compares the final Redis items sold count of an ended sale with
+// its purchases in Postgres and stores the result.
+// Reservations that were never purchased show up as a difference as well.
+func (h *Handler) reconcileSale(ctx context.Context, saleID int, itemsSold int64) {
+	logger := myLogger.FromContext(ctx, "sale_scheduler")
+
+	purchases, err := h.Postgres.CountPurchasesBySale(ctx, saleID)
+	if err != nil {
+		logger.Error("sale scheduler | failed to count purchases for reconciliation", "sale_id", saleID, "error", err)
+		return
 	}
 
-	if activeSaleID == 0 {
-		logger.Info("sale scheduler | no active sale found to end")
-		return nil
+	if purchases != itemsSold {
+		logger.Warn("sale scheduler | sale reconciliation found a discrepancy",
+			"sale_id", saleID, "redis_items_sold", itemsSold, "purchases", purchases, "difference", itemsSold-purchases)
+	} else {
+		logger.Info("sale scheduler | sale reconciled", "sale_id", saleID, "items_sold", itemsSold)
 	}
-	logger.Info("sale scheduler | ending active sale", "sale_id", activeSaleID)
-	return h.Postgres.EndSale(activeSaleID)
+
+	if err := h.Postgres.InsertSaleReconciliation(ctx, database.SaleReconciliation{
+		SaleID:         saleID,
+		RedisItemsSold: itemsSold,
+		Purchases:      purchases,
+		CheckedAt:      h.Clock.Now(),
+	}); err != nil {
+		logger.Error("sale scheduler | failed to store sale reconciliation", "sale_id", saleID, "error", err)
+	}
+}
+
+// logSaleSummary logs the report of an ended sale, from its Redis counters and, with
+// Postgres, its purchases and expired reservations. Reservations still running when
+// the sale ended aren't counted as expired yet.
+func (h *Handler) logSaleSummary(ctx context.Context, saleID int, counters database.SaleCounters, endedAt time.Time) {
+	logger := myLogger.FromContext(ctx, "sale_scheduler")
+
+	summary := SaleSummary{
+		SaleID:       saleID,
+		InitialStock: counters.InitialStock,
+		ItemsSold:    counters.ItemsSold,
+	}
+	if !counters.StartedAt.IsZero() {
+		summary.DurationSeconds = int64(endedAt.Sub(counters.StartedAt).Seconds())
+	}
+	if saleData, ok := h.saleCache.Load(saleID); ok {
+		summary.ItemName = saleData.ItemName
+	} else if saleData, err := h.loadSaleData(ctx, saleID); err == nil {
+		summary.ItemName = saleData.ItemName
+	}
+
+	if h.Postgres != nil {
+		purchases, err := h.Postgres.CountPurchasesBySale(ctx, saleID)
+		if err != nil {
+			logger.Warn("sale scheduler | failed to count purchases for sale summary", "sale_id", saleID, "error", err)
+		}
+		expired, err := h.Postgres.CountExpiredAttemptsBySale(ctx, saleID)
+		if err != nil {
+			logger.Warn("sale scheduler | failed to count expired reservations for sale summary", "sale_id", saleID, "error", err)
+		}
+		summary.Purchases = purchases
+		summary.ExpiredReservations = expired
+		if counters.ItemsSold > 0 {
+			summary.ConversionRate = float64(purchases) / float64(counters.ItemsSold)
+		}
+	}
+
+	logger.Info("sale scheduler | sale summary", "summary", summary)
 }
 
-// generateSaleID generates a new sale ID
-func generateSaleID() int {
-	now := time.Now()
+// fitSaleItem truncates the item name and image URL to the columns of the sales
+// table, so an oversized catalog entry can't keep the sale from starting
+func fitSaleItem(ctx context.Context, itemName, imageURL string) (string, string) {
+	logger := myLogger.FromContext(ctx, "sale_scheduler")
+
+	if truncated, ok := truncateRunes(itemName, database.MaxItemNameLength); ok {
+		logger.Warn("sale scheduler | item name too long, truncated", "length", utf8.RuneCountInString(itemName), "max", database.MaxItemNameLength)
+		itemName = truncated
+	}
+	if truncated, ok := truncateRunes(imageURL, database.MaxImageURLLength); ok {
+		logger.Warn("sale scheduler | image URL too long, truncated", "length", utf8.RuneCountInString(imageURL), "max", database.MaxImageURLLength)
+		imageURL = truncated
+	}
+	return itemName, imageURL
+}
+
+// truncateRunes cuts s to limit characters, true if it was longer
+func truncateRunes(s string, limit int) (string, bool) {
+	if utf8.RuneCountInString(s) <= limit {
+		return s, false
+	}
+	return string([]rune(s)[:limit]), true
+}
+
+// schedulerBackoff returns the retry backoff of the sale scheduler, jittered by the
+// handler's seeded random source
+func (h *Handler) schedulerBackoff() utils.Backoff {
+	backoff := h.Config.GetSchedulerBackoff()
+	backoff.Rand = h.Rand
+	return backoff
+}
+
+// sleepContext sleeps for the duration unless the context is cancelled first.
+// Returns false if the context was cancelled.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// sleep sleeps on the handler clock for the duration unless the context is cancelled first.
+// Returns false if the context was cancelled.
+func (h *Handler) sleep(ctx context.Context, d time.Duration) bool {
+	timer := h.Clock.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C():
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// saleStock returns the stock of the item. The catalog stock of the item takes
+// precedence over the global initial stock.
+func (h *Handler) saleStock(itemName string) int {
+	if stock := h.Items.StockFor(itemName); stock > 0 {
+		return stock
+	}
+	return h.Config.GetInitialStock()
+}
+
+// checkoutTTL returns how long a checkout code of the sale reserves the item, in seconds.
+// The catalog TTL of the item takes precedence over the default one.
+func (h *Handler) checkoutTTL(saleID int) int {
+	if saleData, ok := h.saleCache.Load(saleID); ok {
+		if ttl := h.Items.CheckoutTTLFor(saleData.ItemName); ttl > 0 {
+			return ttl
+		}
+	}
+	return checkoutCodeTTL
+}
+
+// saleItemCap returns the max items sold of a sale started with the stock, which
+// never exceeds it. It's stored with the sale keys, stock added mid-sale raises it there.
+func (h *Handler) saleItemCap(stock int) int {
+	itemCap := h.Config.GetSaleItemCap()
+	if stock > 0 && stock < itemCap {
+		itemCap = stock
+	}
+	return itemCap
+}
+
+// isItemInSale reports whether the item ID can be checked out in the sale.
+// The valid item IDs are cached per sale to avoid a Redis call per checkout.
+func (h *Handler) isItemInSale(ctx context.Context, saleID int, itemID string) (bool, error) {
+	set, err := h.saleItemIDs(ctx, saleID)
+	if err != nil {
+		return false, err
+	}
+
+	if len(set) == 0 {
+		return true, nil
+	}
+	_, found := set[itemID]
+	return found, nil
+}
+
+// singleSaleItemID returns the item ID of a sale with exactly one valid item ID.
+// Returns false for sales with several item IDs or where any ID is valid.
+func (h *Handler) singleSaleItemID(ctx context.Context, saleID int) (string, bool, error) {
+	set, err := h.saleItemIDs(ctx, saleID)
+	if err != nil || len(set) != 1 {
+		return "", false, err
+	}
+	for itemID := range set {
+		return itemID, true, nil
+	}
+	return "", false, nil
+}
+
+// saleItemIDs returns the set of valid item IDs of the sale, empty if any ID is valid
+func (h *Handler) saleItemIDs(ctx context.Context, saleID int) (map[string]struct{}, error) {
+	if set, ok := h.itemIDsCache.Load(saleID); ok {
+		return set, nil
+	}
+
+	itemIDs, err := h.Redis.GetSaleItemIDs(ctx, saleID)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]struct{}, len(itemIDs))
+	for _, id := range itemIDs {
+		set[id] = struct{}{}
+	}
+	h.itemIDsCache.Store(saleID, set)
+	return set, nil
+}
+
+// generateSaleID generates the ID of a sale starting at now
+func generateSaleID(now time.Time) int {
 	return int(now.Year()*10000 + int(now.YearDay())*100 + now.Hour())
 }
 
-// restoreRedisSaleState restores the Redis state for a sale
-func (h *Handler) restoreRedisSaleState(ctx context.Context, saleID int) error {
+// restoreRedisSaleState resumes a sale whose Redis state is missing. Keys that still
+// exist keep their values, the missing ones are rebuilt from Postgres: the sale has
+// sold as many items as it has purchases out of its stock and the stock added to it,
+// reservations didn't survive the keys.
+func (h *Handler) restoreRedisSaleState(ctx context.Context, sale *database.SaleRecord) error {
 	logger := myLogger.FromContext(ctx, "sale_scheduler")
 
-	// Get sale data from Postgres
-	itemName, imageURL, err := h.Postgres.GetSaleByID(saleID)
+	// Get sale data and cache it
+	saleData, err := h.loadSaleData(ctx, sale.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get sale data: %v", err)
+	}
+	purchases, err := h.Postgres.CountPurchasesBySale(ctx, sale.ID)
 	if err != nil {
-		return fmt.Errorf("failed to get sale data from Postgres: %v", err)
+		return fmt.Errorf("failed to count purchases of sale: %v", err)
 	}
 
-	// Store in cache
-	h.saleCache.Store(saleID, SaleData{
+	// Stock added through the admin API raised the stock and the item cap alike
+	initialStock := int64(saleData.Stock + sale.AddedStock)
+	itemCap := int64(h.saleItemCap(saleData.Stock) + sale.AddedStock)
+
+	logger.Info("sale scheduler | restoring Redis state for sale", "sale_id", sale.ID, "initial_stock", initialStock, "added_stock", sale.AddedStock, "purchases", purchases)
+	if err := h.Redis.SetSaleItem(ctx, sale.ID, saleData.ItemName, saleData.ImageURL); err != nil {
+		return fmt.Errorf("failed to set sale item in Redis: %v", err)
+	}
+	if err := h.Redis.SetSaleItemIDs(ctx, sale.ID, h.Items.ItemIDsFor(saleData.ItemName)); err != nil {
+		return fmt.Errorf("failed to set sale item IDs in Redis: %v", err)
+	}
+	if _, err := h.Redis.RestoreSaleKeys(ctx, sale.ID, initialStock, int64(sale.AddedStock), itemCap, purchases, sale.StartedAt); err != nil {
+		return fmt.Errorf("failed to restore sale keys in Redis: %v", err)
+	}
+
+	// The pointer goes last, so checkouts only see the sale once its keys exist
+	if err := h.Redis.UpdateActiveSalePointer(ctx, sale.ID); err != nil {
+		return fmt.Errorf("failed to update Redis active sale pointer: %v", err)
+	}
+	h.Redis.InvalidateSaleCache()
+	return nil
+}
+
+// loadSaleData reads the sale from Redis, or from Postgres when Redis doesn't have
+// it, and stores it in the sale cache. The stock is the one the sale was started with.
+func (h *Handler) loadSaleData(ctx context.Context, saleID int) (SaleData, error) {
+	itemName, imageURL, err := h.Redis.GetSaleItem(ctx, saleID)
+	if err != nil && h.Postgres != nil {
+		itemName, imageURL, err = h.Postgres.GetSaleByID(ctx, saleID)
+	}
+	if err != nil {
+		return SaleData{}, err
+	}
+	saleData := SaleData{
 		ItemName: itemName,
 		ImageURL: imageURL,
-	})
+		Stock:    h.saleStock(itemName),
+	}
+	h.saleCache.Store(saleID, saleData)
+	return saleData, nil
+}
+
+// warmSaleCache loads the sale into the sale cache unless it's cached already.
+// Failures are only logged, the request paths load the sale on a cache miss.
+func (h *Handler) warmSaleCache(ctx context.Context, saleID int) {
+	logger := myLogger.FromContext(ctx, "sale_scheduler")
 
-	logger.Info("sale scheduler | restoring Redis state for sale", "sale_id", saleID)
-	return h.Redis.CreateNewSaleKeys(ctx, saleID)
+	if _, ok := h.saleCache.Load(saleID); ok {
+		return
+	}
+	if _, err := h.loadSaleData(ctx, saleID); err != nil {
+		logger.Warn("sale scheduler | failed to warm sale cache", "sale_id", saleID, "error", err)
+		return
+	}
+	logger.Info("sale scheduler | warmed sale cache", "sale_id", saleID)
+}
+
+// WarmActiveSaleCache loads the active sale into the sale cache, for instances
+// that serve the sale without running the scheduler
+func (h *Handler) WarmActiveSaleCache(ctx context.Context) {
+	saleID, err := h.Redis.GetActiveSaleID(ctx)
+	if err != nil || saleID == 0 {
+		return
+	}
+	h.warmSaleCache(ctx, saleID)
 }
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pcristin/golang_contest/internal/config"
+	"github.com/pcristin/golang_contest/internal/utils"
+)
+
+// newClockHandler returns a handler without clients running on the clock
+func newClockHandler(clock utils.Clock) *Handler {
+	h := NewHandler(config.NewConfig(), nil, nil, utils.NewItemGenerator(nil))
+	h.SetClock(clock)
+	return h
+}
+
+// startWaiting runs waitForSaleStart until saleStart and returns its result channel
+// once it waits on its timers
+func startWaiting(t *testing.T, ctx context.Context, h *Handler, clock *fakeClock, saleStart time.Time) <-chan bool {
+	t.Helper()
+	done := make(chan bool, 1)
+	go func() { done <- h.waitForSaleStart(ctx, saleStart) }()
+	// The sale start timer and the skew check
+	clock.waitArmed(t, 2)
+	return done
+}
+
+// waitResult returns the result of waitForSaleStart, failing if it keeps waiting
+func waitResult(t *testing.T, done <-chan bool) bool {
+	t.Helper()
+	select {
+	case started := <-done:
+		return started
+	case <-time.After(5 * time.Second):
+		t.Fatal("still waiting for the sale start")
+		return false
+	}
+}
+
+func TestWaitForSaleStartOnTime(t *testing.T) {
+	start := time.Date(2026, 1, 1, 11, 50, 0, 0, time.UTC)
+	clock := newFakeClock(start)
+	h := newClockHandler(clock)
+
+	done := startWaiting(t, context.Background(), h, clock, start.Add(10*time.Minute))
+	clock.Advance(10 * time.Minute)
+	if !waitResult(t, done) {
+		t.Error("got false, want the sale started")
+	}
+}
+
+func TestWaitForSaleStartClockJumpsForward(t *testing.T) {
+	start := time.Date(2026, 1, 1, 11, 50, 0, 0, time.UTC)
+	clock := newFakeClock(start)
+	h := newClockHandler(clock)
+
+	done := startWaiting(t, context.Background(), h, clock, start.Add(10*time.Minute))
+	// The wall clock passes the sale start, the timer still has 10 minutes to go
+	clock.Jump(15 * time.Minute)
+	clock.Advance(skewCheckInterval)
+	if !waitResult(t, done) {
+		t.Error("got false, want the sale started by the skew check")
+	}
+}
+
+func TestWaitForSaleStartClockJumpsBackward(t *testing.T) {
+	start := time.Date(2026, 1, 1, 11, 50, 0, 0, time.UTC)
+	clock := newFakeClock(start)
+	h := newClockHandler(clock)
+	saleStart := start.Add(10 * time.Minute)
+
+	done := startWaiting(t, context.Background(), h, clock, saleStart)
+	// The timer fires on time, but the wall clock is 5 minutes short of the sale start
+	clock.Jump(-5 * time.Minute)
+	clock.Advance(10 * time.Minute)
+	clock.waitArmed(t, 2)
+	select {
+	case <-done:
+		t.Fatalf("stopped waiting at %v, before the sale start at %v", clock.Now(), saleStart)
+	default:
+	}
+
+	clock.Advance(5 * time.Minute)
+	if !waitResult(t, done) {
+		t.Error("got false, want the sale started")
+	}
+}
+
+func TestWaitForSaleStartCancelled(t *testing.T) {
+	start := time.Date(2026, 1, 1, 11, 50, 0, 0, time.UTC)
+	clock := newFakeClock(start)
+	h := newClockHandler(clock)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := startWaiting(t, ctx, h, clock, start.Add(10*time.Minute))
+	cancel()
+	if waitResult(t, done) {
+		t.Error("got true, want false after the context was cancelled")
+	}
+}
+
+func TestNextSaleAfter(t *testing.T) {
+	h := newClockHandler(utils.RealClock{})
+	noon := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		now           time.Time
+		lastSaleStart time.Time
+		want          time.Time
+	}{
+		{"first sale", noon.Add(-10 * time.Minute), time.Time{}, noon},
+		{"right after a sale", noon.Add(time.Second), noon, noon.Add(time.Hour)},
+		{"clock jumped back before the last sale", noon.Add(-5 * time.Minute), noon, noon.Add(time.Hour)},
+		{"clock jumped back an hour", noon.Add(-time.Hour), noon, noon.Add(time.Hour)},
+		{"clock jumped past the next sale", noon.Add(90 * time.Minute), noon, noon.Add(2 * time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := h.nextSaleAfter(tt.now, tt.lastSaleStart); !got.Equal(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package api
+
+// ShutdownSummary is the final state of the background queues, logged once the
+// server stopped. Records still queued at exit were never written.
+type ShutdownSummary struct {
+	AttemptsFlushed  int64 // written by the final flush of the insert workers
+	PurchasesFlushed int64
+
+	AttemptsDropped         int64 // dropped on full queues since startup
+	PurchasesDropped        int64
+	PurchaseWebhooksDropped int64
+
+	AttemptsQueued         int // left in the queues
+	PurchasesQueued        int
+	PurchaseWebhooksQueued int
+}
+
+// ShutdownSummary returns the state of the background queues. It is safe to
+// call while workers are still running, e.g. after a shutdown timed out.
+func (h *Handler) ShutdownSummary() ShutdownSummary {
+	return ShutdownSummary{
+		AttemptsFlushed:  h.attemptsFlushed.Load(),
+		PurchasesFlushed: h.purchasesFlushed.Load(),
+
+		AttemptsDropped:         h.attemptDrops.total.Load(),
+		PurchasesDropped:        h.purchaseDrops.total.Load(),
+		PurchaseWebhooksDropped: h.purchaseWebhookDrops.total.Load(),
+
+		AttemptsQueued:         len(h.attemptsChan),
+		PurchasesQueued:        len(h.purchasesChan),
+		PurchaseWebhooksQueued: len(h.purchaseWebhooksChan),
+	}
+}
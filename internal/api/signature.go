@@ -0,0 +1,52 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+
+	myLogger "github.com/pcristin/golang_contest/internal/logger"
+	"github.com/pcristin/golang_contest/internal/utils"
+)
+
+// maxSignedBodySize bounds the body buffered for the signature check
+const maxSignedBodySize = 1 << 20 // 1MB
+
+// VerifySignature rejects requests whose body doesn't match the HMAC-SHA256
+// signature in the utils.SignatureHeader, for callbacks of external systems.
+// The body is buffered and handed to next unread. Without a secret all
+// requests are rejected, so an unconfigured callback is never open.
+func VerifySignature(next http.Handler, secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := myLogger.FromContext(r.Context(), "signature")
+
+		if secret == "" {
+			http.Error(w, "callbacks are disabled", http.StatusForbidden)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSignedBodySize))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+
+		if !utils.VerifyBodySignature(secret, body, r.Header.Get(utils.SignatureHeader)) {
+			logger.Warn("signature | invalid request signature", "method", r.Method, "path", r.URL.Path)
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		// Downstream handlers read the body as if it was never touched
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		next.ServeHTTP(w, r)
+	})
+}
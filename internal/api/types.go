@@ -1,10 +1,13 @@
 package api
 
 import (
-	"sync"
+	"context"
+	"sync/atomic"
+	"time"
 
 	"github.com/pcristin/golang_contest/internal/config"
 	"github.com/pcristin/golang_contest/internal/database"
+	"github.com/pcristin/golang_contest/internal/utils"
 )
 
 // Handler is the main handler for the API
@@ -15,29 +18,307 @@ type Handler struct {
 	Redis    *database.RedisClient
 	Postgres *database.PostgresClient
 
+	// Picks the item of each sale
+	Items *utils.ItemGenerator
+
+	// Non-security randomness, seeded from the config for reproducible runs
+	Rand *utils.Random
+
+	// Time of the sale schedule and the code TTLs, the wall clock unless replaced by SetClock
+	Clock utils.Clock
+
 	// Channels
 	attemptsChan  chan database.CheckoutAttempt
 	purchasesChan chan database.Purchase
 
+	// Set once the sale state was recovered at startup
+	ready atomic.Bool
+
+	// Identifies this instance as the holder of Redis locks
+	lockOwner string
+
+	// Set while the service is down for maintenance
+	maintenance atomic.Bool
+
+	// Attempt queue length at which checkouts are refused, 0 when disabled
+	attemptsHighWater int
+
+	// Limits concurrent purchases, nil when unlimited
+	purchaseSlots     chan struct{}
+	purchasesInFlight atomic.Int64
+
+	// Purchases moved to the archive table since startup
+	purchasesArchived atomic.Int64
+
+	// Time from checkout to purchase of completed purchases
+	reservationDurations *durationHistogram
+
+	// Purchases waiting for the purchase webhook, nil when it's disabled
+	purchaseWebhooksChan chan PurchaseEvent
+
+	// Records written by the final flush of the insert workers on shutdown
+	attemptsFlushed  atomic.Int64
+	purchasesFlushed atomic.Int64
+
+	// Records dropped because the channels were full
+	attemptDrops         dropCounter
+	purchaseDrops        dropCounter
+	purchaseWebhookDrops dropCounter
+
+	// Set while the Redis keys of old sales are being deleted
+	cleanupRunning atomic.Bool
+
+	// Last sale ended early because it reached its item cap
+	soldOutSaleID atomic.Int64
+
+	// Daily sale start times, nil when sales start every hour
+	saleSchedule atomic.Pointer[saleSchedule]
+
 	// Sale cached data
-	saleCache sync.Map // key: saleID, value: SaleData
+	saleCache    *saleCache[SaleData]
+	itemIDsCache *saleCache[map[string]struct{}] // empty if any item ID is valid
+
+	// Purchases served from the sale cache and those that fell through to Postgres
+	saleCacheHits   atomic.Int64
+	saleCacheMisses atomic.Int64
+
+	// Called after a new sale started, e.g. to pre-warm the item image on a CDN.
+	// Must not block, nil if not set.
+	OnSaleStarted func(ctx context.Context, event SaleStartedEvent)
+
+	// Runs the background tasks started by requests (e.g. ending a sold out sale) with
+	// the server context and tracks them, so the shutdown waits for them. The tasks run
+	// in a plain goroutine if not set.
+	Background func(name string, fn func(ctx context.Context))
 }
 
 // NewHandler creates a new Handler
-func NewHandler(config *config.Config, redis *database.RedisClient, postgres *database.PostgresClient) *Handler {
-	return &Handler{
+func NewHandler(config *config.Config, redis *database.RedisClient, postgres *database.PostgresClient, items *utils.ItemGenerator) *Handler {
+	handler := &Handler{
 		Config:   config,
 		Redis:    redis,
 		Postgres: postgres,
+		Items:    items,
+		Rand:     utils.NewRandom(config.GetRandomSeed()),
+		Clock:    utils.RealClock{},
+
+		lockOwner: utils.GenerateCode(),
 
 		attemptsChan:  make(chan database.CheckoutAttempt, 25000), // approx 2,5 Mb of size
 		purchasesChan: make(chan database.Purchase, 10000),        // approx 1 Mb of size
+
+		attemptDrops:  dropCounter{record: "attempts"},
+		purchaseDrops: dropCounter{record: "purchases"},
+
+		purchaseWebhookDrops: dropCounter{record: "purchase webhooks"},
+
+		saleCache:    newSaleCache[SaleData](config.GetSaleCacheSize()),
+		itemIDsCache: newSaleCache[map[string]struct{}](config.GetSaleCacheSize()),
+
+		// Spread around the 20 second checkout code TTL
+		reservationDurations: newDurationHistogram(
+			1*time.Second, 2*time.Second, 5*time.Second, 10*time.Second,
+			15*time.Second, 20*time.Second, 30*time.Second, 60*time.Second,
+		),
+	}
+
+	handler.maintenance.Store(config.GetMaintenanceMode())
+
+	now := time.Now().UnixNano()
+	handler.attemptDrops.lastReport.Store(now)
+	handler.purchaseDrops.lastReport.Store(now)
+	handler.purchaseWebhookDrops.lastReport.Store(now)
+
+	if highWater := config.GetAttemptQueueHighWater(); highWater > 0 {
+		handler.attemptsHighWater = max(cap(handler.attemptsChan)*highWater/100, 1)
+	}
+	if maxPurchases := config.GetMaxInFlightPurchases(); maxPurchases > 0 {
+		handler.purchaseSlots = make(chan struct{}, maxPurchases)
+	}
+	if config.GetPurchaseWebhookURL() != "" {
+		handler.purchaseWebhooksChan = make(chan PurchaseEvent, config.GetPurchaseWebhookQueueSize())
+	}
+	if url := config.GetSaleStartedWebhookURL(); url != "" {
+		handler.OnSaleStarted = saleStartedWebhook(url)
+	}
+	return handler
+}
+
+// SetClock replaces the clock of the handler and of its clients, so the times they store
+// and the times the handler compares them with come from the same clock.
+// Must be called before the handler is used.
+func (h *Handler) SetClock(clock utils.Clock) {
+	h.Clock = clock
+	if h.Redis != nil {
+		h.Redis.SetClock(clock)
+	}
+	if h.Postgres != nil {
+		h.Postgres.SetClock(clock)
 	}
 }
 
 // CheckoutResponse is the response for the checkout endpoint
 type CheckoutResponse struct {
-	Code string `json:"code"`
+	Code          string `json:"code"`
+	ItemName      string `json:"item_name,omitempty"`
+	ImageURL      string `json:"image_url,omitempty"`
+	SaleStartedAt string `json:"sale_started_at,omitempty"`
+	SaleEndsAt    string `json:"sale_ends_at,omitempty"`
+}
+
+// ExtendCheckoutResponse is the response for the checkout extension endpoint
+type ExtendCheckoutResponse struct {
+	Code             string `json:"code"`
+	ExpiresAt        string `json:"expires_at"`
+	RemainingSeconds int    `json:"remaining_seconds"`
+}
+
+// AddStockResponse is the response for the stock replenishment endpoint
+type AddStockResponse struct {
+	SaleID       int   `json:"sale_id"`
+	Added        int   `json:"added"`
+	Stock        int64 `json:"stock_remaining"`
+	InitialStock int64 `json:"initial_stock"`
+	ItemCap      int   `json:"item_cap"`
+}
+
+// ResetUserResponse is the response for the user checkout count reset endpoint
+type ResetUserResponse struct {
+	UserID        string `json:"user_id"`
+	PreviousCount int64  `json:"previous_count"`
+}
+
+// ClearReservationsResponse is the response for the reservations reset endpoint
+type ClearReservationsResponse struct {
+	SaleID  int   `json:"sale_id"`
+	Cleared int64 `json:"cleared"`
+}
+
+// SweepExpiredResponse is the response for the expired checkouts sweep endpoint
+type SweepExpiredResponse struct {
+	SaleID   int   `json:"sale_id"`
+	Expired  int   `json:"expired"`  // attempts marked expired, 0 without Postgres
+	Released int64 `json:"released"` // expired codes whose items went back to the sale
+}
+
+// MaintenanceResponse is the response for all requests during maintenance
+type MaintenanceResponse struct {
+	Error      string `json:"error"`
+	RetryAfter int    `json:"retry_after"` // seconds
+}
+
+// MaintenanceStatusResponse is the response for the maintenance mode endpoint
+type MaintenanceStatusResponse struct {
+	Enabled  bool `json:"enabled"`
+	Previous bool `json:"previous"`
+}
+
+// SaleStartedEvent is passed to the OnSaleStarted hook and sent by the sale started webhook
+type SaleStartedEvent struct {
+	SaleID    int    `json:"sale_id"`
+	ItemName  string `json:"item_name"`
+	ImageURL  string `json:"image_url"`
+	StartedAt string `json:"started_at"`
+}
+
+// SaleSummary is the report of a sale logged once it ended
+type SaleSummary struct {
+	SaleID              int     `json:"sale_id"`
+	ItemName            string  `json:"item_name"`
+	DurationSeconds     int64   `json:"duration_seconds"`
+	InitialStock        int64   `json:"initial_stock"`
+	ItemsSold           int64   `json:"items_sold"`
+	Purchases           int64   `json:"purchases"`            // 0 without Postgres
+	ExpiredReservations int64   `json:"expired_reservations"` // 0 without Postgres
+	ConversionRate      float64 `json:"conversion_rate"`      // purchases per item sold
+}
+
+// PurchaseEvent is sent by the purchase webhook for every completed purchase
+type PurchaseEvent struct {
+	UserID      string `json:"user_id"`
+	SaleID      int    `json:"sale_id"`
+	ItemID      string `json:"item_id"`
+	PurchasedAt string `json:"purchased_at"`
+}
+
+// ErrorResponse is the response for failed requests
+type ErrorResponse struct {
+	Error string `json:"error"`
+	Panic string `json:"panic,omitempty"` // only with debug errors enabled
+}
+
+// Reasons of NoSaleResponse
+const (
+	NoSaleReasonNotStarted = "sale_not_started" // no sale ran in the current slot yet
+	NoSaleReasonEnded      = "sale_ended"       // the sale of the current slot has ended
+)
+
+// NoSaleResponse is the checkout response while no sale is active
+type NoSaleResponse struct {
+	Error           string `json:"error"`
+	Reason          string `json:"reason"`
+	NextSaleAt      string `json:"next_sale_at"`
+	StartsInSeconds int    `json:"starts_in_seconds"`
+	EndedAt         string `json:"ended_at,omitempty"` // only when the sale has ended
+}
+
+// CheckoutCodeResponse is the response for the checkout code inspection endpoint
+type CheckoutCodeResponse struct {
+	Code       string `json:"code"`
+	UserID     string `json:"user_id"`
+	SaleID     string `json:"sale_id"`
+	ItemID     string `json:"item_id"`
+	CreatedAt  string `json:"created_at"`
+	TTLSeconds int    `json:"ttl_seconds"`
+	NoExpiry   bool   `json:"no_expiry,omitempty"` // the code was stored without a TTL
+}
+
+// PurchasedItemsResponse is the response for the purchased items endpoint
+type PurchasedItemsResponse struct {
+	UserID  string   `json:"user_id"`
+	SaleID  int      `json:"sale_id"`
+	ItemIDs []string `json:"item_ids"`
+}
+
+// UserAttemptsResponse is the response for the user checkout attempts endpoint
+type UserAttemptsResponse struct {
+	UserID   string        `json:"user_id"`
+	SaleID   int           `json:"sale_id"`
+	Limit    int           `json:"limit"`
+	Offset   int           `json:"offset"`
+	Attempts []AttemptInfo `json:"attempts"`
+}
+
+// AttemptInfo is a checkout attempt of the user attempts endpoint
+type AttemptInfo struct {
+	ID        int     `json:"id"`
+	ItemID    string  `json:"item_id"`
+	Code      *string `json:"code"` // null unless the checkout succeeded
+	Status    string  `json:"status"`
+	CreatedAt string  `json:"created_at"`
+}
+
+// SaleSearchResponse is the response for the sale search endpoint
+type SaleSearchResponse struct {
+	ItemName string           `json:"item_name"`
+	Sales    []SaleRecordInfo `json:"sales"`
+}
+
+// SaleRecordInfo is a sale of the sale search endpoint
+type SaleRecordInfo struct {
+	ID        int     `json:"id"`
+	ItemName  string  `json:"item_name"`
+	ImageURL  string  `json:"image_url"`
+	StartedAt string  `json:"started_at"`
+	EndedAt   *string `json:"ended_at"` // null while the sale is running
+}
+
+// AllowanceResponse is the response for the user allowance endpoint
+type AllowanceResponse struct {
+	UserID    string `json:"user_id"`
+	Count     int64  `json:"count"`
+	Limit     int    `json:"limit"`
+	Remaining int64  `json:"remaining"`
 }
 
 // PurchaseResponse is the response for the purchase endpoint
@@ -46,7 +327,7 @@ type PurchaseResponse struct {
 	ItemID   string `json:"item_id"`
 	ItemName string `json:"item_name"`
 	ImageURL string `json:"image_url"`
-	Metadata string `json:"metadata"`
+	Metadata string `json:"metadata,omitempty"`
 }
 
 // SaleData is the data for a sale consisting of item name and image URL for
@@ -54,12 +335,14 @@ type PurchaseResponse struct {
 type SaleData struct {
 	ItemName string
 	ImageURL string
+	Stock    int
 }
 
 // HealthStatus represents the system health and statistics
 type HealthStatus struct {
 	Status    string `json:"status"`
 	Timestamp string `json:"timestamp"`
+	Ready     bool   `json:"ready"` // false until the startup sale recovery is done
 
 	// Service Health
 	Services map[string]string `json:"services"`
@@ -67,8 +350,20 @@ type HealthStatus struct {
 	// Current Sale Info
 	Sale SaleInfo `json:"sale"`
 
+	// Active sale ID cached in memory
+	SaleCache SaleCacheInfo `json:"sale_cache"`
+
 	// Performance Stats
 	Performance PerformanceStats `json:"performance"`
+
+	// Warnings that don't degrade the service (e.g. sale counter drift)
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// ReadyStatus is the response of the readiness check
+type ReadyStatus struct {
+	Ready    bool              `json:"ready"`
+	Services map[string]string `json:"services"`
 }
 
 // SaleInfo contains current sale information
@@ -77,15 +372,55 @@ type SaleInfo struct {
 	ItemName string `json:"item_name,omitempty"`
 	ImageURL string `json:"image_url,omitempty"`
 	Stock    int64  `json:"stock_remaining"`
-	Sold     int64  `json:"items_sold"`
+	Sold     int64  `json:"items_sold,omitempty"`    // hidden with public stock rounding
+	Initial  int64  `json:"initial_stock,omitempty"` // hidden with public stock rounding
+	ItemCap  int    `json:"item_cap"`
 	Active   bool   `json:"is_active"`
+
+	// Checkout codes neither purchased nor expired yet. A plateau near the stock
+	// while purchases stall points at reservations that are never released.
+	Reservations int64 `json:"reservations,omitempty"` // hidden with public stock rounding
+}
+
+// SaleCacheInfo contains the state of the in-memory active sale ID cache
+// and of the sale data cache
+type SaleCacheInfo struct {
+	SaleID     int     `json:"sale_id"`
+	CachedAt   string  `json:"cached_at,omitempty"`
+	AgeSeconds float64 `json:"age_seconds"`
+
+	// Sale data cache, a high miss count means purchases load the sale from Postgres
+	Sales          int   `json:"sales"`
+	MaxSales       int   `json:"max_sales"`
+	PurchaseHits   int64 `json:"purchase_hits"`
+	PurchaseMisses int64 `json:"purchase_misses"`
+}
+
+// HistogramStats contains the cumulative bucket counts of a histogram
+type HistogramStats struct {
+	Buckets map[string]int64 `json:"buckets"`
+	Count   int64            `json:"count"`
+	SumMs   int64            `json:"sum_ms"`
 }
 
 // PerformanceStats contains performance metrics
 type PerformanceStats struct {
-	AttemptQueueSize  int `json:"attempt_queue_size"`
-	PurchaseQueueSize int `json:"purchase_queue_size"`
-	QueueCapacity     struct {
+	AttemptQueueSize  int   `json:"attempt_queue_size"`
+	PurchaseQueueSize int   `json:"purchase_queue_size"`
+	PurchasesArchived int64 `json:"purchases_archived"`
+	PurchasesInFlight int64 `json:"purchases_in_flight"`
+
+	// Set while checkouts are refused because the attempt queue is nearly full
+	AttemptBackpressure   bool `json:"attempt_backpressure"`
+	AttemptQueueHighWater int  `json:"attempt_queue_high_water"` // 0 is disabled
+
+	// Lua scripts running on Redis, at the cap they wait for a slot
+	RedisScriptsInFlight int64 `json:"redis_scripts_in_flight"`
+	RedisScriptsMax      int   `json:"redis_scripts_max"` // 0 is unlimited
+
+	// Time from checkout to purchase, cumulative buckets in seconds
+	ReservationDuration HistogramStats `json:"reservation_duration"`
+	QueueCapacity       struct {
 		Attempts  int `json:"attempts_max"`
 		Purchases int `json:"purchases_max"`
 	} `json:"queue_capacity"`
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	myLogger "github.com/pcristin/golang_contest/internal/logger"
+)
+
+// ProcessUserCountChecks periodically looks for users whose checkout count in Redis
+// exceeds their successful checkouts in Postgres, which happens when a failed
+// checkout couldn't roll the count back. Found users are only reported, they
+// can be fixed with POST /admin/reset-user.
+func (h *Handler) ProcessUserCountChecks(ctx context.Context) {
+	logger := myLogger.FromContext(ctx, "user_count_worker")
+
+	interval := h.Config.GetUserCountCheckInterval()
+	if interval == 0 {
+		logger.Info("user counts | user count checks disabled")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Attempts are inserted in the background, so a user is only reported
+	// once the count is off in two checks in a row
+	suspects := make(map[string]int64)
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("user counts | background worker stopped")
+			return
+		case <-ticker.C:
+			suspects = h.checkUserCounts(ctx, suspects)
+		}
+	}
+}
+
+// checkUserCounts compares the user counts of the active sale and returns the users whose count is too high
+func (h *Handler) checkUserCounts(ctx context.Context, suspects map[string]int64) map[string]int64 {
+	logger := myLogger.FromContext(ctx, "user_count_worker")
+
+	saleID, err := h.Redis.GetActiveSaleID(ctx)
+	if err != nil {
+		logger.Debug("user counts | no active sale", "error", err)
+		return nil
+	}
+
+	redisCounts, err := h.Redis.GetUserCheckoutCounts(ctx)
+	if err != nil {
+		logger.Error("user counts | failed to get user counts from Redis", "error", err)
+		return suspects
+	}
+	checkouts, err := h.Postgres.CountCheckoutsByUser(ctx, saleID)
+	if err != nil {
+		logger.Error("user counts | failed to count checkouts in Postgres", "sale_id", saleID, "error", err)
+		return suspects
+	}
+
+	found := make(map[string]int64)
+	for userID, count := range redisCounts {
+		excess := count - checkouts[userID]
+		if excess <= 0 {
+			continue
+		}
+		found[userID] = excess
+		if _, seen := suspects[userID]; seen {
+			logger.Warn("user counts | user checkout count exceeds successful checkouts",
+				"sale_id", saleID, "user_id", userID, "count", count, "checkouts", checkouts[userID], "excess", excess)
+		}
+	}
+	return found
+}
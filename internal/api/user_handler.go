@@ -0,0 +1,90 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	myLogger "github.com/pcristin/golang_contest/internal/logger"
+	"github.com/pcristin/golang_contest/internal/utils"
+)
+
+// Allowance returns how many more items the user can check out in the current sale
+func (h *Handler) Allowance(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), myLogger.RequestIDKey, utils.GenerateRequestID())
+	logger := myLogger.FromContext(ctx, "user")
+
+	userID := r.PathValue("user_id")
+	if userID == "" {
+		http.Error(w, "user_id is required", http.StatusBadRequest)
+		return
+	}
+
+	count, err := h.Redis.GetUserCheckoutCount(ctx, userID)
+	if err != nil {
+		logger.Error("allowance | failed to get user checkout count", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	limit := h.Config.GetUserCheckoutLimit()
+	remaining := int64(limit) - count
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	response := AllowanceResponse{
+		UserID:    userID,
+		Count:     count,
+		Limit:     limit,
+		Remaining: remaining,
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// PurchasedItems returns the item IDs the user purchased in a sale, the active one by default.
+// Purchases are inserted in the background, so the latest ones may show up with a short delay.
+func (h *Handler) PurchasedItems(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), myLogger.RequestIDKey, utils.GenerateRequestID())
+	logger := myLogger.FromContext(ctx, "user")
+
+	userID := r.PathValue("user_id")
+	if userID == "" {
+		http.Error(w, "user_id is required", http.StatusBadRequest)
+		return
+	}
+
+	var saleID int
+	if saleIDStr := r.URL.Query().Get("sale_id"); saleIDStr != "" {
+		var err error
+		saleID, err = strconv.Atoi(saleIDStr)
+		if err != nil || saleID <= 0 {
+			http.Error(w, "invalid sale ID", http.StatusBadRequest)
+			return
+		}
+	} else {
+		activeSaleID, err := h.Redis.GetActiveSaleID(ctx)
+		if err != nil {
+			logger.Error("purchased items | failed to get active sale ID", "error", err)
+			http.Error(w, "no sale is active", http.StatusBadRequest)
+			return
+		}
+		saleID = activeSaleID
+	}
+
+	itemIDs, err := h.Postgres.GetPurchasedItemIDs(ctx, userID, saleID)
+	if err != nil {
+		logger.Error("purchased items | failed to get purchased item IDs", "sale_id", saleID, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := PurchasedItemsResponse{
+		UserID:  userID,
+		SaleID:  saleID,
+		ItemIDs: itemIDs,
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Schema versions of the checkout and purchase responses. Clients pin one with the
+// Accept-Version header, new fields only ever go into a new version.
+const (
+	apiVersion1      = 1 // checkout returns the code only, purchase always has metadata
+	apiVersionLatest = 2 // checkout adds the sale metadata, purchase omits empty metadata
+)
+
+// requestedAPIVersion returns the response version pinned by the Accept-Version header,
+// "2" or "v2", the latest if none is sent. Returns false for unknown versions.
+func requestedAPIVersion(r *http.Request) (int, bool) {
+	header := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(r.Header.Get("Accept-Version"))), "v")
+	if header == "" {
+		return apiVersionLatest, true
+	}
+	version, err := strconv.Atoi(header)
+	if err != nil || version < apiVersion1 || version > apiVersionLatest {
+		return 0, false
+	}
+	return version, true
+}
+
+// rejectAPIVersion answers requests pinning an unknown response version
+func rejectAPIVersion(w http.ResponseWriter) {
+	w.Header().Set("X-API-Version", strconv.Itoa(apiVersionLatest))
+	writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "unsupported Accept-Version, the latest is " + strconv.Itoa(apiVersionLatest)})
+}
+
+// versionedResponse is a response that renders itself in an older schema version
+type versionedResponse interface {
+	forVersion(version int) any
+}
+
+// writeVersionedJSON writes the response in the version and names it in the X-API-Version header
+func writeVersionedJSON(w http.ResponseWriter, status int, version int, v versionedResponse) error {
+	w.Header().Set("X-API-Version", strconv.Itoa(version))
+	return writeJSON(w, status, v.forVersion(version))
+}
+
+// checkoutResponseV1 is CheckoutResponse before the sale metadata was added
+type checkoutResponseV1 struct {
+	Code string `json:"code"`
+}
+
+func (c CheckoutResponse) forVersion(version int) any {
+	if version == apiVersion1 {
+		return checkoutResponseV1{Code: c.Code}
+	}
+	return c
+}
+
+// purchaseResponseV1 is PurchaseResponse before empty metadata was omitted
+type purchaseResponseV1 struct {
+	Status   string `json:"status"`
+	ItemID   string `json:"item_id"`
+	ItemName string `json:"item_name"`
+	ImageURL string `json:"image_url"`
+	Metadata string `json:"metadata"`
+}
+
+func (p PurchaseResponse) forVersion(version int) any {
+	if version == apiVersion1 {
+		return purchaseResponseV1(p)
+	}
+	return p
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	myLogger "github.com/pcristin/golang_contest/internal/logger"
+	"github.com/pcristin/golang_contest/internal/utils"
+)
+
+// webhookTimeout bounds a single webhook call, integrations must not hold up the server
+const webhookTimeout = 5 * time.Second
+
+// webhookClient is shared by all outbound webhooks
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// purchaseWebhookBackoff spaces out the retries of a failed purchase webhook
+var purchaseWebhookBackoff = utils.Backoff{
+	Base:       1 * time.Second,
+	Multiplier: 2,
+	Max:        30 * time.Second,
+	Jitter:     0.2,
+}
+
+// postWebhook POSTs the payload as JSON to the URL. Any non-2xx response is an error.
+func postWebhook(ctx context.Context, url string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// saleStartedWebhook returns an OnSaleStarted hook posting the event to the URL.
+// The call runs in the background so a slow endpoint never delays the sale.
+func saleStartedWebhook(url string) func(context.Context, SaleStartedEvent) {
+	return func(ctx context.Context, event SaleStartedEvent) {
+		logger := myLogger.FromContext(ctx, "webhook")
+
+		// The scheduler context may be cancelled before the call is done
+		ctx = context.WithoutCancel(ctx)
+		go func() {
+			if err := postWebhook(ctx, url, event); err != nil {
+				logger.Error("webhook | failed to send sale started event", "sale_id", event.SaleID, "error", err)
+				return
+			}
+			logger.Info("webhook | sent sale started event", "sale_id", event.SaleID)
+		}()
+	}
+}
+
+// enqueuePurchaseWebhook queues the purchase for the webhook worker without
+// blocking. Events are dropped when the queue is full.
+func (h *Handler) enqueuePurchaseWebhook(logger *slog.Logger, event PurchaseEvent) {
+	if h.purchaseWebhooksChan == nil {
+		return
+	}
+	select {
+	case h.purchaseWebhooksChan <- event:
+	default:
+		h.purchaseWebhookDrops.add(logger)
+	}
+}
+
+// ProcessPurchaseWebhooks sends the queued purchase events to the purchase webhook.
+// Failed calls are retried with backoff and dropped after the max attempts.
+// Events still queued on shutdown are dropped.
+func (h *Handler) ProcessPurchaseWebhooks(ctx context.Context) {
+	logger := myLogger.FromContext(ctx, "webhook")
+	url := h.Config.GetPurchaseWebhookURL()
+	maxAttempts := h.Config.GetPurchaseWebhookMaxAttempts()
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if pending := len(h.purchaseWebhooksChan); pending > 0 {
+				logger.Warn("webhook | dropping unsent purchase events on shutdown", "count", pending)
+			}
+			logger.Info("webhook | purchase webhook worker stopped")
+			return
+		case event := <-h.purchaseWebhooksChan:
+			h.sendPurchaseWebhook(ctx, url, maxAttempts, event)
+		case <-ticker.C:
+			h.purchaseWebhookDrops.report(logger, h.Config.GetDropLogInterval())
+		}
+	}
+}
+
+// sendPurchaseWebhook posts one purchase event, retrying up to maxAttempts times
+func (h *Handler) sendPurchaseWebhook(ctx context.Context, url string, maxAttempts int, event PurchaseEvent) {
+	logger := myLogger.FromContext(ctx, "webhook")
+
+	backoff := purchaseWebhookBackoff
+	backoff.Rand = h.Rand
+	for attempt := 1; ; attempt++ {
+		err := postWebhook(ctx, url, event)
+		if err == nil {
+			logger.Debug("webhook | sent purchase event", "user_id", event.UserID, "sale_id", event.SaleID, "item_id", event.ItemID)
+			return
+		}
+		if attempt >= maxAttempts {
+			logger.Error("webhook | dropping purchase event after max attempts", "attempts", attempt,
+				"user_id", event.UserID, "sale_id", event.SaleID, "item_id", event.ItemID, "error", err)
+			return
+		}
+
+		delay := backoff.Delay(attempt)
+		logger.Warn("webhook | failed to send purchase event, retrying", "attempt", attempt, "retry_in", delay, "error", err)
+		if !sleepContext(ctx, delay) {
+			return
+		}
+	}
+}
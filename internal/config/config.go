@@ -1,8 +1,17 @@
 package config
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pcristin/golang_contest/internal/utils"
 )
 
 // NewConfig creates a new ConfigGetter
@@ -12,16 +21,110 @@ func NewConfig() *Config {
 		RedisURL:    "",
 		PostgresURL: "",
 		LogLevel:    "info",
+
+		UserCheckoutLimit:      10,
+		MaxReservationLifetime: 60,
+
+		MaintenanceRetryAfter: 60,
+
+		InitialStock: 10000,
+		SaleItemCap:  10000,
+
+		AttemptWorkers:  1,
+		PurchaseWorkers: 1,
+
+		RetentionBatchSize: 1000,
+		RetentionInterval:  10 * time.Minute,
+
+		DropLogInterval: 1 * time.Second,
+		RequestIDFormat: RequestIDFormatTimestamp,
+
+		SaleCacheSize: 24,
+
+		AttemptQueueHighWater: 90,
+
+		PurchaseWebhookQueueSize:   10000,
+		PurchaseWebhookMaxAttempts: 5,
+
+		CompressionMinSize: 512,
+		CompressionTypes:   "application/json",
+
+		HealthCriticalServices: "redis",
+		HealthCheckTimeout:     1 * time.Second,
+
+		SchedulerRetryBase:       1 * time.Second,
+		SchedulerRetryMultiplier: 2,
+		SchedulerRetryMax:        30 * time.Second,
+		SchedulerRetryJitter:     0.2,
+
+		RecoveryLockTTL: 60 * time.Second,
 	}
 }
 
-// ParseFlags parses the flags and sets the config
-func (c *Config) ParseFlags() {
+// ParseFlags parses the flags and sets the config.
+// Returns an error if the config file can't be read, the rest of the config is set anyway.
+func (c *Config) ParseFlags() error {
 	// Build-in flags
+	flag.StringVar(&c.Host, "host", "", "Host or IP address to bind (all interfaces if empty)")
 	flag.StringVar(&c.Port, "port", "8080", "Port to listen on")
+	flag.StringVar(&c.AdminPort, "admin-port", "", "Port of a separate admin listener (admin endpoints on the main port if empty)")
 	flag.StringVar(&c.RedisURL, "redis-url", "localhost:6379", "Redis URL")
+	flag.StringVar(&c.RedisKeyPrefix, "redis-key-prefix", "", "Prefix of all Redis keys, to share a Redis instance between environments")
+	flag.IntVar(&c.RedisMaxScripts, "redis-max-scripts", 0, "Max Lua scripts running at once on Redis (0 is unlimited)")
+	flag.IntVar(&c.RedisPoolWarmup, "redis-pool-warmup", 0, "Redis connections opened at startup before serving (0 disables)")
 	flag.StringVar(&c.PostgresURL, "postgres-url", "postgres://localhost:5432/flash_sale?sslmode=disable", "Postgres URL")
 	flag.StringVar(&c.LogLevel, "log-level", "info", "Log level")
+	flag.DurationVar(&c.PostgresStatementTimeout, "postgres-statement-timeout", 0, "Max duration of a single Postgres statement (0 disables)")
+	flag.IntVar(&c.AttemptWorkers, "attempt-workers", 1, "Number of goroutines batch-inserting checkout attempts")
+	flag.IntVar(&c.PurchaseWorkers, "purchase-workers", 1, "Number of goroutines batch-inserting purchases")
+	flag.BoolVar(&c.NoPostgres, "no-postgres", false, "TESTING ONLY: run without Postgres, checkout attempts and purchases are not stored")
+	flag.DurationVar(&c.AttemptsRetention, "attempts-retention", 0, "Delete resolved checkout attempts of ended sales older than this (0 disables)")
+	flag.DurationVar(&c.PurchasesArchival, "purchases-archival", 0, "Move purchases of ended sales older than this to the archive table (0 disables)")
+	flag.IntVar(&c.RetentionBatchSize, "retention-batch-size", 1000, "Rows deleted per retention batch")
+	flag.DurationVar(&c.RetentionInterval, "retention-interval", 10*time.Minute, "Time between retention runs")
+	flag.StringVar(&c.HealthCriticalServices, "health-critical-services", "redis", "Comma separated services (redis, postgres) that make /ready fail when down, others only degrade /health")
+	flag.DurationVar(&c.HealthCheckTimeout, "health-check-timeout", 1*time.Second, "Max time of each service check of /health and /ready, a slower service is reported as timed out (0 disables)")
+	flag.DurationVar(&c.UserCountCheckInterval, "user-count-check-interval", 0, "Time between checks for inflated user checkout counts (0 disables)")
+	flag.DurationVar(&c.DropLogInterval, "drop-log-interval", 1*time.Second, "Min time between aggregated logs of records dropped on full queues")
+	flag.StringVar(&c.RequestIDFormat, "request-id-format", RequestIDFormatTimestamp, "Format of the request IDs in the logs: timestamp or uuid")
+	flag.StringVar(&c.ConfigFile, "config-file", "", "Path to a KEY=VALUE file with environment overrides")
+	flag.StringVar(&c.CatalogFile, "catalog-file", "", "Path to a JSON catalog of sale items (placeholder items if empty)")
+	flag.StringVar(&c.AdminToken, "admin-token", "", "Token required by admin endpoints (disabled if empty)")
+	flag.StringVar(&c.CallbackSecret, "callback-secret", "", "HMAC-SHA256 secret signing callback request bodies (callbacks disabled if empty)")
+	flag.BoolVar(&c.DefaultItemID, "default-item-id", false, "Check out the item of single-item sales when the id parameter is omitted")
+	flag.IntVar(&c.UserCheckoutLimit, "user-checkout-limit", 10, "Max items a user can check out per sale")
+	flag.IntVar(&c.InitialStock, "initial-stock", 10000, "Stock of each sale")
+	flag.IntVar(&c.SaleItemCap, "sale-item-cap", 0, "Max items sold per sale (defaults to initial stock)")
+	flag.BoolVar(&c.SaleAutoEnd, "sale-auto-end", false, "End the sale as soon as it reaches its item cap instead of at the next sale start")
+	flag.BoolVar(&c.SaleEndPurge, "sale-end-purge", false, "Delete the Redis keys of a sale ended early and clear the active sale pointer once its codes expired")
+	flag.IntVar(&c.MaxReservationLifetime, "max-reservation-lifetime", 60, "Max total lifetime of a checkout code in seconds, including extensions")
+	flag.DurationVar(&c.UserCheckoutCooldown, "user-checkout-cooldown", 0, "Min time between successful checkouts of a user in a sale (0 disables)")
+	flag.BoolVar(&c.MaintenanceMode, "maintenance-mode", false, "Start in maintenance mode, answering all traffic but health checks with 503")
+	flag.IntVar(&c.MaintenanceRetryAfter, "maintenance-retry-after", 60, "Seconds clients are told to wait during maintenance")
+
+	flag.IntVar(&c.MaxInFlightPurchases, "max-inflight-purchases", 0, "Max concurrent purchase requests, more are answered with 503 (0 is unlimited)")
+	flag.IntVar(&c.AttemptQueueHighWater, "attempt-queue-high-water", 90, "Percent of the checkout attempt queue at which checkouts are answered with 503 (0 disables)")
+	flag.BoolVar(&c.PurchasePostgresFallback, "purchase-postgres-fallback", false, "Complete purchases from the checkout attempt when Redis lost the sale data")
+	flag.StringVar(&c.PurchaseWriteMode, "purchase-write-mode", PurchaseWriteModeAsync, "How purchases reach Postgres: async (batched in the background) or sync (written before the response)")
+	flag.IntVar(&c.StockDisplayStep, "stock-display-step", 0, "Round the public stock up to a multiple of this (0 shows the exact stock)")
+	flag.BoolVar(&c.CheckoutIncludeSale, "checkout-include-sale", false, "Include the item name and image in the checkout response")
+	flag.StringVar(&c.SaleStartedWebhookURL, "sale-started-webhook-url", "", "URL POSTed each new sale, e.g. to pre-warm the item image (disabled if empty)")
+	flag.StringVar(&c.PurchaseWebhookURL, "purchase-webhook-url", "", "URL POSTed every completed purchase (disabled if empty)")
+	flag.IntVar(&c.PurchaseWebhookQueueSize, "purchase-webhook-queue-size", 10000, "Max purchases waiting for the purchase webhook, more are dropped")
+	flag.IntVar(&c.PurchaseWebhookMaxAttempts, "purchase-webhook-max-attempts", 5, "Calls per purchase before the purchase webhook gives up")
+	flag.Int64Var(&c.RandomSeed, "random-seed", 0, "Seed of the non-security randomness like the purchase easter egg, for reproducible tests (random if 0)")
+	flag.BoolVar(&c.DebugErrors, "debug-errors", false, "Include panic messages in error responses (never enable in production)")
+	flag.IntVar(&c.SaleCacheSize, "sale-cache-size", 24, "Max sales kept in the in-memory sale caches")
+	flag.IntVar(&c.CompressionMinSize, "compression-min-size", 512, "Min response size in bytes to gzip")
+	flag.StringVar(&c.CompressionTypes, "compression-types", "application/json", "Comma separated content types to gzip (empty disables compression)")
+	flag.BoolVar(&c.DisableScheduler, "disable-scheduler", false, "Don't create or recover sales, only serve the sale created by another instance")
+	flag.StringVar(&c.SaleScheduleTimes, "sale-schedule-times", "", "Comma separated HH:MM daily sale start times (every hour if empty)")
+	flag.StringVar(&c.SaleTimezone, "sale-timezone", "", "IANA timezone of the sale schedule times (local if empty)")
+	flag.DurationVar(&c.RecoveryLockTTL, "recovery-lock-ttl", 60*time.Second, "Expiry of the lock one instance holds while recovering the sale at startup, refreshed while held, 0 lets every instance recover it")
+	flag.DurationVar(&c.SchedulerRetryBase, "scheduler-retry-base", 1*time.Second, "Delay before the first sale scheduler retry")
+	flag.Float64Var(&c.SchedulerRetryMultiplier, "scheduler-retry-multiplier", 2, "Growth factor of the sale scheduler retry delay")
+	flag.DurationVar(&c.SchedulerRetryMax, "scheduler-retry-max", 30*time.Second, "Max delay between sale scheduler retries")
+	flag.Float64Var(&c.SchedulerRetryJitter, "scheduler-retry-jitter", 0.2, "Random fraction (0..1) added to sale scheduler retry delays")
 
 	// Parse flags
 	flag.Parse()
@@ -29,15 +132,201 @@ func (c *Config) ParseFlags() {
 	// Environment variables (overrides build-in flags)
 	c.LoadEnvVars()
 
+	// Config file (overrides environment variables)
+	var err error
+	if c.ConfigFile != "" {
+		if err = loadEnvFile(c.ConfigFile); err != nil {
+			err = fmt.Errorf("failed to load config file %s: %v", c.ConfigFile, err)
+		} else {
+			c.LoadEnvVars()
+		}
+	}
+
+	// Sell the whole stock unless a cap is set
+	if c.SaleItemCap <= 0 || c.SaleItemCap > c.InitialStock {
+		c.SaleItemCap = c.InitialStock
+	}
+	return err
+}
+
+// Validate checks the settings that would break sales if out of range
+func (c *Config) Validate() error {
+	if c.InitialStock <= 0 || c.InitialStock > utils.MaxSaleStock {
+		return fmt.Errorf("initial stock %d must be between 1 and %d", c.InitialStock, utils.MaxSaleStock)
+	}
+	// Keys are matched with SCAN patterns, so the prefix must not contain glob characters
+	if strings.ContainsAny(c.RedisKeyPrefix, "*?[]\\ ") {
+		return fmt.Errorf("redis key prefix %q must not contain glob characters or spaces", c.RedisKeyPrefix)
+	}
+	if c.PurchaseWriteMode != PurchaseWriteModeAsync && c.PurchaseWriteMode != PurchaseWriteModeSync {
+		return fmt.Errorf("purchase write mode %q must be %q or %q", c.PurchaseWriteMode, PurchaseWriteModeAsync, PurchaseWriteModeSync)
+	}
+	if c.PurchaseWriteMode == PurchaseWriteModeSync && c.NoPostgres {
+		return fmt.Errorf("purchase write mode %q requires Postgres", PurchaseWriteModeSync)
+	}
+	if c.RequestIDFormat != RequestIDFormatTimestamp && c.RequestIDFormat != RequestIDFormatUUID {
+		return fmt.Errorf("request ID format %q must be %q or %q", c.RequestIDFormat, RequestIDFormatTimestamp, RequestIDFormatUUID)
+	}
+	for service := range c.GetHealthCriticalServices() {
+		if service != "redis" && service != "postgres" {
+			return fmt.Errorf("unknown critical health service %q, must be redis or postgres", service)
+		}
+	}
+	if err := validateWebhookURL(c.SaleStartedWebhookURL); err != nil {
+		return fmt.Errorf("sale started webhook: %v", err)
+	}
+	if err := validateWebhookURL(c.PurchaseWebhookURL); err != nil {
+		return fmt.Errorf("purchase webhook: %v", err)
+	}
+	return nil
+}
+
+// validateWebhookURL checks that a configured webhook URL is an absolute http(s) URL
+func validateWebhookURL(rawURL string) error {
+	if rawURL == "" {
+		return nil
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid URL %q", rawURL)
+	}
+	return nil
+}
+
+// Reload re-reads the config file and environment variables and applies the
+// settings that are safe to change at runtime. It returns the names of the
+// changed settings that require a restart and were ignored.
+func (c *Config) Reload() ([]string, error) {
+	next := NewConfig()
+
+	c.mu.RLock()
+	next.Host = c.Host
+	next.Port = c.Port
+	next.AdminPort = c.AdminPort
+	next.RedisURL = c.RedisURL
+	next.RedisKeyPrefix = c.RedisKeyPrefix
+	next.RedisMaxScripts = c.RedisMaxScripts
+	next.RedisPoolWarmup = c.RedisPoolWarmup
+	next.PostgresURL = c.PostgresURL
+	next.PostgresStatementTimeout = c.PostgresStatementTimeout
+	next.LogLevel = c.LogLevel
+	next.DropLogInterval = c.DropLogInterval
+	next.RequestIDFormat = c.RequestIDFormat
+	next.ConfigFile = c.ConfigFile
+	next.CatalogFile = c.CatalogFile
+	next.AdminToken = c.AdminToken
+	next.UserCheckoutLimit = c.UserCheckoutLimit
+	next.MaxReservationLifetime = c.MaxReservationLifetime
+	next.UserCheckoutCooldown = c.UserCheckoutCooldown
+	next.MaintenanceMode = c.MaintenanceMode
+	next.MaintenanceRetryAfter = c.MaintenanceRetryAfter
+	c.mu.RUnlock()
+
+	if next.ConfigFile != "" {
+		if err := loadEnvFile(next.ConfigFile); err != nil {
+			return nil, err
+		}
+	}
+	next.LoadEnvVars()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Settings bound at startup
+	var ignored []string
+	if next.Host != c.Host {
+		ignored = append(ignored, "HOST")
+	}
+	if next.Port != c.Port {
+		ignored = append(ignored, "PORT")
+	}
+	if next.AdminPort != c.AdminPort {
+		ignored = append(ignored, "ADMIN_PORT")
+	}
+	if next.RedisURL != c.RedisURL {
+		ignored = append(ignored, "REDIS_URL")
+	}
+	if next.RedisKeyPrefix != c.RedisKeyPrefix {
+		ignored = append(ignored, "REDIS_KEY_PREFIX")
+	}
+	if next.RedisMaxScripts != c.RedisMaxScripts {
+		ignored = append(ignored, "REDIS_MAX_SCRIPTS")
+	}
+	if next.RedisPoolWarmup != c.RedisPoolWarmup {
+		ignored = append(ignored, "REDIS_POOL_WARMUP")
+	}
+	if next.PostgresURL != c.PostgresURL {
+		ignored = append(ignored, "POSTGRES_URL")
+	}
+	if next.RequestIDFormat != c.RequestIDFormat {
+		ignored = append(ignored, "REQUEST_ID_FORMAT")
+	}
+	if next.MaintenanceMode != c.MaintenanceMode {
+		// Toggled at runtime via the admin endpoint instead
+		ignored = append(ignored, "MAINTENANCE_MODE")
+	}
+	if next.PostgresStatementTimeout != c.PostgresStatementTimeout {
+		ignored = append(ignored, "POSTGRES_STATEMENT_TIMEOUT")
+	}
+
+	// Settings safe to change live
+	c.LogLevel = next.LogLevel
+	c.DropLogInterval = next.DropLogInterval
+	c.AdminToken = next.AdminToken
+	c.UserCheckoutLimit = next.UserCheckoutLimit
+	c.MaxReservationLifetime = next.MaxReservationLifetime
+	c.UserCheckoutCooldown = next.UserCheckoutCooldown
+	c.MaintenanceRetryAfter = next.MaintenanceRetryAfter
+
+	return ignored, nil
+}
+
+// loadEnvFile reads KEY=VALUE lines from the file and sets them as environment variables
+func loadEnvFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// Skip empty lines and comments
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		if err := os.Setenv(strings.TrimSpace(key), strings.TrimSpace(value)); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
 }
 
 // LoadEnvVars loads the environment variables and sets the config
 func (c *Config) LoadEnvVars() {
+	// Host
+	if valueHost, foundHost := os.LookupEnv("HOST"); foundHost && valueHost != "" {
+		c.Host = valueHost
+	}
+
 	// Port
 	if valuePort, foundPort := os.LookupEnv("PORT"); foundPort && valuePort != "" {
 		c.Port = valuePort
 	}
 
+	// Admin port
+	if valueAdminPort, foundAdminPort := os.LookupEnv("ADMIN_PORT"); foundAdminPort && valueAdminPort != "" {
+		c.AdminPort = valueAdminPort
+	}
+
 	// Log level
 	if valueLogLevel, foundLogLevel := os.LookupEnv("LOG_LEVEL"); foundLogLevel && valueLogLevel != "" {
 		c.LogLevel = valueLogLevel
@@ -48,10 +337,335 @@ func (c *Config) LoadEnvVars() {
 		c.RedisURL = valueRedisURL
 	}
 
+	// Redis key prefix
+	if valueKeyPrefix, foundKeyPrefix := os.LookupEnv("REDIS_KEY_PREFIX"); foundKeyPrefix && valueKeyPrefix != "" {
+		c.RedisKeyPrefix = valueKeyPrefix
+	}
+
+	// Redis script cap
+	if valueMaxScripts, foundMaxScripts := os.LookupEnv("REDIS_MAX_SCRIPTS"); foundMaxScripts && valueMaxScripts != "" {
+		if maxScripts, err := strconv.Atoi(valueMaxScripts); err == nil && maxScripts >= 0 {
+			c.RedisMaxScripts = maxScripts
+		}
+	}
+
+	// Redis pool warmup
+	if valueWarmup, foundWarmup := os.LookupEnv("REDIS_POOL_WARMUP"); foundWarmup && valueWarmup != "" {
+		if warmup, err := strconv.Atoi(valueWarmup); err == nil && warmup >= 0 {
+			c.RedisPoolWarmup = warmup
+		}
+	}
+
 	// Postgres URL
 	if valuePostgresURL, foundPostgresURL := os.LookupEnv("POSTGRES_URL"); foundPostgresURL && valuePostgresURL != "" {
 		c.PostgresURL = valuePostgresURL
 	}
+
+	// Postgres statement timeout
+	if valueStatementTimeout, foundStatementTimeout := os.LookupEnv("POSTGRES_STATEMENT_TIMEOUT"); foundStatementTimeout && valueStatementTimeout != "" {
+		if statementTimeout, err := time.ParseDuration(valueStatementTimeout); err == nil && statementTimeout >= 0 {
+			c.PostgresStatementTimeout = statementTimeout
+		}
+	}
+
+	// Retention
+	if valueAttemptsRetention, foundAttemptsRetention := os.LookupEnv("ATTEMPTS_RETENTION"); foundAttemptsRetention && valueAttemptsRetention != "" {
+		if attemptsRetention, err := time.ParseDuration(valueAttemptsRetention); err == nil && attemptsRetention >= 0 {
+			c.AttemptsRetention = attemptsRetention
+		}
+	}
+	if valuePurchasesArchival, foundPurchasesArchival := os.LookupEnv("PURCHASES_ARCHIVAL"); foundPurchasesArchival && valuePurchasesArchival != "" {
+		if purchasesArchival, err := time.ParseDuration(valuePurchasesArchival); err == nil && purchasesArchival >= 0 {
+			c.PurchasesArchival = purchasesArchival
+		}
+	}
+	if valueBatchSize, foundBatchSize := os.LookupEnv("RETENTION_BATCH_SIZE"); foundBatchSize && valueBatchSize != "" {
+		if batchSize, err := strconv.Atoi(valueBatchSize); err == nil && batchSize > 0 {
+			c.RetentionBatchSize = batchSize
+		}
+	}
+	if valueRetentionInterval, foundRetentionInterval := os.LookupEnv("RETENTION_INTERVAL"); foundRetentionInterval && valueRetentionInterval != "" {
+		if retentionInterval, err := time.ParseDuration(valueRetentionInterval); err == nil && retentionInterval > 0 {
+			c.RetentionInterval = retentionInterval
+		}
+	}
+
+	// Drop log interval
+	if valueDropLogInterval, foundDropLogInterval := os.LookupEnv("DROP_LOG_INTERVAL"); foundDropLogInterval && valueDropLogInterval != "" {
+		if dropLogInterval, err := time.ParseDuration(valueDropLogInterval); err == nil && dropLogInterval > 0 {
+			c.DropLogInterval = dropLogInterval
+		}
+	}
+
+	// Request ID format
+	if valueIDFormat, foundIDFormat := os.LookupEnv("REQUEST_ID_FORMAT"); foundIDFormat && valueIDFormat != "" {
+		c.RequestIDFormat = strings.ToLower(valueIDFormat)
+	}
+
+	// Config file
+	if valueConfigFile, foundConfigFile := os.LookupEnv("CONFIG_FILE"); foundConfigFile && valueConfigFile != "" {
+		c.ConfigFile = valueConfigFile
+	}
+
+	// Catalog file
+	if valueCatalogFile, foundCatalogFile := os.LookupEnv("CATALOG_FILE"); foundCatalogFile && valueCatalogFile != "" {
+		c.CatalogFile = valueCatalogFile
+	}
+
+	// Admin token
+	if valueAdminToken, foundAdminToken := os.LookupEnv("ADMIN_TOKEN"); foundAdminToken && valueAdminToken != "" {
+		c.AdminToken = valueAdminToken
+	}
+
+	// Callback secret
+	if valueCallbackSecret, foundCallbackSecret := os.LookupEnv("CALLBACK_SECRET"); foundCallbackSecret && valueCallbackSecret != "" {
+		c.CallbackSecret = valueCallbackSecret
+	}
+
+	// User checkout limit
+	if valueUserLimit, foundUserLimit := os.LookupEnv("USER_CHECKOUT_LIMIT"); foundUserLimit && valueUserLimit != "" {
+		if userLimit, err := strconv.Atoi(valueUserLimit); err == nil && userLimit > 0 {
+			c.UserCheckoutLimit = userLimit
+		}
+	}
+
+	// Initial stock
+	if valueInitialStock, foundInitialStock := os.LookupEnv("INITIAL_STOCK"); foundInitialStock && valueInitialStock != "" {
+		// Out of range values are rejected by Validate
+		if initialStock, err := strconv.Atoi(valueInitialStock); err == nil {
+			c.InitialStock = initialStock
+		}
+	}
+
+	// Sale item cap
+	if valueItemCap, foundItemCap := os.LookupEnv("SALE_ITEM_CAP"); foundItemCap && valueItemCap != "" {
+		if itemCap, err := strconv.Atoi(valueItemCap); err == nil && itemCap > 0 {
+			c.SaleItemCap = itemCap
+		}
+	}
+
+	// User checkout cooldown
+	if valueCooldown, foundCooldown := os.LookupEnv("USER_CHECKOUT_COOLDOWN"); foundCooldown && valueCooldown != "" {
+		if cooldown, err := time.ParseDuration(valueCooldown); err == nil && cooldown >= 0 {
+			c.UserCheckoutCooldown = cooldown
+		}
+	}
+
+	// Maintenance mode
+	if valueMaintenance, foundMaintenance := os.LookupEnv("MAINTENANCE_MODE"); foundMaintenance && valueMaintenance != "" {
+		if maintenance, err := strconv.ParseBool(valueMaintenance); err == nil {
+			c.MaintenanceMode = maintenance
+		}
+	}
+
+	// Maintenance retry after
+	if valueRetryAfter, foundRetryAfter := os.LookupEnv("MAINTENANCE_RETRY_AFTER"); foundRetryAfter && valueRetryAfter != "" {
+		if retryAfter, err := strconv.Atoi(valueRetryAfter); err == nil && retryAfter > 0 {
+			c.MaintenanceRetryAfter = retryAfter
+		}
+	}
+
+	// Sale auto end
+	if valueAutoEnd, foundAutoEnd := os.LookupEnv("SALE_AUTO_END"); foundAutoEnd && valueAutoEnd != "" {
+		if autoEnd, err := strconv.ParseBool(valueAutoEnd); err == nil {
+			c.SaleAutoEnd = autoEnd
+		}
+	}
+	if valueEndPurge, foundEndPurge := os.LookupEnv("SALE_END_PURGE"); foundEndPurge && valueEndPurge != "" {
+		if endPurge, err := strconv.ParseBool(valueEndPurge); err == nil {
+			c.SaleEndPurge = endPurge
+		}
+	}
+
+	// Checkout response sale metadata
+	if valueIncludeSale, foundIncludeSale := os.LookupEnv("CHECKOUT_INCLUDE_SALE"); foundIncludeSale && valueIncludeSale != "" {
+		if includeSale, err := strconv.ParseBool(valueIncludeSale); err == nil {
+			c.CheckoutIncludeSale = includeSale
+		}
+	}
+
+	// Sale started webhook
+	if valueSaleWebhook, foundSaleWebhook := os.LookupEnv("SALE_STARTED_WEBHOOK_URL"); foundSaleWebhook && valueSaleWebhook != "" {
+		c.SaleStartedWebhookURL = valueSaleWebhook
+	}
+
+	// Purchase webhook
+	if valuePurchaseWebhook, foundPurchaseWebhook := os.LookupEnv("PURCHASE_WEBHOOK_URL"); foundPurchaseWebhook && valuePurchaseWebhook != "" {
+		c.PurchaseWebhookURL = valuePurchaseWebhook
+	}
+	if valueWebhookQueue, foundWebhookQueue := os.LookupEnv("PURCHASE_WEBHOOK_QUEUE_SIZE"); foundWebhookQueue && valueWebhookQueue != "" {
+		if webhookQueue, err := strconv.Atoi(valueWebhookQueue); err == nil && webhookQueue > 0 {
+			c.PurchaseWebhookQueueSize = webhookQueue
+		}
+	}
+	if valueWebhookAttempts, foundWebhookAttempts := os.LookupEnv("PURCHASE_WEBHOOK_MAX_ATTEMPTS"); foundWebhookAttempts && valueWebhookAttempts != "" {
+		if webhookAttempts, err := strconv.Atoi(valueWebhookAttempts); err == nil && webhookAttempts > 0 {
+			c.PurchaseWebhookMaxAttempts = webhookAttempts
+		}
+	}
+
+	// Default item ID
+	if valueDefaultItem, foundDefaultItem := os.LookupEnv("DEFAULT_ITEM_ID"); foundDefaultItem && valueDefaultItem != "" {
+		if defaultItem, err := strconv.ParseBool(valueDefaultItem); err == nil {
+			c.DefaultItemID = defaultItem
+		}
+	}
+
+	// Public stock rounding
+	if valueStockStep, foundStockStep := os.LookupEnv("STOCK_DISPLAY_STEP"); foundStockStep && valueStockStep != "" {
+		if stockStep, err := strconv.Atoi(valueStockStep); err == nil && stockStep >= 0 {
+			c.StockDisplayStep = stockStep
+		}
+	}
+
+	// Testing without Postgres
+	if valueNoPostgres, foundNoPostgres := os.LookupEnv("NO_POSTGRES"); foundNoPostgres && valueNoPostgres != "" {
+		if noPostgres, err := strconv.ParseBool(valueNoPostgres); err == nil {
+			c.NoPostgres = noPostgres
+		}
+	}
+
+	// Background workers
+	if valueAttemptWorkers, foundAttemptWorkers := os.LookupEnv("ATTEMPT_WORKERS"); foundAttemptWorkers && valueAttemptWorkers != "" {
+		if attemptWorkers, err := strconv.Atoi(valueAttemptWorkers); err == nil && attemptWorkers > 0 {
+			c.AttemptWorkers = attemptWorkers
+		}
+	}
+	if valuePurchaseWorkers, foundPurchaseWorkers := os.LookupEnv("PURCHASE_WORKERS"); foundPurchaseWorkers && valuePurchaseWorkers != "" {
+		if purchaseWorkers, err := strconv.Atoi(valuePurchaseWorkers); err == nil && purchaseWorkers > 0 {
+			c.PurchaseWorkers = purchaseWorkers
+		}
+	}
+
+	// User count checks
+	if valueCheckInterval, foundCheckInterval := os.LookupEnv("USER_COUNT_CHECK_INTERVAL"); foundCheckInterval && valueCheckInterval != "" {
+		if checkInterval, err := time.ParseDuration(valueCheckInterval); err == nil && checkInterval >= 0 {
+			c.UserCountCheckInterval = checkInterval
+		}
+	}
+
+	// Purchase admission
+	if valueMaxPurchases, foundMaxPurchases := os.LookupEnv("MAX_INFLIGHT_PURCHASES"); foundMaxPurchases && valueMaxPurchases != "" {
+		if maxPurchases, err := strconv.Atoi(valueMaxPurchases); err == nil && maxPurchases >= 0 {
+			c.MaxInFlightPurchases = maxPurchases
+		}
+	}
+
+	// Attempt queue high water mark
+	if valueHighWater, foundHighWater := os.LookupEnv("ATTEMPT_QUEUE_HIGH_WATER"); foundHighWater && valueHighWater != "" {
+		if highWater, err := strconv.Atoi(valueHighWater); err == nil && highWater >= 0 && highWater <= 100 {
+			c.AttemptQueueHighWater = highWater
+		}
+	}
+
+	// Purchase fallback
+	if valueFallback, foundFallback := os.LookupEnv("PURCHASE_POSTGRES_FALLBACK"); foundFallback && valueFallback != "" {
+		if fallback, err := strconv.ParseBool(valueFallback); err == nil {
+			c.PurchasePostgresFallback = fallback
+		}
+	}
+
+	// Purchase write mode
+	if valueWriteMode, foundWriteMode := os.LookupEnv("PURCHASE_WRITE_MODE"); foundWriteMode && valueWriteMode != "" {
+		c.PurchaseWriteMode = strings.ToLower(valueWriteMode)
+	}
+
+	// Random seed
+	if valueSeed, foundSeed := os.LookupEnv("RANDOM_SEED"); foundSeed && valueSeed != "" {
+		if seed, err := strconv.ParseInt(valueSeed, 10, 64); err == nil {
+			c.RandomSeed = seed
+		}
+	}
+
+	// Debug errors
+	if valueDebugErrors, foundDebugErrors := os.LookupEnv("DEBUG_ERRORS"); foundDebugErrors && valueDebugErrors != "" {
+		if debugErrors, err := strconv.ParseBool(valueDebugErrors); err == nil {
+			c.DebugErrors = debugErrors
+		}
+	}
+
+	// Sale caches
+	if valueCacheSize, foundCacheSize := os.LookupEnv("SALE_CACHE_SIZE"); foundCacheSize && valueCacheSize != "" {
+		if cacheSize, err := strconv.Atoi(valueCacheSize); err == nil && cacheSize > 0 {
+			c.SaleCacheSize = cacheSize
+		}
+	}
+
+	// Response compression
+	if valueMinSize, foundMinSize := os.LookupEnv("COMPRESSION_MIN_SIZE"); foundMinSize && valueMinSize != "" {
+		if minSize, err := strconv.Atoi(valueMinSize); err == nil && minSize >= 0 {
+			c.CompressionMinSize = minSize
+		}
+	}
+	if valueTypes, foundTypes := os.LookupEnv("COMPRESSION_TYPES"); foundTypes {
+		c.CompressionTypes = valueTypes
+	}
+
+	// Health
+	if valueCritical, foundCritical := os.LookupEnv("HEALTH_CRITICAL_SERVICES"); foundCritical {
+		c.HealthCriticalServices = valueCritical
+	}
+	if valueCheckTimeout, foundCheckTimeout := os.LookupEnv("HEALTH_CHECK_TIMEOUT"); foundCheckTimeout && valueCheckTimeout != "" {
+		if checkTimeout, err := time.ParseDuration(valueCheckTimeout); err == nil && checkTimeout >= 0 {
+			c.HealthCheckTimeout = checkTimeout
+		}
+	}
+
+	// Sale scheduler
+	if valueDisableScheduler, foundDisableScheduler := os.LookupEnv("DISABLE_SCHEDULER"); foundDisableScheduler && valueDisableScheduler != "" {
+		if disableScheduler, err := strconv.ParseBool(valueDisableScheduler); err == nil {
+			c.DisableScheduler = disableScheduler
+		}
+	}
+
+	// Sale schedule
+	if valueScheduleTimes, foundScheduleTimes := os.LookupEnv("SALE_SCHEDULE_TIMES"); foundScheduleTimes && valueScheduleTimes != "" {
+		c.SaleScheduleTimes = valueScheduleTimes
+	}
+	if valueTimezone, foundTimezone := os.LookupEnv("SALE_TIMEZONE"); foundTimezone && valueTimezone != "" {
+		c.SaleTimezone = valueTimezone
+	}
+
+	// Sale recovery lock
+	if valueRecoveryLockTTL, foundRecoveryLockTTL := os.LookupEnv("RECOVERY_LOCK_TTL"); foundRecoveryLockTTL && valueRecoveryLockTTL != "" {
+		if recoveryLockTTL, err := time.ParseDuration(valueRecoveryLockTTL); err == nil && recoveryLockTTL >= 0 {
+			c.RecoveryLockTTL = recoveryLockTTL
+		}
+	}
+
+	// Sale scheduler retries
+	if valueRetryBase, foundRetryBase := os.LookupEnv("SCHEDULER_RETRY_BASE"); foundRetryBase && valueRetryBase != "" {
+		if retryBase, err := time.ParseDuration(valueRetryBase); err == nil && retryBase > 0 {
+			c.SchedulerRetryBase = retryBase
+		}
+	}
+	if valueRetryMultiplier, foundRetryMultiplier := os.LookupEnv("SCHEDULER_RETRY_MULTIPLIER"); foundRetryMultiplier && valueRetryMultiplier != "" {
+		if retryMultiplier, err := strconv.ParseFloat(valueRetryMultiplier, 64); err == nil && retryMultiplier >= 1 {
+			c.SchedulerRetryMultiplier = retryMultiplier
+		}
+	}
+	if valueRetryMax, foundRetryMax := os.LookupEnv("SCHEDULER_RETRY_MAX"); foundRetryMax && valueRetryMax != "" {
+		if retryMax, err := time.ParseDuration(valueRetryMax); err == nil && retryMax > 0 {
+			c.SchedulerRetryMax = retryMax
+		}
+	}
+	if valueRetryJitter, foundRetryJitter := os.LookupEnv("SCHEDULER_RETRY_JITTER"); foundRetryJitter && valueRetryJitter != "" {
+		if retryJitter, err := strconv.ParseFloat(valueRetryJitter, 64); err == nil && retryJitter >= 0 && retryJitter <= 1 {
+			c.SchedulerRetryJitter = retryJitter
+		}
+	}
+
+	// Max reservation lifetime
+	if valueMaxLifetime, foundMaxLifetime := os.LookupEnv("MAX_RESERVATION_LIFETIME"); foundMaxLifetime && valueMaxLifetime != "" {
+		if maxLifetime, err := strconv.Atoi(valueMaxLifetime); err == nil && maxLifetime > 0 {
+			c.MaxReservationLifetime = maxLifetime
+		}
+	}
+}
+
+// GetHost returns the current configuration
+func (c *Config) GetHost() string {
+	return c.Host
 }
 
 // GetPort returns the current configuration
@@ -59,17 +673,329 @@ func (c *Config) GetPort() string {
 	return c.Port
 }
 
+// GetAdminPort returns the current configuration
+func (c *Config) GetAdminPort() string {
+	return c.AdminPort
+}
+
+// GetListenAddr returns the host:port address to bind, or an error if the
+// host or port is invalid
+func (c *Config) GetListenAddr() (string, error) {
+	return listenAddr(c.Host, c.Port)
+}
+
+// GetAdminListenAddr returns the host:port address of the admin listener, or
+// an error if the host or admin port is invalid or the same as the main port
+func (c *Config) GetAdminListenAddr() (string, error) {
+	if c.AdminPort == c.Port {
+		return "", fmt.Errorf("admin port %q is the same as the main port", c.AdminPort)
+	}
+	return listenAddr(c.Host, c.AdminPort)
+}
+
+// listenAddr validates the host and port and joins them into an address
+func listenAddr(host, port string) (string, error) {
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber < 1 || portNumber > 65535 {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+
+	// IPv6 addresses may be given with or without brackets
+	bareHost := strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if bareHost != "" && net.ParseIP(bareHost) == nil && strings.ContainsAny(bareHost, ":/ ") {
+		return "", fmt.Errorf("invalid host %q", host)
+	}
+
+	return net.JoinHostPort(bareHost, port), nil
+}
+
 // GetRedisURL returns the current configuration
 func (c *Config) GetRedisURL() string {
 	return c.RedisURL
 }
 
+// GetRedisKeyPrefix returns the current configuration
+func (c *Config) GetRedisKeyPrefix() string {
+	return c.RedisKeyPrefix
+}
+
+// GetRedisMaxScripts returns the current configuration
+func (c *Config) GetRedisMaxScripts() int {
+	return c.RedisMaxScripts
+}
+
+// GetRedisPoolWarmup returns the current configuration
+func (c *Config) GetRedisPoolWarmup() int {
+	return c.RedisPoolWarmup
+}
+
 // GetPostgresURL returns the current configuration
 func (c *Config) GetPostgresURL() string {
 	return c.PostgresURL
 }
 
+// GetPostgresStatementTimeout returns the current configuration
+func (c *Config) GetPostgresStatementTimeout() time.Duration {
+	return c.PostgresStatementTimeout
+}
+
 // GetLogLevel returns the current configuration
 func (c *Config) GetLogLevel() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.LogLevel
 }
+
+// GetCatalogFile returns the current configuration
+func (c *Config) GetCatalogFile() string {
+	return c.CatalogFile
+}
+
+// GetInitialStock returns the current configuration
+func (c *Config) GetInitialStock() int {
+	return c.InitialStock
+}
+
+// GetSaleItemCap returns the current configuration
+func (c *Config) GetSaleItemCap() int {
+	return c.SaleItemCap
+}
+
+// GetSaleAutoEnd returns the current configuration
+func (c *Config) GetSaleAutoEnd() bool {
+	return c.SaleAutoEnd
+}
+
+// GetSaleEndPurge returns the current configuration
+func (c *Config) GetSaleEndPurge() bool {
+	return c.SaleEndPurge
+}
+
+// GetUserCountCheckInterval returns the current configuration
+func (c *Config) GetUserCountCheckInterval() time.Duration {
+	return c.UserCountCheckInterval
+}
+
+// GetAttemptQueueHighWater returns the current configuration
+func (c *Config) GetAttemptQueueHighWater() int {
+	return c.AttemptQueueHighWater
+}
+
+// GetMaxInFlightPurchases returns the current configuration
+func (c *Config) GetMaxInFlightPurchases() int {
+	return c.MaxInFlightPurchases
+}
+
+// GetPurchasePostgresFallback returns the current configuration
+func (c *Config) GetPurchasePostgresFallback() bool {
+	return c.PurchasePostgresFallback
+}
+
+// GetUUIDRequestIDs reports whether request IDs are UUIDs
+func (c *Config) GetUUIDRequestIDs() bool {
+	return c.RequestIDFormat == RequestIDFormatUUID
+}
+
+// GetPurchaseWriteMode returns the current configuration
+func (c *Config) GetPurchaseWriteMode() string {
+	return c.PurchaseWriteMode
+}
+
+// GetRandomSeed returns the current configuration
+func (c *Config) GetRandomSeed() int64 {
+	return c.RandomSeed
+}
+
+// GetDebugErrors returns the current configuration
+func (c *Config) GetDebugErrors() bool {
+	return c.DebugErrors
+}
+
+// GetSaleCacheSize returns the current configuration
+func (c *Config) GetSaleCacheSize() int {
+	return c.SaleCacheSize
+}
+
+// GetCompressionMinSize returns the current configuration
+func (c *Config) GetCompressionMinSize() int {
+	return c.CompressionMinSize
+}
+
+// GetCompressionTypes returns the content types to compress
+func (c *Config) GetCompressionTypes() []string {
+	var types []string
+	for _, contentType := range strings.Split(c.CompressionTypes, ",") {
+		if contentType = strings.ToLower(strings.TrimSpace(contentType)); contentType != "" {
+			types = append(types, contentType)
+		}
+	}
+	return types
+}
+
+// GetHealthCriticalServices returns the services that make the instance unready when down
+func (c *Config) GetHealthCriticalServices() map[string]bool {
+	services := make(map[string]bool)
+	for _, service := range strings.Split(c.HealthCriticalServices, ",") {
+		if service = strings.ToLower(strings.TrimSpace(service)); service != "" {
+			services[service] = true
+		}
+	}
+	return services
+}
+
+// GetHealthCheckTimeout returns the current configuration
+func (c *Config) GetHealthCheckTimeout() time.Duration {
+	return c.HealthCheckTimeout
+}
+
+// GetSaleStartedWebhookURL returns the current configuration
+func (c *Config) GetSaleStartedWebhookURL() string {
+	return c.SaleStartedWebhookURL
+}
+
+// GetPurchaseWebhookURL returns the current configuration
+func (c *Config) GetPurchaseWebhookURL() string {
+	return c.PurchaseWebhookURL
+}
+
+// GetPurchaseWebhookQueueSize returns the current configuration
+func (c *Config) GetPurchaseWebhookQueueSize() int {
+	return max(c.PurchaseWebhookQueueSize, 1)
+}
+
+// GetPurchaseWebhookMaxAttempts returns the current configuration
+func (c *Config) GetPurchaseWebhookMaxAttempts() int {
+	return max(c.PurchaseWebhookMaxAttempts, 1)
+}
+
+// GetDefaultItemID returns the current configuration
+func (c *Config) GetDefaultItemID() bool {
+	return c.DefaultItemID
+}
+
+// GetStockDisplayStep returns the current configuration
+func (c *Config) GetStockDisplayStep() int {
+	return c.StockDisplayStep
+}
+
+// GetCheckoutIncludeSale returns the current configuration
+func (c *Config) GetCheckoutIncludeSale() bool {
+	return c.CheckoutIncludeSale
+}
+
+// GetDisableScheduler returns the current configuration
+func (c *Config) GetDisableScheduler() bool {
+	return c.DisableScheduler
+}
+
+// GetSaleScheduleTimes returns the current configuration
+func (c *Config) GetSaleScheduleTimes() string {
+	return c.SaleScheduleTimes
+}
+
+// GetSaleTimezone returns the current configuration
+func (c *Config) GetSaleTimezone() string {
+	return c.SaleTimezone
+}
+
+// GetRecoveryLockTTL returns the current configuration
+func (c *Config) GetRecoveryLockTTL() time.Duration {
+	return c.RecoveryLockTTL
+}
+
+// GetSchedulerBackoff returns the retry backoff of the sale scheduler
+func (c *Config) GetSchedulerBackoff() utils.Backoff {
+	return utils.Backoff{
+		Base:       c.SchedulerRetryBase,
+		Multiplier: c.SchedulerRetryMultiplier,
+		Max:        c.SchedulerRetryMax,
+		Jitter:     c.SchedulerRetryJitter,
+	}
+}
+
+// GetAttemptsRetention returns the current configuration
+func (c *Config) GetAttemptsRetention() time.Duration {
+	return c.AttemptsRetention
+}
+
+// GetNoPostgres returns the current configuration
+func (c *Config) GetNoPostgres() bool {
+	return c.NoPostgres
+}
+
+// GetAttemptWorkers returns the current configuration
+func (c *Config) GetAttemptWorkers() int {
+	return max(c.AttemptWorkers, 1)
+}
+
+// GetPurchaseWorkers returns the current configuration
+func (c *Config) GetPurchaseWorkers() int {
+	return max(c.PurchaseWorkers, 1)
+}
+
+// GetPurchasesArchival returns the current configuration
+func (c *Config) GetPurchasesArchival() time.Duration {
+	return c.PurchasesArchival
+}
+
+// GetRetentionBatchSize returns the current configuration
+func (c *Config) GetRetentionBatchSize() int {
+	return c.RetentionBatchSize
+}
+
+// GetRetentionInterval returns the current configuration
+func (c *Config) GetRetentionInterval() time.Duration {
+	return c.RetentionInterval
+}
+
+// GetDropLogInterval returns the current configuration
+func (c *Config) GetDropLogInterval() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.DropLogInterval
+}
+
+// GetCallbackSecret returns the current configuration
+func (c *Config) GetCallbackSecret() string {
+	return c.CallbackSecret
+}
+
+// GetAdminToken returns the current configuration
+func (c *Config) GetAdminToken() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.AdminToken
+}
+
+// GetUserCheckoutLimit returns the current configuration
+func (c *Config) GetUserCheckoutLimit() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.UserCheckoutLimit
+}
+
+// GetUserCheckoutCooldown returns the current configuration
+func (c *Config) GetUserCheckoutCooldown() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.UserCheckoutCooldown
+}
+
+// GetMaintenanceMode returns the current configuration
+func (c *Config) GetMaintenanceMode() bool {
+	return c.MaintenanceMode
+}
+
+// GetMaintenanceRetryAfter returns the current configuration
+func (c *Config) GetMaintenanceRetryAfter() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.MaintenanceRetryAfter
+}
+
+// GetMaxReservationLifetime returns the current configuration
+func (c *Config) GetMaxReservationLifetime() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return time.Duration(c.MaxReservationLifetime) * time.Second
+}
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/pcristin/golang_contest/internal/utils"
+)
+
+func TestValidateInitialStock(t *testing.T) {
+	tests := []struct {
+		name    string
+		stock   int
+		wantErr bool
+	}{
+		{"no stock", 0, true},
+		{"negative", -1, true},
+		{"one item", 1, false},
+		{"largest stock", utils.MaxSaleStock, false},
+		{"past the largest stock", utils.MaxSaleStock + 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewConfig()
+			c.PurchaseWriteMode = PurchaseWriteModeAsync
+			c.InitialStock = tt.stock
+
+			err := c.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,8 +1,128 @@
 package config
 
+import (
+	"sync"
+	"time"
+)
+
+// Purchase write modes
+const (
+	PurchaseWriteModeAsync = "async" // purchases are batch-inserted in the background
+	PurchaseWriteModeSync  = "sync"  // purchases are written before the response
+)
+
+// Request ID formats
+const (
+	RequestIDFormatTimestamp = "timestamp" // <unix nano>-<32 hex chars>
+	RequestIDFormatUUID      = "uuid"      // random UUIDv4
+)
+
 type Config struct {
+	Host        string // interface to bind, all interfaces if empty
 	Port        string
+	AdminPort   string // serve admin endpoints on their own listener, on Port if empty
 	RedisURL    string
 	PostgresURL string
 	LogLevel    string
+	ConfigFile  string
+	CatalogFile string
+	AdminToken  string `json:"-"` // never logged
+
+	// Shared secret of signed callbacks from external systems, never logged
+	CallbackSecret string `json:"-"`
+
+	// Redis
+	RedisKeyPrefix  string // namespace of all Redis keys, e.g. "staging:"
+	RedisMaxScripts int    // Lua scripts running at once, 0 is unlimited
+	RedisPoolWarmup int    // connections opened before serving, bounded by the pool size
+
+	// Postgres
+	PostgresStatementTimeout time.Duration // 0 disables the timeout
+	NoPostgres               bool          // testing only: run the Redis path without Postgres
+
+	// Checkout
+	DefaultItemID bool // checkouts without id get the item of single-item sales
+
+	// Limits
+	UserCheckoutLimit      int
+	MaxReservationLifetime int           // seconds
+	UserCheckoutCooldown   time.Duration // min time between checkouts of a user in a sale, 0 disables it
+
+	// Maintenance
+	MaintenanceMode       bool // answer all traffic but health checks with 503 from startup
+	MaintenanceRetryAfter int  // seconds clients are told to wait during maintenance
+
+	// Sale
+	InitialStock int  // physical stock put into Redis at sale start
+	SaleItemCap  int  // max items sold per sale, may be lower than InitialStock to keep a buffer
+	SaleAutoEnd  bool // end the sale as soon as it reaches SaleItemCap
+	SaleEndPurge bool // delete the Redis keys of a sale ended early once its codes expired
+
+	// Background workers
+	AttemptWorkers  int // goroutines batch-inserting checkout attempts
+	PurchaseWorkers int // goroutines batch-inserting purchases
+
+	// Retention
+	AttemptsRetention  time.Duration // 0 keeps checkout attempts forever
+	PurchasesArchival  time.Duration // 0 keeps purchases in the hot table forever
+	RetentionBatchSize int
+	RetentionInterval  time.Duration
+
+	// Health
+	HealthCriticalServices string        // comma separated services that make the instance unready when down
+	HealthCheckTimeout     time.Duration // max time of each service check, 0 leaves it to the client timeouts
+
+	// Consistency checks
+	UserCountCheckInterval time.Duration // 0 disables the user count checks
+
+	// Logging
+	DropLogInterval time.Duration // min time between aggregated logs of dropped records
+	RequestIDFormat string        // RequestIDFormatTimestamp or RequestIDFormatUUID
+
+	// Purchases
+	MaxInFlightPurchases     int    // concurrent purchase requests, 0 is unlimited
+	AttemptQueueHighWater    int    // percent of the attempt queue at which checkouts get 503, 0 disables it
+	PurchasePostgresFallback bool   // complete purchases from checkout_attempts when Redis lost the code
+	PurchaseWriteMode        string // PurchaseWriteModeAsync or PurchaseWriteModeSync
+
+	// Caches
+	SaleCacheSize int // max sales kept in the in-memory sale caches
+
+	// Responses
+	CheckoutIncludeSale bool // add item name and image to the checkout response
+	StockDisplayStep    int  // public stock is rounded up to a multiple of this, exact if 0 or 1
+
+	// Integrations
+	SaleStartedWebhookURL string // POSTed the sale ID, item name and image URL of each new sale
+
+	PurchaseWebhookURL         string // POSTed every completed purchase
+	PurchaseWebhookQueueSize   int    // purchases waiting to be sent, more are dropped
+	PurchaseWebhookMaxAttempts int    // calls per purchase before it's dropped
+
+	// Testing: seeds the non-security randomness, random if 0. Codes are always random.
+	RandomSeed int64
+
+	// Never enable in production, panic messages may leak internals
+	DebugErrors bool // add panic messages to 500 responses
+
+	// Response compression
+	CompressionMinSize int    // bytes, smaller responses are sent uncompressed
+	CompressionTypes   string // comma separated content types that are gzipped
+
+	// Sale scheduler
+	DisableScheduler  bool   // serve the sale created by another instance, never create sales
+	SaleScheduleTimes string // comma separated HH:MM daily start times, hourly if empty
+	SaleTimezone      string // IANA timezone of SaleScheduleTimes, local if empty
+
+	// Only one instance recovers the sale at startup, 0 lets every instance recover it
+	RecoveryLockTTL time.Duration
+
+	// Sale scheduler retries
+	SchedulerRetryBase       time.Duration
+	SchedulerRetryMultiplier float64
+	SchedulerRetryMax        time.Duration
+	SchedulerRetryJitter     float64
+
+	// Guards the settings that can be reloaded at runtime
+	mu sync.RWMutex
 }
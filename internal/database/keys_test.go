@@ -0,0 +1,126 @@
+package database
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestKeysHavePrefix(t *testing.T) {
+	const prefix = "staging:"
+	r := &RedisClient{keyPrefix: prefix}
+	keys := r.newSaleKeys(42)
+
+	built := map[string]string{
+		"checkoutKey":     r.checkoutKey("abc"),
+		"saleKey":         r.saleKey(42, "stock"),
+		"reservationsKey": r.reservationsKey("42"),
+		"reservedByKey":   r.reservedByKey("42"),
+		"userCountKey":    keys.userCountKey("user1"),
+		"userCooldownKey": keys.userCooldownKey("user1"),
+	}
+	// Every key of saleKeys, including the ones added later
+	v := reflect.ValueOf(keys)
+	for i := range v.NumField() {
+		if field := v.Field(i); field.Kind() == reflect.String {
+			built["saleKeys."+v.Type().Field(i).Name] = field.String()
+		}
+	}
+
+	for name, key := range built {
+		if !strings.HasPrefix(key, prefix) {
+			t.Errorf("%s built %q without the prefix %q", name, key, prefix)
+		}
+	}
+}
+
+// TestKeyLiteralsArePrefixed makes sure the keys built inline in redis.go start with
+// the key prefix: every string literal that starts a key must be concatenated to it.
+func TestKeyLiteralsArePrefixed(t *testing.T) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "redis.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Literals within a concatenation that starts with r.keyPrefix
+	prefixed := make(map[*ast.BasicLit]bool)
+	ast.Inspect(file, func(n ast.Node) bool {
+		expr, ok := n.(*ast.BinaryExpr)
+		if !ok || expr.Op != token.ADD {
+			return true
+		}
+		leftmost := ast.Expr(expr)
+		for {
+			binary, ok := leftmost.(*ast.BinaryExpr)
+			if !ok || binary.Op != token.ADD {
+				break
+			}
+			leftmost = binary.X
+		}
+		if selector, ok := leftmost.(*ast.SelectorExpr); ok && selector.Sel.Name == "keyPrefix" {
+			ast.Inspect(expr, func(n ast.Node) bool {
+				if lit, ok := n.(*ast.BasicLit); ok {
+					prefixed[lit] = true
+				}
+				return true
+			})
+		}
+		return true
+	})
+
+	ast.Inspect(file, func(n ast.Node) bool {
+		lit, ok := n.(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			return true
+		}
+		value, err := strconv.Unquote(lit.Value)
+		if err != nil {
+			return true
+		}
+		for _, start := range []string{"sale:", "checkout:", "lock:"} {
+			if strings.HasPrefix(value, start) && !prefixed[lit] {
+				t.Errorf("%s: key %q is built without the key prefix", fset.Position(lit.Pos()), value)
+			}
+		}
+		return true
+	})
+}
+
+// TestStockOnlyMutatedByScripts makes sure the stock counters are only changed by the
+// Lua scripts, which keep them within bounds: no fast-fail stock helpers are left and
+// redis.go sends no plain INCR or DECR command.
+func TestStockOnlyMutatedByScripts(t *testing.T) {
+	clientType := reflect.TypeOf(&RedisClient{})
+	for i := range clientType.NumMethod() {
+		name := clientType.Method(i).Name
+		if strings.Contains(name, "FastFail") || strings.HasPrefix(name, "IncrementStock") || strings.HasPrefix(name, "DecrementStock") {
+			t.Errorf("RedisClient.%s changes the stock outside the Lua scripts", name)
+		}
+	}
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "redis.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ast.Inspect(file, func(n ast.Node) bool {
+		lit, ok := n.(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			return true
+		}
+		value, err := strconv.Unquote(lit.Value)
+		if err != nil {
+			return true
+		}
+		switch strings.ToUpper(value) {
+		case "INCR", "INCRBY", "DECR", "DECRBY":
+			t.Errorf("%s: %s sent outside the Lua scripts", fset.Position(lit.Pos()), value)
+		}
+		return true
+	})
+}
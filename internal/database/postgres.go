@@ -7,11 +7,17 @@ import (
 	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"github.com/pcristin/golang_contest/internal/utils"
 )
 
-// NewPostgresClient creates a new Postgres client
-func NewPostgresClient(ctx context.Context, url string) (*PostgresClient, error) {
+// NewPostgresClient creates a new Postgres client.
+// A positive statementTimeout aborts any statement running longer than it.
+func NewPostgresClient(ctx context.Context, url string, statementTimeout time.Duration) (*PostgresClient, error) {
+	if statementTimeout > 0 {
+		url = withStatementTimeout(url, statementTimeout)
+	}
+
 	// Open a connection to the Postgres database
 	db, err := sql.Open("postgres", url)
 	if err != nil {
@@ -24,11 +30,31 @@ func NewPostgresClient(ctx context.Context, url string) (*PostgresClient, error)
 	db.SetConnMaxLifetime(5 * time.Minute) // Max connection lifetime
 
 	// Immediately test the connection
-	if err := db.Ping(); err != nil {
+	if err := db.PingContext(ctx); err != nil {
 		return nil, err
 	}
 
-	return &PostgresClient{db: db}, nil
+	return &PostgresClient{db: db, clock: utils.RealClock{}}, nil
+}
+
+// withStatementTimeout adds the statement_timeout run-time parameter to the connection string.
+// lib/pq passes unknown parameters to the server on connect, for both URL and key=value forms.
+func withStatementTimeout(connStr string, statementTimeout time.Duration) string {
+	param := fmt.Sprintf("statement_timeout=%d", statementTimeout.Milliseconds())
+
+	if strings.HasPrefix(connStr, "postgres://") || strings.HasPrefix(connStr, "postgresql://") {
+		if strings.Contains(connStr, "?") {
+			return connStr + "&" + param
+		}
+		return connStr + "?" + param
+	}
+	return connStr + " " + param
+}
+
+// SetClock replaces the clock of the stored sale and purchase times and of the expiry
+// cutoff, e.g. with a fake clock in tests. Must be called before the client is used.
+func (c *PostgresClient) SetClock(clock utils.Clock) {
+	c.clock = clock
 }
 
 // Close closes the Postgres client
@@ -37,21 +63,24 @@ func (c *PostgresClient) Close() error {
 }
 
 // HealthCheck checks if the Postgres client is healthy
-func (c *PostgresClient) HealthCheck() error {
-	return c.db.Ping()
+func (c *PostgresClient) HealthCheck(ctx context.Context) error {
+	return c.db.PingContext(ctx)
 }
 
 // CreateTables creates the tables for the Postgres client
-func (c *PostgresClient) CreateTables() error {
+func (c *PostgresClient) CreateTables(ctx context.Context) error {
 	// Schema
-	schema := `
+	schema := fmt.Sprintf(`
     CREATE TABLE IF NOT EXISTS sales (
         id SERIAL PRIMARY KEY,
-        item_name VARCHAR(255) NOT NULL,
-        image_url VARCHAR(500) NOT NULL,
+        item_name VARCHAR(%d) NOT NULL,
+        image_url VARCHAR(%d) NOT NULL,
         started_at TIMESTAMP NOT NULL,
-        ended_at TIMESTAMP
+        ended_at TIMESTAMP,
+        added_stock INTEGER NOT NULL DEFAULT 0
     );
+
+    ALTER TABLE sales ADD COLUMN IF NOT EXISTS added_stock INTEGER NOT NULL DEFAULT 0;
     
     CREATE TABLE IF NOT EXISTS checkout_attempts (
         id SERIAL PRIMARY KEY,
@@ -60,10 +89,18 @@ func (c *PostgresClient) CreateTables() error {
 		item_id VARCHAR(50) NOT NULL,
         code VARCHAR(32),
         status VARCHAR(30) NOT NULL,
+        outcome_code SMALLINT,
+        ttl_seconds INTEGER,
         created_at TIMESTAMP DEFAULT NOW()
     );
+
+    ALTER TABLE checkout_attempts ADD COLUMN IF NOT EXISTS outcome_code SMALLINT;
+    ALTER TABLE checkout_attempts ADD COLUMN IF NOT EXISTS ttl_seconds INTEGER;
     
+    CREATE INDEX IF NOT EXISTS idx_sales_item_name ON sales(LOWER(item_name));
+
     CREATE INDEX IF NOT EXISTS idx_code ON checkout_attempts(code) WHERE code IS NOT NULL;
+    CREATE INDEX IF NOT EXISTS idx_attempts_user_sale ON checkout_attempts(user_id, sale_id, id);
     
     CREATE TABLE IF NOT EXISTS purchases (
         id SERIAL PRIMARY KEY,
@@ -75,10 +112,27 @@ func (c *PostgresClient) CreateTables() error {
     
     CREATE INDEX IF NOT EXISTS idx_user_sale ON purchases(user_id, sale_id);
     CREATE INDEX IF NOT EXISTS idx_user_item ON purchases(user_id, item_id);
-    `
+
+    CREATE TABLE IF NOT EXISTS purchases_archive (
+        id INTEGER PRIMARY KEY,
+        user_id VARCHAR(50) NOT NULL,
+        sale_id INTEGER REFERENCES sales(id),
+        item_id VARCHAR(50) NOT NULL,
+        purchased_at TIMESTAMP,
+        archived_at TIMESTAMP DEFAULT NOW()
+    );
+
+    CREATE TABLE IF NOT EXISTS sale_reconciliations (
+        id SERIAL PRIMARY KEY,
+        sale_id INTEGER REFERENCES sales(id),
+        redis_items_sold BIGINT NOT NULL,
+        purchases BIGINT NOT NULL,
+        checked_at TIMESTAMP DEFAULT NOW()
+    );
+    `, MaxItemNameLength, MaxImageURLLength)
 
 	// Execute the schema
-	_, err := c.db.Exec(schema)
+	_, err := c.db.ExecContext(ctx, schema)
 	if err != nil {
 		return err
 	}
@@ -87,11 +141,11 @@ func (c *PostgresClient) CreateTables() error {
 }
 
 // InsertSale inserts a new sale into the database
-func (c *PostgresClient) InsertSale(itemName, imageURL string) (int, error) {
+func (c *PostgresClient) InsertSale(ctx context.Context, itemName, imageURL string) (int, error) {
 	var saleID int
 	// Insert the sale into the database
-	err := c.db.QueryRow("INSERT INTO sales (item_name, image_url, started_at) VALUES ($1, $2, $3) RETURNING id",
-		itemName, imageURL, time.Now()).Scan(&saleID)
+	err := c.db.QueryRowContext(ctx, "INSERT INTO sales (item_name, image_url, started_at) VALUES ($1, $2, $3) RETURNING id",
+		itemName, imageURL, c.clock.Now()).Scan(&saleID)
 	if err != nil {
 		return 0, err
 	}
@@ -99,10 +153,16 @@ func (c *PostgresClient) InsertSale(itemName, imageURL string) (int, error) {
 	return saleID, nil
 }
 
+// DeleteSale deletes a sale, e.g. one that failed to start. Fails if anything refers to it.
+func (c *PostgresClient) DeleteSale(ctx context.Context, saleID int) error {
+	_, err := c.db.ExecContext(ctx, "DELETE FROM sales WHERE id = $1", saleID)
+	return err
+}
+
 // BatchInsertAttempts inserts a batch of checkout attempts into the database
-func (c *PostgresClient) BatchInsertAttempts(attempts []CheckoutAttempt) error {
+func (c *PostgresClient) BatchInsertAttempts(ctx context.Context, attempts []CheckoutAttempt) error {
 	// Start a transaction
-	tx, err := c.db.Begin()
+	tx, err := c.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -110,9 +170,9 @@ func (c *PostgresClient) BatchInsertAttempts(attempts []CheckoutAttempt) error {
 	defer tx.Rollback()
 
 	// Prepare the statement for better perfomance
-	stmt, err := tx.Prepare(`
-		INSERT INTO checkout_attempts (user_id, sale_id, item_id, code, status, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6)
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO checkout_attempts (user_id, sale_id, item_id, code, status, outcome_code, created_at, ttl_seconds)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 	`)
 	if err != nil {
 		return err
@@ -121,7 +181,7 @@ func (c *PostgresClient) BatchInsertAttempts(attempts []CheckoutAttempt) error {
 
 	// Insert each attempt
 	for _, attempt := range attempts {
-		_, err := stmt.Exec(attempt.UserID, attempt.SaleID, attempt.ItemID, attempt.Code, attempt.Status, attempt.CreatedAt)
+		_, err := stmt.ExecContext(ctx, attempt.UserID, attempt.SaleID, attempt.ItemID, attempt.Code, attempt.Status.String(), int(attempt.Status), attempt.CreatedAt, attemptTTL(attempt))
 		if err != nil {
 			// For now, fail the whole batch
 			// Decide the best way to handle individual errors later
@@ -131,10 +191,15 @@ func (c *PostgresClient) BatchInsertAttempts(attempts []CheckoutAttempt) error {
 	return tx.Commit()
 }
 
+// attemptTTL returns the ttl_seconds column value of the attempt, NULL if unknown
+func attemptTTL(attempt CheckoutAttempt) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(attempt.TTL), Valid: attempt.TTL > 0}
+}
+
 // InsertSingleAttempt inserts a single checkout attempt into the database (FALLBACK SCENARIO)
-func (c *PostgresClient) InsertSingleAttempt(attempt CheckoutAttempt) error {
-	_, err := c.db.Exec("INSERT INTO checkout_attempts (user_id, sale_id, item_id, code, status, created_at) VALUES ($1, $2, $3, $4, $5, $6)",
-		attempt.UserID, attempt.SaleID, attempt.ItemID, attempt.Code, attempt.Status, attempt.CreatedAt)
+func (c *PostgresClient) InsertSingleAttempt(ctx context.Context, attempt CheckoutAttempt) error {
+	_, err := c.db.ExecContext(ctx, "INSERT INTO checkout_attempts (user_id, sale_id, item_id, code, status, outcome_code, created_at, ttl_seconds) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		attempt.UserID, attempt.SaleID, attempt.ItemID, attempt.Code, attempt.Status.String(), int(attempt.Status), attempt.CreatedAt, attemptTTL(attempt))
 	if err != nil {
 		return err
 	}
@@ -142,9 +207,9 @@ func (c *PostgresClient) InsertSingleAttempt(attempt CheckoutAttempt) error {
 }
 
 // InsertPurchase inserts a purchase into the database
-func (c *PostgresClient) InsertPurchase(userID string, saleID int, itemID string) error {
-	_, err := c.db.Exec("INSERT INTO purchases (user_id, sale_id, item_id, purchased_at) VALUES ($1, $2, $3, $4)",
-		userID, saleID, itemID, time.Now())
+func (c *PostgresClient) InsertPurchase(ctx context.Context, userID string, saleID int, itemID string) error {
+	_, err := c.db.ExecContext(ctx, "INSERT INTO purchases (user_id, sale_id, item_id, purchased_at) VALUES ($1, $2, $3, $4)",
+		userID, saleID, itemID, c.clock.Now())
 	if err != nil {
 		return err
 	}
@@ -152,9 +217,9 @@ func (c *PostgresClient) InsertPurchase(userID string, saleID int, itemID string
 }
 
 // GetCheckoutAttemptByCode gets the checkout attempt for a user by code
-func (c *PostgresClient) GetCheckoutAttemptByCode(code string) (*CheckoutAttempt, error) {
+func (c *PostgresClient) GetCheckoutAttemptByCode(ctx context.Context, code string) (*CheckoutAttempt, error) {
 	var attempt CheckoutAttempt
-	err := c.db.QueryRow("SELECT id, user_id, sale_id, item_id, code, status, created_at FROM checkout_attempts WHERE code = $1", code).Scan(
+	err := c.db.QueryRowContext(ctx, "SELECT id, user_id, sale_id, item_id, code, status, created_at FROM checkout_attempts WHERE code = $1", code).Scan(
 		&attempt.ID,
 		&attempt.UserID,
 		&attempt.SaleID,
@@ -162,18 +227,19 @@ func (c *PostgresClient) GetCheckoutAttemptByCode(code string) (*CheckoutAttempt
 		&attempt.Code,
 		&attempt.Status,
 		&attempt.CreatedAt)
-	if err != nil {
-		return nil, err
-	} else if err == sql.ErrNoRows {
+	if err == sql.ErrNoRows {
 		return nil, nil
+	} else if err != nil {
+		return nil, err
 	}
 	return &attempt, nil
 }
 
-// CompletePurchase completes a purchase in a transaction
-func (c *PostgresClient) CompletePurchase(code string, userID string, saleID int, itemID string) error {
+// CompletePurchase completes a purchase in a transaction.
+// Returns ErrCheckoutCodeNotFound if there is no attempt with the code.
+func (c *PostgresClient) CompletePurchase(ctx context.Context, code string, userID string, saleID int, itemID string) error {
 	// Start a transaction
-	tx, err := c.db.Begin()
+	tx, err := c.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -182,27 +248,28 @@ func (c *PostgresClient) CompletePurchase(code string, userID string, saleID int
 
 	// Get attempt ID and verify it's still pending for purchase
 	var attemptID int
-	var status string
-	err = tx.QueryRow("SELECT id, status FROM checkout_attempts WHERE code = $1 FOR UPDATE",
+	var status CheckoutStatus
+	err = tx.QueryRowContext(ctx, "SELECT id, status FROM checkout_attempts WHERE code = $1 FOR UPDATE",
 		code,
 	).Scan(&attemptID, &status)
-	if err != nil {
+	if err == sql.ErrNoRows {
+		return ErrCheckoutCodeNotFound
+	} else if err != nil {
 		return err
-	} else if err == sql.ErrNoRows {
-		return fmt.Errorf("checkout attempt not found or already completed")
-	} else if status != "success" {
+	} else if status != CheckoutStatusSuccess {
 		return fmt.Errorf("checkout attempt already completed")
 	}
 
 	// Update the attempt status to completed
-	_, err = tx.Exec("UPDATE checkout_attempts SET status = 'completed' WHERE id = $1", attemptID)
+	_, err = tx.ExecContext(ctx, "UPDATE checkout_attempts SET status = $1, outcome_code = $2 WHERE id = $3",
+		CheckoutStatusCompleted.String(), int(CheckoutStatusCompleted), attemptID)
 	if err != nil {
 		return err
 	}
 
 	// Insert the purchase
-	_, err = tx.Exec("INSERT INTO purchases (user_id, sale_id, item_id, purchased_at) VALUES ($1, $2, $3, $4)",
-		userID, saleID, itemID, time.Now())
+	_, err = tx.ExecContext(ctx, "INSERT INTO purchases (user_id, sale_id, item_id, purchased_at) VALUES ($1, $2, $3, $4)",
+		userID, saleID, itemID, c.clock.Now())
 	if err != nil {
 		return err
 	}
@@ -210,10 +277,63 @@ func (c *PostgresClient) CompletePurchase(code string, userID string, saleID int
 	return tx.Commit()
 }
 
+// CompletePurchaseFromAttempt completes the purchase of a checkout code from its
+// checkout attempt, for when the code is gone from Redis. The attempt must still
+// be pending and younger than its TTL, defaultTTL for attempts stored without one.
+// Returns ErrCheckoutCodeNotFound if there is no such attempt.
+func (c *PostgresClient) CompletePurchaseFromAttempt(ctx context.Context, code string, defaultTTL time.Duration) (*CheckoutAttempt, error) {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Locking the row makes concurrent purchases of the same code wait for each other
+	var attempt CheckoutAttempt
+	err = tx.QueryRowContext(ctx, `
+		SELECT id, user_id, sale_id, item_id, code, status, created_at
+		FROM checkout_attempts
+		WHERE code = $1
+		AND status = 'success'
+		AND created_at + COALESCE(ttl_seconds, $2) * INTERVAL '1 second' > $3
+		FOR UPDATE
+	`, code, int(defaultTTL.Seconds()), c.clock.Now()).Scan(
+		&attempt.ID,
+		&attempt.UserID,
+		&attempt.SaleID,
+		&attempt.ItemID,
+		&attempt.Code,
+		&attempt.Status,
+		&attempt.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrCheckoutCodeNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE checkout_attempts SET status = $1, outcome_code = $2 WHERE id = $3",
+		CheckoutStatusCompleted.String(), int(CheckoutStatusCompleted), attempt.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO purchases (user_id, sale_id, item_id, purchased_at) VALUES ($1, $2, $3, $4)",
+		attempt.UserID, attempt.SaleID, attempt.ItemID, c.clock.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	attempt.Status = CheckoutStatusCompleted
+	return &attempt, nil
+}
+
 // GetSaleByID gets a sale by ID
-func (c *PostgresClient) GetSaleByID(saleID int) (string, string, error) {
+func (c *PostgresClient) GetSaleByID(ctx context.Context, saleID int) (string, string, error) {
 	var itemName, imageURL string
-	err := c.db.QueryRow("SELECT item_name, image_url FROM sales WHERE id = $1", saleID).Scan(
+	err := c.db.QueryRowContext(ctx, "SELECT item_name, image_url FROM sales WHERE id = $1", saleID).Scan(
 		&itemName,
 		&imageURL,
 	)
@@ -223,13 +343,57 @@ func (c *PostgresClient) GetSaleByID(saleID int) (string, string, error) {
 	return itemName, imageURL, nil
 }
 
-// GetExpiredCheckoutAttempts gets all checkout attempts that are expired
-func (c *PostgresClient) GetExpiredCheckoutAttempts(expiredAfter time.Duration) ([]CheckoutAttempt, error) {
-	stmt, err := c.db.Prepare(`
+// GetSaleRecord gets a sale with its start and end times by ID
+func (c *PostgresClient) GetSaleRecord(ctx context.Context, saleID int) (*SaleRecord, error) {
+	var sale SaleRecord
+	err := c.db.QueryRowContext(ctx, "SELECT id, item_name, image_url, started_at, ended_at, added_stock FROM sales WHERE id = $1", saleID).Scan(
+		&sale.ID,
+		&sale.ItemName,
+		&sale.ImageURL,
+		&sale.StartedAt,
+		&sale.EndedAt,
+		&sale.AddedStock,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &sale, nil
+}
+
+// AddSaleStock records stock added to a running sale, so restoring the sale's Redis
+// keys doesn't lose it
+func (c *PostgresClient) AddSaleStock(ctx context.Context, saleID int, amount int) error {
+	_, err := c.db.ExecContext(ctx, "UPDATE sales SET added_stock = added_stock + $1 WHERE id = $2", amount, saleID)
+	return err
+}
+
+// GetSaleByItemName gets the sales of an item, matched case-insensitively, newest first
+func (c *PostgresClient) GetSaleByItemName(ctx context.Context, name string) ([]SaleRecord, error) {
+	rows, err := c.db.QueryContext(ctx, "SELECT id, item_name, image_url, started_at, ended_at FROM sales WHERE LOWER(item_name) = LOWER($1) ORDER BY id DESC", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sales := []SaleRecord{}
+	for rows.Next() {
+		var sale SaleRecord
+		if err := rows.Scan(&sale.ID, &sale.ItemName, &sale.ImageURL, &sale.StartedAt, &sale.EndedAt); err != nil {
+			return nil, err
+		}
+		sales = append(sales, sale)
+	}
+	return sales, rows.Err()
+}
+
+// GetExpiredCheckoutAttempts gets all checkout attempts that expired more than grace ago.
+// Each attempt expires after its own TTL, defaultTTL for attempts stored without one.
+func (c *PostgresClient) GetExpiredCheckoutAttempts(ctx context.Context, grace time.Duration, defaultTTL time.Duration) ([]CheckoutAttempt, error) {
+	stmt, err := c.db.PrepareContext(ctx, `
 		SELECT id, user_id, sale_id, item_id, code, status, created_at 
 		FROM checkout_attempts 
 		WHERE status = 'success' 
-		AND created_at < $1
+		AND created_at + COALESCE(ttl_seconds, $2) * INTERVAL '1 second' < $1
 		ORDER BY created_at
 		LIMIT 100
 	`)
@@ -239,9 +403,9 @@ func (c *PostgresClient) GetExpiredCheckoutAttempts(expiredAfter time.Duration)
 	}
 	defer stmt.Close()
 
-	cutoff := time.Now().Add(-expiredAfter)
+	cutoff := c.clock.Now().Add(-grace)
 
-	rows, err := stmt.Query(cutoff)
+	rows, err := stmt.QueryContext(ctx, cutoff, int(defaultTTL.Seconds()))
 	if err != nil {
 		return nil, err
 	}
@@ -260,7 +424,7 @@ func (c *PostgresClient) GetExpiredCheckoutAttempts(expiredAfter time.Duration)
 }
 
 // MarkAttemptsExpired marks all checkout attempts that are expired as expired
-func (c *PostgresClient) MarkAttemptsExpired(attemptsIDs []int) error {
+func (c *PostgresClient) MarkAttemptsExpired(ctx context.Context, attemptsIDs []int) error {
 	if len(attemptsIDs) == 0 {
 		return nil
 	}
@@ -274,18 +438,18 @@ func (c *PostgresClient) MarkAttemptsExpired(attemptsIDs []int) error {
 	}
 
 	// Build the query
-	query := fmt.Sprintf("UPDATE checkout_attempts SET status = 'expired' WHERE id IN (%s)",
-		strings.Join(placeholders, ", "))
+	query := fmt.Sprintf("UPDATE checkout_attempts SET status = '%s', outcome_code = %d WHERE id IN (%s)",
+		CheckoutStatusExpired, CheckoutStatusExpired, strings.Join(placeholders, ", "))
 
 	// Start a transaction
-	tx, err := c.db.Begin()
+	tx, err := c.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
 	// Execute the query
-	_, err = tx.Exec(query, args...)
+	_, err = tx.ExecContext(ctx, query, args...)
 	if err != nil {
 		return err
 	}
@@ -293,9 +457,9 @@ func (c *PostgresClient) MarkAttemptsExpired(attemptsIDs []int) error {
 }
 
 // GetLastSaleStartTime gets the start time of the last sale
-func (c *PostgresClient) GetLastSaleStartTime() (time.Time, error) {
+func (c *PostgresClient) GetLastSaleStartTime(ctx context.Context) (time.Time, error) {
 	var startTime time.Time
-	err := c.db.QueryRow("SELECT started_at FROM sales ORDER BY started_at DESC LIMIT 1").Scan(&startTime)
+	err := c.db.QueryRowContext(ctx, "SELECT started_at FROM sales ORDER BY started_at DESC LIMIT 1").Scan(&startTime)
 	if err == sql.ErrNoRows {
 		return time.Time{}, nil
 	} else if err != nil {
@@ -305,9 +469,9 @@ func (c *PostgresClient) GetLastSaleStartTime() (time.Time, error) {
 }
 
 // GetActiveSaleID gets the ID of the active sale
-func (c *PostgresClient) GetActiveSaleID() (int, error) {
+func (c *PostgresClient) GetActiveSaleID(ctx context.Context) (int, error) {
 	var saleID int
-	err := c.db.QueryRow("SELECT id FROM sales WHERE ended_at IS NULL ORDER BY id DESC LIMIT 1").Scan(&saleID)
+	err := c.db.QueryRowContext(ctx, "SELECT id FROM sales WHERE ended_at IS NULL ORDER BY id DESC LIMIT 1").Scan(&saleID)
 	if err == sql.ErrNoRows {
 		return 0, nil
 	} else if err != nil {
@@ -317,15 +481,15 @@ func (c *PostgresClient) GetActiveSaleID() (int, error) {
 }
 
 // EndSale ends the active sale (mark it as ended)
-func (c *PostgresClient) EndSale(saleID int) error {
-	_, err := c.db.Exec("UPDATE sales SET ended_at = $1 WHERE id = $2", time.Now(), saleID)
+func (c *PostgresClient) EndSale(ctx context.Context, saleID int) error {
+	_, err := c.db.ExecContext(ctx, "UPDATE sales SET ended_at = $1 WHERE id = $2", c.clock.Now(), saleID)
 	return err
 }
 
 // BatchInsertPurchases inserts a batch of purchases into the database
-func (c *PostgresClient) BatchInsertPurchases(purchases []Purchase) error {
+func (c *PostgresClient) BatchInsertPurchases(ctx context.Context, purchases []Purchase) error {
 	// Start a transaction
-	tx, err := c.db.Begin()
+	tx, err := c.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -333,7 +497,7 @@ func (c *PostgresClient) BatchInsertPurchases(purchases []Purchase) error {
 	defer tx.Rollback()
 
 	// Prepare the statement for better perfomance
-	stmt, err := tx.Prepare(`
+	stmt, err := tx.PrepareContext(ctx, `
 		INSERT INTO purchases (user_id, sale_id, item_id, purchased_at)
 		VALUES ($1, $2, $3, $4)
 	`)
@@ -344,7 +508,7 @@ func (c *PostgresClient) BatchInsertPurchases(purchases []Purchase) error {
 
 	// Insert each purchase
 	for _, purchase := range purchases {
-		_, err := stmt.Exec(purchase.UserID, purchase.SaleID, purchase.ItemID, purchase.PurchasedAt)
+		_, err := stmt.ExecContext(ctx, purchase.UserID, purchase.SaleID, purchase.ItemID, purchase.PurchasedAt)
 		if err != nil {
 			// For now, fail the whole batch
 			// Decide the best way to handle individual errors later
@@ -353,3 +517,170 @@ func (c *PostgresClient) BatchInsertPurchases(purchases []Purchase) error {
 	}
 	return tx.Commit()
 }
+
+// CountCheckoutsByUser counts the successful checkouts of every user in a sale,
+// whether they were purchased, expired or are still reserved
+func (c *PostgresClient) CountCheckoutsByUser(ctx context.Context, saleID int) (map[string]int64, error) {
+	rows, err := c.db.QueryContext(ctx, `
+		SELECT user_id, COUNT(*)
+		FROM checkout_attempts
+		WHERE sale_id = $1
+		AND status IN ('success', 'completed', 'expired')
+		GROUP BY user_id
+	`, saleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var userID string
+		var count int64
+		if err := rows.Scan(&userID, &count); err != nil {
+			return nil, err
+		}
+		counts[userID] = count
+	}
+	return counts, rows.Err()
+}
+
+// GetAttemptsByUser gets the checkout attempts of the user in a sale, newest first.
+// A nil status returns the attempts of any status.
+func (c *PostgresClient) GetAttemptsByUser(ctx context.Context, userID string, saleID int, status *CheckoutStatus, limit, offset int) ([]CheckoutAttempt, error) {
+	query := "SELECT id, user_id, sale_id, item_id, code, status, created_at FROM checkout_attempts WHERE user_id = $1 AND sale_id = $2"
+	args := []any{userID, saleID}
+	if status != nil {
+		query += " AND status = $3"
+		args = append(args, status.String())
+	}
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d OFFSET $%d", len(args)+1, len(args)+2)
+	args = append(args, limit, offset)
+
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []CheckoutAttempt{}
+	for rows.Next() {
+		var attempt CheckoutAttempt
+		if err := rows.Scan(&attempt.ID, &attempt.UserID, &attempt.SaleID, &attempt.ItemID, &attempt.Code, &attempt.Status, &attempt.CreatedAt); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, attempt)
+	}
+	return attempts, rows.Err()
+}
+
+// GetPurchasedItemIDs gets the item IDs the user purchased in a sale
+func (c *PostgresClient) GetPurchasedItemIDs(ctx context.Context, userID string, saleID int) ([]string, error) {
+	rows, err := c.db.QueryContext(ctx, "SELECT item_id FROM purchases WHERE user_id = $1 AND sale_id = $2 ORDER BY id", userID, saleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	itemIDs := []string{}
+	for rows.Next() {
+		var itemID string
+		if err := rows.Scan(&itemID); err != nil {
+			return nil, err
+		}
+		itemIDs = append(itemIDs, itemID)
+	}
+	return itemIDs, rows.Err()
+}
+
+// StreamPurchasesBySale streams all purchases of a sale to fn row by row,
+// so that large sales are never loaded into memory at once
+func (c *PostgresClient) StreamPurchasesBySale(ctx context.Context, saleID int, fn func(Purchase) error) error {
+	rows, err := c.db.QueryContext(ctx, "SELECT id, user_id, sale_id, item_id, purchased_at FROM purchases WHERE sale_id = $1 ORDER BY id", saleID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var purchase Purchase
+		if err := rows.Scan(&purchase.ID, &purchase.UserID, &purchase.SaleID, &purchase.ItemID, &purchase.PurchasedAt); err != nil {
+			return err
+		}
+		if err := fn(purchase); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// CountPurchasesBySale counts the purchases of a sale
+func (c *PostgresClient) CountPurchasesBySale(ctx context.Context, saleID int) (int64, error) {
+	var count int64
+	err := c.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM purchases WHERE sale_id = $1", saleID).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// CountExpiredAttemptsBySale counts the checkout attempts of a sale whose code expired
+func (c *PostgresClient) CountExpiredAttemptsBySale(ctx context.Context, saleID int) (int64, error) {
+	var count int64
+	err := c.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM checkout_attempts WHERE sale_id = $1 AND status = $2",
+		saleID, CheckoutStatusExpired.String()).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// InsertSaleReconciliation stores the result of a sale reconciliation
+func (c *PostgresClient) InsertSaleReconciliation(ctx context.Context, reconciliation SaleReconciliation) error {
+	_, err := c.db.ExecContext(ctx, "INSERT INTO sale_reconciliations (sale_id, redis_items_sold, purchases, checked_at) VALUES ($1, $2, $3, $4)",
+		reconciliation.SaleID, reconciliation.RedisItemsSold, reconciliation.Purchases, reconciliation.CheckedAt)
+	return err
+}
+
+// DeleteOldAttempts deletes up to limit resolved checkout attempts of ended sales created before the cutoff.
+// Attempts that may still change (e.g. "success" waiting for purchase or expiry) are never deleted.
+func (c *PostgresClient) DeleteOldAttempts(ctx context.Context, cutoff time.Time, limit int) (int64, error) {
+	result, err := c.db.ExecContext(ctx, `
+		DELETE FROM checkout_attempts WHERE id IN (
+			SELECT a.id FROM checkout_attempts a
+			JOIN sales s ON s.id = a.sale_id
+			WHERE a.created_at < $1
+			AND s.ended_at IS NOT NULL
+			AND a.status = ANY($3)
+			LIMIT $2
+		)
+	`, cutoff, limit, pq.Array(resolvedCheckoutStatuses()))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// ArchiveOldPurchases moves up to limit purchases of ended sales made before the cutoff to the archive table.
+// Delete and insert run as a single statement, so a failure never loses or duplicates rows.
+func (c *PostgresClient) ArchiveOldPurchases(ctx context.Context, cutoff time.Time, limit int) (int64, error) {
+	result, err := c.db.ExecContext(ctx, `
+		WITH moved AS (
+			DELETE FROM purchases WHERE id IN (
+				SELECT p.id FROM purchases p
+				JOIN sales s ON s.id = p.sale_id
+				WHERE p.purchased_at < $1
+				AND s.ended_at IS NOT NULL
+				ORDER BY p.id
+				LIMIT $2
+			)
+			RETURNING id, user_id, sale_id, item_id, purchased_at
+		)
+		INSERT INTO purchases_archive (id, user_id, sale_id, item_id, purchased_at)
+		SELECT id, user_id, sale_id, item_id, purchased_at FROM moved
+	`, cutoff, limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
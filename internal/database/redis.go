@@ -3,14 +3,23 @@ package database
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 	myLogger "github.com/pcristin/golang_contest/internal/logger"
+	"github.com/pcristin/golang_contest/internal/utils"
 )
 
-func NewRedisClient(ctx context.Context, address string) *RedisClient {
+// NewRedisClient creates a Redis client. Every key it builds starts with keyPrefix,
+// so environments can share a Redis instance. At most maxScripts Lua scripts run
+// at once, 0 is unlimited. Checkouts are checked against limits.
+func NewRedisClient(ctx context.Context, address string, keyPrefix string, maxScripts int, limits CheckoutLimits) *RedisClient {
 	logger := myLogger.FromContext(ctx, "redis")
 
 	pool := &redis.Pool{
@@ -43,115 +52,398 @@ func NewRedisClient(ctx context.Context, address string) *RedisClient {
 			return err
 		},
 	}
-	return &RedisClient{
-		pool: pool,
+	client := &RedisClient{
+		pool:      pool,
+		keyPrefix: keyPrefix,
+		clock:     utils.RealClock{},
 	}
+	if maxScripts > 0 {
+		client.scriptSlots = make(chan struct{}, maxScripts)
+	}
+	client.SetCheckoutLimits(limits)
+	return client
+}
+
+// SetCheckoutLimits replaces the limits of the checkouts, e.g. after a config reload
+func (r *RedisClient) SetCheckoutLimits(limits CheckoutLimits) {
+	r.checkoutLimits.Store(&limits)
+}
+
+// SetClock replaces the clock of the stored sale and checkout times, e.g. with a fake
+// clock in tests. Must be called before the client is used.
+func (r *RedisClient) SetClock(clock utils.Clock) {
+	r.clock = clock
+}
+
+// CheckoutLimits returns the limits the checkouts are checked against
+func (r *RedisClient) CheckoutLimits() CheckoutLimits {
+	return *r.checkoutLimits.Load()
+}
+
+// runScript runs a Lua script once a script slot is free. Scripts block the Redis
+// event loop, so the cap keeps bursts of them from stalling every other command.
+// redigo sends EVALSHA and only falls back to EVAL when Redis doesn't know the script.
+func (r *RedisClient) runScript(ctx context.Context, conn redis.Conn, script *redis.Script, keysAndArgs ...any) (any, error) {
+	if r.scriptSlots != nil {
+		select {
+		case r.scriptSlots <- struct{}{}:
+			defer func() { <-r.scriptSlots }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	r.scriptsInFlight.Add(1)
+	defer r.scriptsInFlight.Add(-1)
+
+	return script.Do(conn, keysAndArgs...)
+}
+
+// ScriptStats returns the number of Lua scripts running and the cap, 0 if unlimited
+func (r *RedisClient) ScriptStats() (inFlight int64, limit int) {
+	return r.scriptsInFlight.Load(), cap(r.scriptSlots)
+}
+
+var (
+	// ErrCheckoutCodeNotFound is returned when a checkout code doesn't exist or has expired
+	ErrCheckoutCodeNotFound = errors.New("checkout code not found")
+
+	// ErrCheckoutCodeContention is returned when a checkout code changed between reading and deleting it
+	ErrCheckoutCodeContention = errors.New("checkout code changed concurrently")
+
+	// ErrMalformedCheckoutData is returned when the data of a checkout code can't be parsed
+	ErrMalformedCheckoutData = errors.New("malformed checkout data")
+
+	// ErrSaleKeysNotFound is returned when the keys of a sale don't exist or have expired
+	ErrSaleKeysNotFound = errors.New("sale keys not found")
+
+	// ErrSaleItemNotFound is returned when the item of a sale isn't stored in Redis
+	ErrSaleItemNotFound = errors.New("sale item not found")
+
+	// ErrReservationLifetimeExceeded is returned when a checkout code can't be extended any further
+	ErrReservationLifetimeExceeded = errors.New("checkout code reached its maximum lifetime")
+)
+
+// Special replies of the Redis TTL command
+const (
+	// TTLKeyMissing is returned by GetCodeTTL when the code doesn't exist
+	TTLKeyMissing = -2
+
+	// TTLNoExpire is returned by GetCodeTTL when the code never expires
+	TTLNoExpire = -1
+)
+
+// saleKeys are the hot path keys of a sale, built once per active sale
+// instead of formatting them on every checkout.
+// After the sale was created its stock and items sold counters are only changed by
+// the Lua scripts (checkout, reservation release, stock replenishment), which keep
+// them within bounds. Don't add plain INCR/DECR helpers for them.
+type saleKeys struct {
+	saleID          int
+	stock           string
+	itemsSold       string
+	itemCap         string
+	reservations    string
+	reservedBy      string
+	userCountPrefix string
+}
+
+// newSaleKeys builds the keys of the sale
+func (r *RedisClient) newSaleKeys(saleID int) saleKeys {
+	prefix := r.keyPrefix + "sale:" + strconv.Itoa(saleID)
+	return saleKeys{
+		saleID:          saleID,
+		stock:           prefix + ":stock",
+		itemsSold:       prefix + ":items_sold",
+		itemCap:         prefix + ":item_cap",
+		reservations:    prefix + ":reservations",
+		reservedBy:      prefix + ":reserved_by",
+		userCountPrefix: prefix + ":user:",
+	}
+}
+
+// checkoutKey returns the key of a checkout code
+func (r *RedisClient) checkoutKey(code string) string {
+	return r.keyPrefix + "checkout:" + code
+}
+
+// saleKey returns the key of a sale field, e.g. "stock"
+func (r *RedisClient) saleKey(saleID int, name string) string {
+	return r.keyPrefix + "sale:" + strconv.Itoa(saleID) + ":" + name
+}
+
+// reservationsKey returns the key of the set of outstanding checkout codes of the sale,
+// for callers holding the sale ID of the checkout data
+func (r *RedisClient) reservationsKey(saleID string) string {
+	return r.keyPrefix + "sale:" + saleID + ":reservations"
+}
+
+// reservedByKey returns the key of the hash of the users holding the outstanding
+// checkout codes of the sale. Expired codes are gone with their data, this is what
+// tells whose checkout count to give back.
+func (r *RedisClient) reservedByKey(saleID string) string {
+	return r.keyPrefix + "sale:" + saleID + ":reserved_by"
+}
+
+// userCountKey returns the checkout count key of the user in the sale.
+// Counts are per sale, so a new sale starts without any.
+func (k saleKeys) userCountKey(userID string) string {
+	return k.userCountPrefix + userID + ":count"
+}
+
+// userCooldownKey returns the key that exists while the user has to wait before the
+// next checkout in the sale
+func (k saleKeys) userCooldownKey(userID string) string {
+	return k.userCountPrefix + userID + ":cooldown"
+}
+
+// activeSaleKeys returns the keys of the active sale
+func (r *RedisClient) activeSaleKeys(ctx context.Context) (saleKeys, error) {
+	activeSaleID, err := r.GetActiveSaleID(ctx)
+	if err != nil {
+		return saleKeys{}, err
+	}
+
+	r.cacheMutex.RLock()
+	keys := r.currentSaleKeys
+	r.cacheMutex.RUnlock()
+
+	// The cache may have been invalidated in the meantime
+	if keys.saleID != activeSaleID {
+		keys = r.newSaleKeys(activeSaleID)
+	}
+	return keys, nil
+}
+
+// IsConnectionError reports whether the error means Redis is unreachable
+// rather than the command itself failing
+func IsConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, redis.ErrPoolExhausted)
+}
+
+// parseCheckoutData parses the checkout data and checks that all required fields are set
+func parseCheckoutData(raw string) (*CheckoutData, error) {
+	var data CheckoutData
+	if err := json.Unmarshal([]byte(raw), &data); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedCheckoutData, err)
+	}
+	if data.UserID == "" || data.SaleID == "" || data.ItemID == "" || data.CreatedAt == "" {
+		return nil, fmt.Errorf("%w: missing required fields", ErrMalformedCheckoutData)
+	}
+	return &data, nil
 }
 
-// GetCheckoutCode retrieves a value from Redis
-func (r *RedisClient) GetCheckoutCode(ctx context.Context, code string) (string, error) {
+// GetCheckoutCode retrieves the checkout data of a code without consuming it.
+// Returns ErrCheckoutCodeNotFound if the code doesn't exist or has expired.
+func (r *RedisClient) GetCheckoutCode(ctx context.Context, code string) (*CheckoutData, error) {
 	logger := myLogger.FromContext(ctx, "redis")
 
 	conn := r.pool.Get()
 	defer conn.Close()
 
-	reply, err := redis.String(conn.Do("GET", code))
+	reply, err := redis.String(conn.Do("GET", r.checkoutKey(code)))
+	if err == redis.ErrNil {
+		logger.Debug("redis get | checkout code not found", "code", code)
+		return nil, ErrCheckoutCodeNotFound
+	}
 	if err != nil {
-		if err == redis.ErrNil {
-			logger.Debug("redis get | checkout code not found", "code", code)
-		} else {
-			logger.Error("redis get | failed to get checkout code", "error", err)
-		}
-		return "", err
+		logger.Error("redis get | failed to get checkout code", "error", err)
+		return nil, err
+	}
+
+	data, err := parseCheckoutData(reply)
+	if err != nil {
+		logger.Error("redis get | failed to parse checkout data", "code", code, "error", err)
+		return nil, err
 	}
 	logger.Debug("redis get | got checkout code", "code", code)
-	return reply, nil
+	return data, nil
+}
+
+// GetCodeTTL returns the remaining time to live of a checkout code in seconds.
+// Returns TTLKeyMissing if the code doesn't exist and TTLNoExpire if it has no expiration.
+func (r *RedisClient) GetCodeTTL(ctx context.Context, code string) (int, error) {
+	logger := myLogger.FromContext(ctx, "redis")
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	ttl, err := redis.Int(conn.Do("TTL", r.checkoutKey(code)))
+	if err != nil {
+		logger.Error("redis get | failed to get checkout code TTL", "error", err)
+		return 0, err
+	}
+	return ttl, nil
 }
 
-// SetCheckoutCode stores a value in Redis with expiration
-func (r *RedisClient) SetCheckoutCode(ctx context.Context, userID string, saleID string, itemID string, code string, expireSeconds int) error {
+// SetCheckoutCode stores the checkout data of a code in Redis with expiration and counts
+// it as an outstanding reservation of the sale. The creation time is set if it's empty.
+func (r *RedisClient) SetCheckoutCode(ctx context.Context, data CheckoutData, code string, expireSeconds int) error {
 	logger := myLogger.FromContext(ctx, "redis")
 
 	conn := r.pool.Get()
 	defer conn.Close()
 
+	if data.CreatedAt == "" {
+		data.CreatedAt = r.clock.Now().Format(time.RFC3339)
+	}
+
 	// SETEX = SET with EXpiration
-	jsonData, err := json.Marshal(map[string]string{"user_id": userID, "sale_id": saleID, "item_id": itemID, "created_at": time.Now().Format(time.RFC3339)})
+	jsonData, err := json.Marshal(data)
 	if err != nil {
 		logger.Error("redis set | failed to marshal checkout data", "error", err)
 		return err
 	}
-	_, err = conn.Do("SETEX", "checkout:"+code, expireSeconds, jsonData)
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+	if err := conn.Send("SETEX", r.checkoutKey(code), expireSeconds, jsonData); err != nil {
+		return err
+	}
+	if err := conn.Send("SADD", r.reservationsKey(data.SaleID), code); err != nil {
+		return err
+	}
+	if err := conn.Send("HSET", r.reservedByKey(data.SaleID), code, data.UserID); err != nil {
+		return err
+	}
+	// Lives as long as the other sale keys
+	if err := conn.Send("EXPIRE", r.reservationsKey(data.SaleID), 3600); err != nil {
+		return err
+	}
+	if err := conn.Send("EXPIRE", r.reservedByKey(data.SaleID), 3600); err != nil {
+		return err
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
 	if err != nil {
 		logger.Error("redis set | failed to set checkout code", "error", err)
 		return err
 	}
-	logger.Debug("redis set | set checkout code", "code", code, "user_id", userID)
-	return err
+	// A command failing inside the transaction doesn't fail the EXEC itself
+	for _, reply := range replies {
+		if replyErr, ok := reply.(redis.Error); ok {
+			logger.Error("redis set | failed to set checkout code", "error", replyErr)
+			return replyErr
+		}
+	}
+	logger.Debug("redis set | set checkout code", "code", code, "user_id", data.UserID)
+	return nil
 }
 
-// DecrementStock decrements a value (atomically!) in Redis and returns the new value
-// DECR return value AFTER decrementing
-// If it was 1, DECR will return 0
-// If it was 0, DECR will return -1 (then the stock is fully sold out!)
-func (r *RedisClient) DecrementStockFastFail(ctx context.Context) (int64, error) {
+// ExtendCheckoutCode resets the expiration of a checkout code to its TTL, capped so that
+// the code never outlives maxLifetime counted from its creation. Codes stored without
+// their TTL are extended by expireSeconds.
+// Returns ErrCheckoutCodeNotFound if the code doesn't exist anymore.
+func (r *RedisClient) ExtendCheckoutCode(ctx context.Context, code string, expireSeconds int, maxLifetime time.Duration) (time.Time, error) {
 	logger := myLogger.FromContext(ctx, "redis")
 
-	// Get the active sale ID
-	activeSaleID, err := r.GetActiveSaleID(ctx)
-	if err != nil {
-		logger.Error("redis decrement | failed to get active sale ID", "error", err)
-		return 0, err
-	}
-
 	conn := r.pool.Get()
 	defer conn.Close()
 
-	reply, err := redis.Int64(conn.Do("DECR", fmt.Sprintf("sale:%d:stock", activeSaleID)))
+	reply, err := redis.String(conn.Do("GET", r.checkoutKey(code)))
+	if err == redis.ErrNil {
+		logger.Debug("redis extend | checkout code not found", "code", code)
+		return time.Time{}, ErrCheckoutCodeNotFound
+	}
 	if err != nil {
-		logger.Error("redis decrement | failed to decrement stock", "error", err)
-		return 0, err
+		logger.Error("redis extend | failed to get checkout code", "error", err)
+		return time.Time{}, err
 	}
 
-	logger.Debug("redis decrement | decremented stock", "sale_id", activeSaleID, "stock", reply)
-	return reply, nil
-}
+	// The original creation time is kept inside the checkout data
+	data, err := parseCheckoutData(reply)
+	if err != nil {
+		logger.Error("redis extend | failed to parse checkout data", "code", code, "error", err)
+		return time.Time{}, err
+	}
+	createdAt, err := time.Parse(time.RFC3339, data.CreatedAt)
+	if err != nil {
+		logger.Error("redis extend | failed to parse checkout creation time", "error", err)
+		return time.Time{}, err
+	}
 
-// IncrementStockFastFail increments a value (atomically!) in Redis and returns the new value
-// INCR return value AFTER incrementing
-// If it was 0, INCR will return 1
-// If it was 1, INCR will return 2
-func (r *RedisClient) IncrementStockFastFail(ctx context.Context) (int64, error) {
-	logger := myLogger.FromContext(ctx, "redis")
+	if data.TTL > 0 {
+		expireSeconds = data.TTL
+	}
+	now := r.clock.Now()
+	ttl, err := extendedTTL(createdAt, now, time.Duration(expireSeconds)*time.Second, maxLifetime)
+	if err != nil {
+		logger.Debug("redis extend | checkout code reached max lifetime", "code", code, "created_at", createdAt)
+		return time.Time{}, err
+	}
+	expiresAt := now.Add(ttl)
 
-	// Get the active sale ID
-	activeSaleID, err := r.GetActiveSaleID(ctx)
+	// EXPIRE returns 0 if the key has expired in the meantime
+	updated, err := redis.Int(conn.Do("EXPIRE", r.checkoutKey(code), int(ttl.Seconds())))
 	if err != nil {
-		logger.Error("redis increment | failed to get active sale ID", "error", err)
-		return 0, err
+		logger.Error("redis extend | failed to extend checkout code", "error", err)
+		return time.Time{}, err
+	}
+	if updated == 0 {
+		return time.Time{}, ErrCheckoutCodeNotFound
 	}
 
-	conn := r.pool.Get()
-	defer conn.Close()
+	logger.Debug("redis extend | extended checkout code", "code", code, "expires_at", expiresAt)
+	return expiresAt, nil
+}
 
-	reply, err := redis.Int64(conn.Do("INCR", fmt.Sprintf("sale:%d:stock", activeSaleID)))
-	if err != nil {
-		logger.Error("redis increment | failed to increment stock", "error", err)
-		return 0, err
+// extendedTTL returns the TTL an extension at now gives a code created at createdAt:
+// its ttl, cut so that the code never outlives maxLifetime. Returns
+// ErrReservationLifetimeExceeded if less than a second of the lifetime is left.
+func extendedTTL(createdAt, now time.Time, ttl, maxLifetime time.Duration) (time.Duration, error) {
+	remaining := createdAt.Add(maxLifetime).Sub(now)
+	if remaining < time.Second {
+		return 0, ErrReservationLifetimeExceeded
 	}
+	return min(ttl, remaining), nil
+}
 
-	logger.Debug("redis increment | incremented stock", "sale_id", activeSaleID, "stock", reply)
-	return reply, nil
+// WarmUp opens and pings up to n pool connections and returns them to the pool idle,
+// so the first requests don't each pay for a dial. n is bounded by the pool size.
+// Returns the number of connections warmed, which is less than n on error.
+func (r *RedisClient) WarmUp(ctx context.Context, n int) (int, error) {
+	n = min(n, r.pool.MaxActive, r.pool.MaxIdle)
+
+	// All connections are held at once, a released one would just be borrowed again
+	conns := make([]redis.Conn, 0, n)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	for range n {
+		if err := ctx.Err(); err != nil {
+			return len(conns), err
+		}
+		conn := r.pool.Get()
+		if _, err := conn.Do("PING"); err != nil {
+			conn.Close()
+			return len(conns), err
+		}
+		conns = append(conns, conn)
+	}
+	return len(conns), nil
 }
 
 // HealthCheck checks if the Redis connection is alive
 func (r *RedisClient) HealthCheck(ctx context.Context) error {
 	logger := myLogger.FromContext(ctx, "redis")
 
-	conn := r.pool.Get()
+	// Both waits honour the context, so a hung Redis can't outlast the caller's deadline
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		logger.Error("redis health check | failed to get connection", "error", err)
+		return err
+	}
 	defer conn.Close()
 
-	_, err := conn.Do("PING")
+	_, err = redis.DoContext(conn, ctx, "PING")
 	if err != nil {
 		logger.Error("redis health check | failed to ping Redis", "error", err)
 		return err
@@ -160,57 +452,116 @@ func (r *RedisClient) HealthCheck(ctx context.Context) error {
 	return err
 }
 
-// GetUserCheckoutCount returns the number of items the user has checked out
+// GetUserCheckoutCount returns the number of items the user has checked out.
+// A user without checkouts has no count key yet, which reads as 0.
 func (r *RedisClient) GetUserCheckoutCount(ctx context.Context, userID string) (int64, error) {
 	logger := myLogger.FromContext(ctx, "redis")
 
+	keys, err := r.activeSaleKeys(ctx)
+	if err != nil {
+		logger.Error("redis get | failed to get active sale ID", "error", err)
+		return 0, err
+	}
+
 	conn := r.pool.Get()
 	defer conn.Close()
 
-	reply, err := redis.Int64(conn.Do("GET", "sale:current:user:"+userID+":count"))
+	reply, err := redis.Int64(conn.Do("GET", keys.userCountKey(userID)))
+	if err == redis.ErrNil {
+		logger.Debug("redis get | user has no checkouts", "user_id", userID)
+		return 0, nil
+	}
 	if err != nil {
-		if err != redis.ErrNil {
-			logger.Error("redis get | failed to get user checkout count", "error", err)
-		}
+		logger.Error("redis get | failed to get user checkout count", "error", err)
 		return 0, err
 	}
 	logger.Debug("redis get | got user checkout count", "user_id", userID, "count", reply)
 	return reply, nil
 }
 
-// IncrementUserCheckoutCount increments the number of items the user has checked out
-func (r *RedisClient) IncrementUserCheckoutCount(ctx context.Context, userID string) (int64, error) {
+// GetUserCheckoutCounts returns the checkout counts of all users in the current sale
+func (r *RedisClient) GetUserCheckoutCounts(ctx context.Context) (map[string]int64, error) {
 	logger := myLogger.FromContext(ctx, "redis")
 
+	saleKeys, err := r.activeSaleKeys(ctx)
+	if err != nil {
+		logger.Error("redis scan | failed to get active sale ID", "error", err)
+		return nil, err
+	}
+
 	conn := r.pool.Get()
 	defer conn.Close()
 
-	count, err := redis.Int64(conn.Do("INCR", "sale:current:user:"+userID+":count"))
-	if err != nil {
-		logger.Error("redis increment | failed to increment user checkout count", "error", err)
-		return 0, err
+	// SCAN doesn't block Redis like KEYS does on many users
+	counts := make(map[string]int64)
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", saleKeys.userCountPrefix+"*:count", "COUNT", 1000))
+		if err != nil {
+			logger.Error("redis scan | failed to scan user count keys", "error", err)
+			return nil, err
+		}
+		cursor, _ = redis.Int(reply[0], nil)
+		keys, _ := redis.Strings(reply[1], nil)
+
+		if len(keys) > 0 {
+			args := make([]interface{}, len(keys))
+			for i, key := range keys {
+				args[i] = key
+			}
+			values, err := redis.Int64s(conn.Do("MGET", args...))
+			if err != nil {
+				logger.Error("redis get | failed to get user checkout counts", "error", err)
+				return nil, err
+			}
+			for i, key := range keys {
+				userID := strings.TrimSuffix(strings.TrimPrefix(key, saleKeys.userCountPrefix), ":count")
+				counts[userID] = values[i]
+			}
+		}
+
+		if cursor == 0 {
+			return counts, nil
+		}
 	}
-	logger.Debug("redis increment | incremented user checkout count", "user_id", userID, "count", count)
-	return count, nil
 }
 
-// DecrementUserCheckoutCount decrements the number of items the user has checked out
-func (r *RedisClient) DecrementUserCheckoutCount(ctx context.Context, userID string) error {
+// ResetUserCheckoutCount deletes the checkout count of the user in the current sale
+// and returns the count it had
+func (r *RedisClient) ResetUserCheckoutCount(ctx context.Context, userID string) (int64, error) {
 	logger := myLogger.FromContext(ctx, "redis")
 
+	keys, err := r.activeSaleKeys(ctx)
+	if err != nil {
+		logger.Error("redis reset | failed to get active sale ID", "error", err)
+		return 0, err
+	}
+
 	conn := r.pool.Get()
 	defer conn.Close()
 
-	_, err := conn.Do("DECR", "sale:current:user:"+userID+":count")
+	key := keys.userCountKey(userID)
+	conn.Send("MULTI")
+	conn.Send("GET", key)
+	conn.Send("DEL", key)
+	reply, err := redis.Values(conn.Do("EXEC"))
 	if err != nil {
-		logger.Error("redis decrement | failed to decrement user checkout count", "error", err)
-		return err
+		logger.Error("redis reset | failed to reset user checkout count", "error", err)
+		return 0, err
 	}
-	logger.Debug("redis decrement | decremented user checkout count", "user_id", userID)
-	return err
+
+	previous, err := redis.Int64(reply[0], nil)
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	logger.Info("redis reset | reset user checkout count", "user_id", userID, "previous_count", previous)
+	return previous, nil
 }
 
-// GetSaleCurrentID returns the current sale ID
+// GetSaleCurrentID returns the current sale ID, empty if the active sale is closed
 func (r *RedisClient) GetSaleCurrentID(ctx context.Context) (string, error) {
 	logger := myLogger.FromContext(ctx, "redis")
 
@@ -224,7 +575,12 @@ func (r *RedisClient) GetSaleCurrentID(ctx context.Context) (string, error) {
 	conn := r.pool.Get()
 	defer conn.Close()
 
-	reply, err := redis.String(conn.Do("GET", fmt.Sprintf("sale:%d:id", activeSaleID)))
+	reply, err := redis.String(conn.Do("GET", r.saleKey(activeSaleID, "id")))
+	if err == redis.ErrNil {
+		// The sale was closed or its ID key expired, either way it takes no checkouts
+		logger.Debug("redis get | sale is closed", "sale_id", activeSaleID)
+		return "", nil
+	}
 	if err != nil {
 		logger.Error("redis get | failed to get sale current ID", "error", err)
 		return "", err
@@ -239,7 +595,7 @@ func (r *RedisClient) GetSaleCurrentStock(ctx context.Context) (int64, error) {
 	logger := myLogger.FromContext(ctx, "redis")
 
 	// Get the active sale ID
-	activeSaleID, err := r.GetActiveSaleID(ctx)
+	keys, err := r.activeSaleKeys(ctx)
 	if err != nil {
 		logger.Error("redis get | failed to get active sale ID", "error", err)
 		return 0, err
@@ -248,105 +604,212 @@ func (r *RedisClient) GetSaleCurrentStock(ctx context.Context) (int64, error) {
 	conn := r.pool.Get()
 	defer conn.Close()
 
-	reply, err := redis.Int64(conn.Do("GET", fmt.Sprintf("sale:%d:stock", activeSaleID)))
+	reply, err := redis.Int64(conn.Do("GET", keys.stock))
 	if err != nil {
 		logger.Error("redis get | failed to get sale current stock", "error", err)
 		return 0, err
 	}
-	logger.Debug("redis get | got sale current stock", "sale_id", activeSaleID, "stock", reply)
+	logger.Debug("redis get | got sale current stock", "sale_id", keys.saleID, "stock", reply)
 	return reply, nil
 }
 
-// DeleteCode deletes a checkout code from Redis to prevent reuse
-func (r *RedisClient) DeleteCode(ctx context.Context, code string) error {
+// addSaleStockScript adds stock to a sale, keeping its stock counters consistent.
+// Returns nil if the sale keys don't exist.
+var addSaleStockScript = redis.NewScript(4, `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return false
+end
+local stock = redis.call('INCRBY', KEYS[1], ARGV[1])
+local initial = redis.call('INCRBY', KEYS[2], ARGV[1])
+local added = redis.call('INCRBY', KEYS[3], ARGV[1])
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[3], ttl)
+end
+local cap = 0
+if redis.call('EXISTS', KEYS[4]) == 1 then
+	cap = redis.call('INCRBY', KEYS[4], ARGV[1])
+end
+return {stock, initial, added, cap}
+`)
+
+// AddSaleStock atomically raises the stock of a sale by amount, and its item cap by
+// the same amount so the added stock can be sold.
+// Returns ErrSaleKeysNotFound if the sale keys don't exist.
+func (r *RedisClient) AddSaleStock(ctx context.Context, saleID int, amount int) (StockTotals, error) {
 	logger := myLogger.FromContext(ctx, "redis")
 
 	conn := r.pool.Get()
 	defer conn.Close()
 
-	_, err := conn.Do("DEL", "checkout:"+code)
+	reply, err := redis.Int64s(r.runScript(ctx, conn, addSaleStockScript,
+		r.saleKey(saleID, "stock"),
+		r.saleKey(saleID, "initial_stock"),
+		r.saleKey(saleID, "added_stock"),
+		r.saleKey(saleID, "item_cap"),
+		amount,
+	))
+	if err == redis.ErrNil {
+		logger.Debug("redis add stock | sale keys not found", "sale_id", saleID)
+		return StockTotals{}, ErrSaleKeysNotFound
+	}
 	if err != nil {
-		logger.Error("redis delete | failed to delete checkout code", "error", err)
-		return err
+		logger.Error("redis add stock | failed to add sale stock", "sale_id", saleID, "error", err)
+		return StockTotals{}, err
 	}
-	logger.Debug("redis delete | deleted checkout code", "code", code)
-	return err
+
+	totals := StockTotals{Stock: reply[0], InitialStock: reply[1], AddedStock: reply[2], ItemCap: reply[3]}
+	logger.Info("redis add stock | added sale stock", "sale_id", saleID, "amount", amount, "stock", totals.Stock)
+	return totals, nil
 }
 
-// GetItemsSoldCount returns the number of items sold
-func (r *RedisClient) GetItemsSoldCount(ctx context.Context) (int64, error) {
+// GetSaleInitialStock returns the stock the active sale was created with.
+// Used to detect drift between the stock and items sold counters.
+func (r *RedisClient) GetSaleInitialStock(ctx context.Context) (int64, error) {
 	logger := myLogger.FromContext(ctx, "redis")
 
 	// Get the active sale ID
 	activeSaleID, err := r.GetActiveSaleID(ctx)
 	if err != nil {
+		logger.Error("redis get | failed to get active sale ID", "error", err)
 		return 0, err
 	}
 
 	conn := r.pool.Get()
 	defer conn.Close()
 
-	soldKey := fmt.Sprintf("sale:%d:items_sold", activeSaleID)
-
-	reply, err := redis.Int64(conn.Do("GET", soldKey))
+	reply, err := redis.Int64(conn.Do("GET", r.saleKey(activeSaleID, "initial_stock")))
 	if err != nil {
-		if err != redis.ErrNil {
-			logger.Error("redis get | failed to get items sold count", "error", err)
-		}
+		logger.Error("redis get | failed to get sale initial stock", "error", err)
 		return 0, err
 	}
-	logger.Debug("redis get | got items sold count", "sale_id", activeSaleID, "count", reply)
+	logger.Debug("redis get | got sale initial stock", "sale_id", activeSaleID, "initial_stock", reply)
 	return reply, nil
 }
 
-// IncrementItemsSoldCount increments the number of items sold
-func (r *RedisClient) IncrementItemsSoldCount(ctx context.Context) (int64, error) {
+// GetSaleStartedAt returns when the active sale started.
+// Returns a zero time if the sale has no start time key.
+func (r *RedisClient) GetSaleStartedAt(ctx context.Context) (time.Time, error) {
 	logger := myLogger.FromContext(ctx, "redis")
 
 	// Get the active sale ID
 	activeSaleID, err := r.GetActiveSaleID(ctx)
 	if err != nil {
-		logger.Error("redis increment | failed to get active sale ID", "error", err)
-		return 0, err
+		logger.Error("redis get | failed to get active sale ID", "error", err)
+		return time.Time{}, err
+	}
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	reply, err := redis.Int64(conn.Do("GET", r.saleKey(activeSaleID, "started_at")))
+	if err == redis.ErrNil {
+		logger.Debug("redis get | sale has no start time", "sale_id", activeSaleID)
+		return time.Time{}, nil
+	}
+	if err != nil {
+		logger.Error("redis get | failed to get sale start time", "error", err)
+		return time.Time{}, err
 	}
+	logger.Debug("redis get | got sale start time", "sale_id", activeSaleID, "started_at", reply)
+	return time.Unix(reply, 0), nil
+}
+
+// GetSaleEndedAt returns when the last closed sale was closed. It doesn't depend on the
+// active sale pointer, which is gone once an ended sale was purged.
+// Returns a zero time if no sale was closed within the hour.
+func (r *RedisClient) GetSaleEndedAt(ctx context.Context) (time.Time, error) {
+	logger := myLogger.FromContext(ctx, "redis")
 
-	// Increment the items sold count
 	conn := r.pool.Get()
 	defer conn.Close()
 
-	soldKey := fmt.Sprintf("sale:%d:items_sold", activeSaleID)
+	reply, err := redis.Int64(conn.Do("GET", r.keyPrefix+"sale:current:ended_at"))
+	if err == redis.ErrNil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		logger.Error("redis get | failed to get sale end time", "error", err)
+		return time.Time{}, err
+	}
+	return time.Unix(reply, 0), nil
+}
+
+// GetItemsSoldCount returns the number of items sold.
+// A missing items sold key reads as 0.
+func (r *RedisClient) GetItemsSoldCount(ctx context.Context) (int64, error) {
+	logger := myLogger.FromContext(ctx, "redis")
 
-	reply, err := redis.Int64(conn.Do("INCR", soldKey))
+	// Get the active sale ID
+	keys, err := r.activeSaleKeys(ctx)
 	if err != nil {
-		logger.Error("redis increment | failed to increment items sold count", "error", err)
 		return 0, err
 	}
 
-	logger.Info("redis increment | incremented items sold count", "sale_id", activeSaleID, "count", reply)
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	reply, err := redis.Int64(conn.Do("GET", keys.itemsSold))
+	if err == redis.ErrNil {
+		logger.Debug("redis get | no items sold yet", "sale_id", keys.saleID)
+		return 0, nil
+	}
+	if err != nil {
+		logger.Error("redis get | failed to get items sold count", "error", err)
+		return 0, err
+	}
+	logger.Debug("redis get | got items sold count", "sale_id", keys.saleID, "count", reply)
 	return reply, nil
 }
 
-// DecrementItemsSoldCount decrements the number of items sold
-func (r *RedisClient) DecrementItemsSoldCount(ctx context.Context) error {
+// GetSaleItemsSoldCount returns the number of items sold of the given sale,
+// or ErrSaleKeysNotFound if the sale keys have already expired
+func (r *RedisClient) GetSaleItemsSoldCount(ctx context.Context, saleID int) (int64, error) {
 	logger := myLogger.FromContext(ctx, "redis")
 
-	// Get the active sale ID
-	activeSaleID, err := r.GetActiveSaleID(ctx)
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	reply, err := redis.Int64(conn.Do("GET", r.saleKey(saleID, "items_sold")))
+	if err == redis.ErrNil {
+		logger.Debug("redis get | items sold key not found", "sale_id", saleID)
+		return 0, ErrSaleKeysNotFound
+	}
 	if err != nil {
-		logger.Error("redis decrement | failed to get active sale ID", "error", err)
-		return err
+		logger.Error("redis get | failed to get items sold count", "sale_id", saleID, "error", err)
+		return 0, err
 	}
+	logger.Debug("redis get | got items sold count", "sale_id", saleID, "count", reply)
+	return reply, nil
+}
+
+// GetSaleCounters returns the counters of the sale, e.g. to report on it once it ended.
+// Returns ErrSaleKeysNotFound if its items sold key doesn't exist.
+func (r *RedisClient) GetSaleCounters(ctx context.Context, saleID int) (SaleCounters, error) {
+	logger := myLogger.FromContext(ctx, "redis")
 
 	conn := r.pool.Get()
 	defer conn.Close()
 
-	_, err = conn.Do("DECR", fmt.Sprintf("sale:%d:items_sold", activeSaleID))
+	reply, err := redis.Values(conn.Do("MGET",
+		r.saleKey(saleID, "initial_stock"), r.saleKey(saleID, "items_sold"), r.saleKey(saleID, "started_at"),
+		r.saleKey(saleID, "item_cap")))
 	if err != nil {
-		logger.Error("redis decrement | failed to decrement items sold count", "error", err)
-		return err
+		logger.Error("redis get | failed to get sale counters", "sale_id", saleID, "error", err)
+		return SaleCounters{}, err
 	}
-	logger.Debug("redis decrement | decremented items sold count", "sale_id", activeSaleID)
-	return err
+	if reply[1] == nil {
+		return SaleCounters{}, ErrSaleKeysNotFound
+	}
+
+	var counters SaleCounters
+	counters.ItemsSold, _ = redis.Int64(reply[1], nil)
+	counters.InitialStock, _ = redis.Int64(reply[0], nil)
+	counters.ItemCap, _ = redis.Int64(reply[3], nil)
+	if startedAt, err := redis.Int64(reply[2], nil); err == nil {
+		counters.StartedAt = time.Unix(startedAt, 0)
+	}
+	return counters, nil
 }
 
 // getActiveSaleID returns the ID of the active sale
@@ -366,7 +829,7 @@ func (r *RedisClient) GetActiveSaleID(ctx context.Context) (int, error) {
 	defer conn.Close()
 
 	// Get active sale ID from pointer
-	activeSaleID, err := redis.Int(conn.Do("GET", "sale:current:active_sale"))
+	activeSaleID, err := redis.Int(conn.Do("GET", r.keyPrefix+"sale:current:active_sale"))
 	if err != nil {
 		logger.Error("redis get | no active sale found", "error", err)
 		return 0, fmt.Errorf("no active sale found: %v", err)
@@ -376,63 +839,168 @@ func (r *RedisClient) GetActiveSaleID(ctx context.Context) (int, error) {
 	// Cache the active sale ID
 	r.cacheMutex.Lock()
 	r.currentSaleID = activeSaleID
+	r.currentSaleKeys = r.newSaleKeys(activeSaleID)
 	r.cachedSaleTime = time.Now()
 	r.cacheMutex.Unlock()
 	return activeSaleID, nil
 }
 
-// CleanupOldSaleData cleans up the old sale data
-func (r *RedisClient) CleanupOldSaleData(ctx context.Context) error {
+// CachedSaleID returns the cached active sale ID and when it was cached.
+// A zero ID means nothing is cached.
+func (r *RedisClient) CachedSaleID() (int, time.Time) {
+	r.cacheMutex.RLock()
+	defer r.cacheMutex.RUnlock()
+	return r.currentSaleID, r.cachedSaleTime
+}
+
+// InvalidateSaleCache drops the cached active sale ID, so the next
+// GetActiveSaleID call reads the pointer from Redis
+func (r *RedisClient) InvalidateSaleCache() {
+	r.cacheMutex.Lock()
+	r.currentSaleID = 0
+	r.currentSaleKeys = saleKeys{}
+	r.cachedSaleTime = time.Time{}
+	r.cacheMutex.Unlock()
+}
+
+// CleanupOldSaleData deletes the user checkout counts and checkout codes of every
+// sale but the active one. Keys are SCANned in small batches, so it is safe to run
+// while the active sale takes traffic, just slow on large keyspaces.
+func (r *RedisClient) CleanupOldSaleData(ctx context.Context, activeSaleID int) error {
 	logger := myLogger.FromContext(ctx, "redis")
 
 	conn := r.pool.Get()
 	defer conn.Close()
 
-	// Delete all user count keys
-	userKeys, err := redis.Strings(conn.Do("KEYS", "sale:current:user:*:count"))
-	if err != nil {
-		return fmt.Errorf("failed to get user count keys: %v", err)
-	}
+	activeUserCountPrefix := r.newSaleKeys(activeSaleID).userCountPrefix
 
-	if len(userKeys) > 0 {
-		// Convert to []interface{} for DEL command
-		args := make([]interface{}, len(userKeys))
-		for i, key := range userKeys {
-			args[i] = key
+	// User counts carry their sale ID in the key
+	userKeys, err := r.scanAndDelete(ctx, conn, r.keyPrefix+"sale:*:user:*:count", func(keys []string) ([]string, error) {
+		var old []string
+		for _, key := range keys {
+			if !strings.HasPrefix(key, activeUserCountPrefix) {
+				old = append(old, key)
+			}
 		}
-		_, err = conn.Do("DEL", args...)
-		if err != nil {
-			return fmt.Errorf("failed to delete user count keys: %v", err)
+		return old, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete user count keys: %v", err)
+	}
+	logger.Info("redis cleanup | deleted user count keys", "count", userKeys)
+
+	// So do the reservation sets
+	activeReservations := r.newSaleKeys(activeSaleID).reservations
+	reservationKeys, err := r.scanAndDelete(ctx, conn, r.keyPrefix+"sale:*:reservations", func(keys []string) ([]string, error) {
+		var old []string
+		for _, key := range keys {
+			if key != activeReservations {
+				old = append(old, key)
+			}
 		}
-		logger.Info("redis cleanup | deleted user count keys", "count", len(userKeys))
+		return old, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete reservation keys: %v", err)
 	}
-
-	// Delete all checkout code keys
-	checkoutKeys, err := redis.Strings(conn.Do("KEYS", "checkout:*"))
+	logger.Info("redis cleanup | deleted reservation keys", "count", reservationKeys)
+
+	// And the users holding the reservations
+	activeReservedBy := r.newSaleKeys(activeSaleID).reservedBy
+	reservedByKeys, err := r.scanAndDelete(ctx, conn, r.keyPrefix+"sale:*:reserved_by", func(keys []string) ([]string, error) {
+		var old []string
+		for _, key := range keys {
+			if key != activeReservedBy {
+				old = append(old, key)
+			}
+		}
+		return old, nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to get checkout keys: %v", err)
+		return fmt.Errorf("failed to delete reserved by keys: %v", err)
 	}
+	logger.Info("redis cleanup | deleted reserved by keys", "count", reservedByKeys)
 
-	if len(checkoutKeys) > 0 {
-		// Convert to []interface{} for DEL command
-		args := make([]interface{}, len(checkoutKeys))
-		for i, key := range checkoutKeys {
+	// Checkout codes carry it in their data
+	activeSaleIDStr := strconv.Itoa(activeSaleID)
+	checkoutKeys, err := r.scanAndDelete(ctx, conn, r.keyPrefix+"checkout:*", func(keys []string) ([]string, error) {
+		args := make([]interface{}, len(keys))
+		for i, key := range keys {
 			args[i] = key
 		}
-		_, err = conn.Do("DEL", args...)
+		values, err := redis.Strings(conn.Do("MGET", args...))
 		if err != nil {
-			return fmt.Errorf("failed to delete checkout keys: %v", err)
+			return nil, err
+		}
+		var old []string
+		for i, value := range values {
+			if value == "" {
+				continue // purchased or expired since the scan
+			}
+			data, err := parseCheckoutData(value)
+			if err != nil || data.SaleID != activeSaleIDStr {
+				old = append(old, keys[i])
+			}
 		}
-		logger.Info("redis cleanup | deleted checkout keys", "count", len(checkoutKeys))
+		return old, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete checkout keys: %v", err)
 	}
+	logger.Info("redis cleanup | deleted checkout keys", "count", checkoutKeys)
 
-	logger.Info("redis cleanup | cleanup completed successfully")
+	logger.Info("redis cleanup | cleanup completed successfully", "active_sale_id", activeSaleID)
 	return nil
 }
 
-// createNewSaleKeys creates versioned sale keys for a new sale
-func (r *RedisClient) CreateNewSaleKeys(ctx context.Context, newSaleID int) error {
-	logger := myLogger.FromContext(ctx, "redis")
+// scanAndDelete SCANs the keys matching the pattern and deletes the ones selected
+// by the filter, batch by batch. Returns the number of deleted keys.
+func (r *RedisClient) scanAndDelete(ctx context.Context, conn redis.Conn, pattern string, filter func([]string) ([]string, error)) (int, error) {
+	deleted := 0
+	cursor := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 500))
+		if err != nil {
+			return deleted, err
+		}
+		cursor, _ = redis.Int(reply[0], nil)
+		keys, _ := redis.Strings(reply[1], nil)
+
+		if len(keys) > 0 {
+			selected, err := filter(keys)
+			if err != nil {
+				return deleted, err
+			}
+			if len(selected) > 0 {
+				args := make([]interface{}, len(selected))
+				for i, key := range selected {
+					args[i] = key
+				}
+				if _, err := conn.Do("DEL", args...); err != nil {
+					return deleted, err
+				}
+				deleted += len(selected)
+			}
+		}
+
+		if cursor == 0 {
+			return deleted, nil
+		}
+	}
+}
+
+// CreateNewSaleKeys creates versioned sale keys for a new sale, which sells at most
+// itemCap items. A sale without stock would be sold out from the start, so it is refused.
+func (r *RedisClient) CreateNewSaleKeys(ctx context.Context, newSaleID int, initialStock int, itemCap int) error {
+	logger := myLogger.FromContext(ctx, "redis")
+
+	if initialStock <= 0 {
+		return fmt.Errorf("invalid initial stock %d for sale %d", initialStock, newSaleID)
+	}
 
 	conn := r.pool.Get()
 	defer conn.Close()
@@ -443,22 +1011,32 @@ func (r *RedisClient) CreateNewSaleKeys(ctx context.Context, newSaleID int) erro
 	}
 
 	// Create versioned sale keys (1 hour TTL)
-	err = conn.Send("SETEX", fmt.Sprintf("sale:%d:id", newSaleID), 3600, newSaleID)
+	err = conn.Send("SETEX", r.saleKey(newSaleID, "id"), 3600, newSaleID)
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("SETEX", r.saleKey(newSaleID, "stock"), 3600, initialStock)
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("SETEX", r.saleKey(newSaleID, "initial_stock"), 3600, initialStock)
 	if err != nil {
 		return err
 	}
 
-	err = conn.Send("SETEX", fmt.Sprintf("sale:%d:stock", newSaleID), 3600, 10000)
+	err = conn.Send("SETEX", r.saleKey(newSaleID, "items_sold"), 3600, 0)
 	if err != nil {
 		return err
 	}
 
-	err = conn.Send("SETEX", fmt.Sprintf("sale:%d:items_sold", newSaleID), 3600, 0)
+	err = conn.Send("SETEX", r.saleKey(newSaleID, "item_cap"), 3600, itemCap)
 	if err != nil {
 		return err
 	}
 
-	err = conn.Send("SETEX", fmt.Sprintf("sale:%d:started_at", newSaleID), 3600, time.Now().Unix())
+	err = conn.Send("SETEX", r.saleKey(newSaleID, "started_at"), 3600, r.clock.Now().Unix())
 	if err != nil {
 		return err
 	}
@@ -468,72 +1046,685 @@ func (r *RedisClient) CreateNewSaleKeys(ctx context.Context, newSaleID int) erro
 		return err
 	}
 
-	logger.Info("redis creation | created versioned sale keys for sale ID", "sale_id", newSaleID)
+	logger.Info("redis creation | created versioned sale keys for sale ID", "sale_id", newSaleID, "initial_stock", initialStock)
+	return nil
+}
+
+// RestoreSaleKeys recreates the keys of a sale that are missing, e.g. after Redis lost
+// them, and leaves the existing ones untouched so a resumed sale keeps its counters.
+// initialStock includes the addedStock, as AddSaleStock counts it.
+// Returns the names of the restored keys.
+func (r *RedisClient) RestoreSaleKeys(ctx context.Context, saleID int, initialStock int64, addedStock int64, itemCap int64, itemsSold int64, startedAt time.Time) ([]string, error) {
+	logger := myLogger.FromContext(ctx, "redis")
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	values := []struct {
+		name  string
+		value interface{}
+	}{
+		{"id", saleID},
+		{"stock", max(initialStock-itemsSold, 0)},
+		{"initial_stock", initialStock},
+		{"items_sold", itemsSold},
+		{"item_cap", itemCap},
+		{"started_at", startedAt.Unix()},
+	}
+	if addedStock > 0 {
+		values = append(values, struct {
+			name  string
+			value interface{}
+		}{"added_stock", addedStock})
+	}
+
+	if err := conn.Send("MULTI"); err != nil {
+		return nil, err
+	}
+	for _, v := range values {
+		if err := conn.Send("SET", r.saleKey(saleID, v.name), v.value, "EX", 3600, "NX"); err != nil {
+			return nil, err
+		}
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		logger.Error("redis restore | failed to restore sale keys", "sale_id", saleID, "error", err)
+		return nil, err
+	}
+
+	// SET NX replies nil for the keys that exist already
+	var restored []string
+	for i, reply := range replies {
+		if reply != nil {
+			restored = append(restored, values[i].name)
+		}
+	}
+	logger.Info("redis restore | restored missing sale keys", "sale_id", saleID, "restored", restored)
+	return restored, nil
+}
+
+// SetSaleItemIDs stores the item IDs that can be checked out in the sale
+func (r *RedisClient) SetSaleItemIDs(ctx context.Context, saleID int, itemIDs []int64) error {
+	logger := myLogger.FromContext(ctx, "redis")
+
+	if len(itemIDs) == 0 {
+		return nil
+	}
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	key := r.saleKey(saleID, "item_ids")
+	args := make([]interface{}, 0, len(itemIDs)+1)
+	args = append(args, key)
+	for _, itemID := range itemIDs {
+		args = append(args, itemID)
+	}
+
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+	if err := conn.Send("DEL", key); err != nil {
+		return err
+	}
+	if err := conn.Send("SADD", args...); err != nil {
+		return err
+	}
+	if err := conn.Send("EXPIRE", key, 3600); err != nil {
+		return err
+	}
+	if _, err := conn.Do("EXEC"); err != nil {
+		logger.Error("redis set | failed to set sale item IDs", "sale_id", saleID, "error", err)
+		return err
+	}
+
+	logger.Info("redis set | set sale item IDs", "sale_id", saleID, "count", len(itemIDs))
 	return nil
 }
 
+// GetSaleItemIDs returns the item IDs that can be checked out in the sale, empty if any ID is valid
+func (r *RedisClient) GetSaleItemIDs(ctx context.Context, saleID int) ([]string, error) {
+	logger := myLogger.FromContext(ctx, "redis")
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	reply, err := redis.Strings(conn.Do("SMEMBERS", r.saleKey(saleID, "item_ids")))
+	if err != nil {
+		logger.Error("redis get | failed to get sale item IDs", "sale_id", saleID, "error", err)
+		return nil, err
+	}
+	logger.Debug("redis get | got sale item IDs", "sale_id", saleID, "count", len(reply))
+	return reply, nil
+}
+
+// SetSaleItem stores the item name and image URL of the sale, so the request paths
+// don't need Postgres to read them. Postgres stays the system of record.
+func (r *RedisClient) SetSaleItem(ctx context.Context, saleID int, itemName string, imageURL string) error {
+	logger := myLogger.FromContext(ctx, "redis")
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+	if err := conn.Send("SETEX", r.saleKey(saleID, "item_name"), 3600, itemName); err != nil {
+		return err
+	}
+	if err := conn.Send("SETEX", r.saleKey(saleID, "image_url"), 3600, imageURL); err != nil {
+		return err
+	}
+	if _, err := conn.Do("EXEC"); err != nil {
+		logger.Error("redis set | failed to set sale item", "sale_id", saleID, "error", err)
+		return err
+	}
+
+	logger.Debug("redis set | set sale item", "sale_id", saleID, "item_name", itemName)
+	return nil
+}
+
+// GetSaleItem returns the item name and image URL of the sale.
+// Returns ErrSaleItemNotFound if they aren't stored.
+func (r *RedisClient) GetSaleItem(ctx context.Context, saleID int) (string, string, error) {
+	logger := myLogger.FromContext(ctx, "redis")
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	reply, err := redis.Values(conn.Do("MGET", r.saleKey(saleID, "item_name"), r.saleKey(saleID, "image_url")))
+	if err != nil {
+		logger.Error("redis get | failed to get sale item", "sale_id", saleID, "error", err)
+		return "", "", err
+	}
+	if reply[0] == nil {
+		return "", "", ErrSaleItemNotFound
+	}
+	itemName, _ := redis.String(reply[0], nil)
+	imageURL, _ := redis.String(reply[1], nil)
+	return itemName, imageURL, nil
+}
+
 // Close closes the Redis connection
 func (r *RedisClient) Close() error {
 	return r.pool.Close()
 }
 
-// GetAndDeleteCheckoutCodeAtomically gets the checkout code and deletes it atomically
-func (r *RedisClient) GetAndDeleteCheckoutCodeAtomically(ctx context.Context, code string) (string, error) {
+// GetAndDeleteCheckoutCodeAtomically gets the checkout code and deletes it atomically.
+// Returns nil data if the code doesn't exist and ErrCheckoutCodeContention if it was
+// modified while being read, the caller may retry. Malformed data is not deleted so it
+// can be investigated.
+func (r *RedisClient) GetAndDeleteCheckoutCodeAtomically(ctx context.Context, code string) (*CheckoutData, error) {
 	logger := myLogger.FromContext(ctx, "redis")
 
 	conn := r.pool.Get()
 	defer conn.Close()
 
 	// Step 1 - Watch the checkout code
-	_, err := conn.Do("WATCH", "checkout:"+code)
+	_, err := conn.Do("WATCH", r.checkoutKey(code))
 	if err != nil {
 		logger.Error("redis get and delete | failed to watch checkout code", "error", err)
-		return "", err
+		return nil, err
 	}
 
 	// Step 2 - Get the data
-	data, err := redis.String(conn.Do("GET", "checkout:"+code))
+	data, err := redis.String(conn.Do("GET", r.checkoutKey(code)))
 	if err == redis.ErrNil {
 		logger.Debug("redis get and delete | checkout code not found", "code", code)
-		return "", nil
+		return nil, nil
 	}
 	if err != nil {
 		logger.Error("redis get and delete | failed to get checkout code", "error", err)
-		return "", err
+		return nil, err
+	}
+
+	// Step 2.1 - Validate the data before deleting it
+	checkoutData, err := parseCheckoutData(data)
+	if err != nil {
+		logger.Error("redis get and delete | malformed checkout data, keeping code for investigation", "code", code, "data", data, "error", err)
+		conn.Do("UNWATCH")
+		return nil, err
 	}
 
 	// Step 3 - Start MULTI
 	err = conn.Send("MULTI")
 	if err != nil {
 		logger.Error("redis get and delete | failed to start MULTI", "error", err)
-		return "", err
+		return nil, err
 	}
 
 	// Step 4 - Queue delete
-	err = conn.Send("DEL", "checkout:"+code)
+	err = conn.Send("DEL", r.checkoutKey(code))
 	if err != nil {
 		logger.Error("redis get and delete | failed to queue delete", "error", err)
-		return "", err
+		return nil, err
+	}
+	err = conn.Send("SREM", r.reservationsKey(checkoutData.SaleID), code)
+	if err != nil {
+		logger.Error("redis get and delete | failed to queue reservation removal", "error", err)
+		return nil, err
+	}
+	err = conn.Send("HDEL", r.reservedByKey(checkoutData.SaleID), code)
+	if err != nil {
+		logger.Error("redis get and delete | failed to queue reservation removal", "error", err)
+		return nil, err
 	}
 
 	// Step 5 - Execute
 	reply, err := conn.Do("EXEC")
 	if err != nil {
 		logger.Error("redis get and delete | failed to execute", "error", err)
-		return "", err
+		return nil, err
 	}
 
 	// Step 6 - Check if transaction was successful
 	if reply == nil {
-		logger.Warn("redis get and delete | transaction failed - concurrent access", "code", code)
-		return "", nil
+		logger.Debug("redis get and delete | transaction failed - concurrent access", "code", code)
+		return nil, ErrCheckoutCodeContention
 	}
 
 	// Step 7 - Return the data
 	logger.Debug("redis get and delete | successfully retrieved and deleted checkout code", "code", code)
-	return data, nil
+	return checkoutData, nil
+}
+
+// checkoutScript reserves an item and stores its checkout code in one step, so a
+// crash can't leave counters changed without a code or the other way around.
+// The item cap of the sale (KEYS[7]) is raised when stock is added, ARGV[2] is only the
+// cap of sales created without one. The sale is sold out as well once its stock is
+// gone, whatever the cap, so the stock never goes negative.
+// A cooldown of 0 milliseconds (ARGV[6]) disables it.
+// Returns nil if the sale keys don't exist, else the CheckoutStatus.
+var checkoutScript = redis.NewScript(8, `
+if redis.call('EXISTS', KEYS[2]) == 0 then
+	return false
+end
+if redis.call('EXISTS', KEYS[6]) == 1 then
+	return 7
+end
+if tonumber(redis.call('GET', KEYS[3]) or '0') >= tonumber(ARGV[1]) then
+	return 2
+end
+if tonumber(redis.call('GET', KEYS[2])) >= tonumber(redis.call('GET', KEYS[7]) or ARGV[2]) then
+	return 3
+end
+if tonumber(redis.call('GET', KEYS[1]) or '0') <= 0 then
+	return 3
+end
+redis.call('DECR', KEYS[1])
+redis.call('INCR', KEYS[2])
+redis.call('INCR', KEYS[3])
+redis.call('SETEX', KEYS[4], ARGV[3], ARGV[4])
+redis.call('SADD', KEYS[5], ARGV[5])
+redis.call('EXPIRE', KEYS[5], 3600)
+redis.call('HSET', KEYS[8], ARGV[5], ARGV[7])
+redis.call('EXPIRE', KEYS[8], 3600)
+if tonumber(ARGV[6]) > 0 then
+	redis.call('SET', KEYS[6], 1, 'PX', ARGV[6])
+end
+return 1
+`)
+
+// checkoutKeysAndArgs returns the KEYS and ARGV of checkoutScript, in script order
+func checkoutKeysAndArgs(keys saleKeys, codeKey string, userID string, code string, expireSeconds int, data []byte, limits CheckoutLimits) []any {
+	return []any{
+		keys.stock, keys.itemsSold, keys.userCountKey(userID), codeKey, keys.reservations, keys.userCooldownKey(userID), keys.itemCap, keys.reservedBy,
+		limits.MaxItemsPerUser, limits.MaxTotalItems, expireSeconds, data, code, limits.Cooldown.Milliseconds(), userID,
+	}
 }
 
+// AtomicCheckout reserves an item of the active sale for the user and stores the
+// checkout code, unless the user reached the checkout limit, the sale reached its
+// item cap or the user is in the cooldown of the last checkout, see CheckoutLimits.
+// A successful checkout starts the cooldown.
+// Nothing is changed unless the checkout succeeds, so there is nothing to roll back.
+// Returns ErrSaleKeysNotFound if the sale keys don't exist.
+func (r *RedisClient) AtomicCheckout(ctx context.Context, userID string, itemID string, code string, expireSeconds int) (CheckoutStatus, error) {
+	logger := myLogger.FromContext(ctx, "redis")
+
+	keys, err := r.activeSaleKeys(ctx)
+	if err != nil {
+		logger.Error("redis checkout | failed to get active sale ID", "error", err)
+		return CheckoutStatusUnknownError, err
+	}
+
+	saleID := strconv.Itoa(keys.saleID)
+	jsonData, err := json.Marshal(CheckoutData{UserID: userID, SaleID: saleID, ItemID: itemID, CreatedAt: r.clock.Now().Format(time.RFC3339), TTL: expireSeconds})
+	if err != nil {
+		logger.Error("redis checkout | failed to marshal checkout data", "error", err)
+		return CheckoutStatusUnknownError, err
+	}
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	status, err := redis.Int(r.runScript(ctx, conn, checkoutScript,
+		checkoutKeysAndArgs(keys, r.checkoutKey(code), userID, code, expireSeconds, jsonData, r.CheckoutLimits())...))
+	if err == redis.ErrNil {
+		logger.Error("redis checkout | sale keys not found", "sale_id", keys.saleID)
+		return CheckoutStatusUnknownError, ErrSaleKeysNotFound
+	}
+	if err != nil {
+		logger.Error("redis checkout | failed to run checkout script", "sale_id", keys.saleID, "error", err)
+		return CheckoutStatusUnknownError, err
+	}
+
+	logger.Debug("redis checkout | checkout done", "sale_id", keys.saleID, "user_id", userID, "status", CheckoutStatus(status).String())
+	return CheckoutStatus(status), nil
+}
+
+// ReleaseReservation deletes a checkout code and gives its item back to the sale,
+// e.g. when the checkout failed after the code was stored. Returns false if the
+// code doesn't exist anymore.
+func (r *RedisClient) ReleaseReservation(ctx context.Context, code string) (bool, error) {
+	logger := myLogger.FromContext(ctx, "redis")
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	raw, err := redis.String(conn.Do("GET", r.checkoutKey(code)))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		logger.Error("redis release | failed to get checkout code", "code", code, "error", err)
+		return false, err
+	}
+
+	released, err := r.releaseReservation(ctx, conn, r.checkoutKey(code), raw)
+	if err != nil {
+		logger.Error("redis release | failed to release reservation", "code", code, "error", err)
+		return false, err
+	}
+	return released, nil
+}
+
+// releaseReservation runs clearReservationScript for the code key holding raw
+func (r *RedisClient) releaseReservation(ctx context.Context, conn redis.Conn, codeKey string, raw string) (bool, error) {
+	data, err := parseCheckoutData(raw)
+	if err != nil {
+		return false, err
+	}
+	saleID, err := strconv.Atoi(data.SaleID)
+	if err != nil {
+		return false, fmt.Errorf("%w: invalid sale ID %q", ErrMalformedCheckoutData, data.SaleID)
+	}
+
+	keys := r.newSaleKeys(saleID)
+	ok, err := redis.Int(r.runScript(ctx, conn, clearReservationScript, codeKey, keys.stock, keys.itemsSold, keys.userCountKey(data.UserID), keys.reservations, keys.reservedBy,
+		raw, strings.TrimPrefix(codeKey, r.checkoutKey(""))))
+	return ok == 1, err
+}
+
+// clearReservationScript deletes a checkout code and gives its item back to the
+// sale. The code must still hold the data it was read with, so a reservation
+// is only ever released once. Returns 1 if the code was cleared, 0 otherwise.
+var clearReservationScript = redis.NewScript(6, `
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	redis.call('INCR', KEYS[2])
+end
+if tonumber(redis.call('GET', KEYS[3]) or '0') > 0 then
+	redis.call('DECR', KEYS[3])
+end
+if tonumber(redis.call('GET', KEYS[4]) or '0') > 0 then
+	redis.call('DECR', KEYS[4])
+end
+redis.call('SREM', KEYS[5], ARGV[2])
+redis.call('HDEL', KEYS[6], ARGV[2])
+return 1
+`)
+
+// expireReservationScript gives the item of an expired checkout code back to the
+// sale. The code must be gone and still counted as a reservation, so a reservation
+// that was purchased or released in the meantime is left alone.
+// Returns 1 if the item was given back, 0 otherwise.
+var expireReservationScript = redis.NewScript(6, `
+if redis.call('EXISTS', KEYS[1]) == 1 or redis.call('SISMEMBER', KEYS[5], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('SREM', KEYS[5], ARGV[1])
+redis.call('HDEL', KEYS[6], ARGV[1])
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	redis.call('INCR', KEYS[2])
+end
+if tonumber(redis.call('GET', KEYS[3]) or '0') > 0 then
+	redis.call('DECR', KEYS[3])
+end
+if tonumber(redis.call('GET', KEYS[4]) or '0') > 0 then
+	redis.call('DECR', KEYS[4])
+end
+return 1
+`)
+
+// GetReservationCount returns the number of outstanding checkout codes of the active sale
+func (r *RedisClient) GetReservationCount(ctx context.Context) (int64, error) {
+	keys, err := r.activeSaleKeys(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	return redis.Int64(conn.Do("SCARD", keys.reservations))
+}
+
+// PruneReservations removes the codes that expired from the reservations of the
+// active sale and gives their items back to the sale: the stock, items sold and user
+// checkout count they held. Expiry has no hook in Redis, so this is what keeps the
+// counts honest. Returns the number of removed codes.
+func (r *RedisClient) PruneReservations(ctx context.Context) (int64, error) {
+	logger := myLogger.FromContext(ctx, "redis")
+
+	keys, err := r.activeSaleKeys(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	var pruned int64
+	cursor := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return pruned, err
+		}
+
+		reply, err := redis.Values(conn.Do("SSCAN", keys.reservations, cursor, "COUNT", 500))
+		if err != nil {
+			return pruned, err
+		}
+		cursor, _ = redis.Int(reply[0], nil)
+		codes, _ := redis.Strings(reply[1], nil)
+
+		// Pipeline the existence checks of the batch
+		for _, code := range codes {
+			conn.Send("EXISTS", r.checkoutKey(code))
+		}
+		if err := conn.Flush(); err != nil {
+			return pruned, err
+		}
+		expired := []interface{}{keys.reservedBy}
+		for _, code := range codes {
+			exists, err := redis.Int(conn.Receive())
+			if err != nil {
+				return pruned, err
+			}
+			if exists == 0 {
+				expired = append(expired, code)
+			}
+		}
+
+		if len(expired) > 1 {
+			removed, err := r.expireReservations(ctx, conn, keys, expired)
+			pruned += removed
+			if err != nil {
+				return pruned, err
+			}
+		}
+
+		if cursor == 0 {
+			logger.Debug("redis prune reservations | pruned expired reservations", "sale_id", keys.saleID, "count", pruned)
+			return pruned, nil
+		}
+	}
+}
+
+// expireReservations gives the items of the expired codes back to the sale. expired is
+// the reserved by key followed by the codes. Codes stored before their user was
+// recorded are only removed from the reservations.
+func (r *RedisClient) expireReservations(ctx context.Context, conn redis.Conn, keys saleKeys, expired []interface{}) (int64, error) {
+	users, err := redis.Values(conn.Do("HMGET", expired...))
+	if err != nil {
+		return 0, err
+	}
+
+	var removed int64
+	unknown := []interface{}{keys.reservations}
+	for i, code := range expired[1:] {
+		code := code.(string)
+		if users[i] == nil {
+			unknown = append(unknown, code)
+			continue
+		}
+		userID, _ := redis.String(users[i], nil)
+		ok, err := redis.Int(r.runScript(ctx, conn, expireReservationScript,
+			r.checkoutKey(code), keys.stock, keys.itemsSold, keys.userCountKey(userID), keys.reservations, keys.reservedBy,
+			code))
+		if err != nil {
+			return removed, err
+		}
+		removed += int64(ok)
+	}
+
+	if len(unknown) > 1 {
+		n, err := redis.Int64(conn.Do("SREM", unknown...))
+		if err != nil {
+			return removed, err
+		}
+		removed += n
+	}
+	return removed, nil
+}
+
+// ClearReservations deletes all outstanding checkout codes and restores the stock,
+// items sold and user checkout counts they held. Codes are scanned in small
+// batches to keep Redis responsive. Returns the number of cleared codes.
+func (r *RedisClient) ClearReservations(ctx context.Context) (int64, error) {
+	logger := myLogger.FromContext(ctx, "redis")
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	var cleared int64
+	cursor := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return cleared, err
+		}
+
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", r.keyPrefix+"checkout:*", "COUNT", 100))
+		if err != nil {
+			logger.Error("redis clear reservations | failed to scan checkout codes", "error", err)
+			return cleared, err
+		}
+		cursor, _ = redis.Int(reply[0], nil)
+		codeKeys, _ := redis.Strings(reply[1], nil)
+
+		for _, codeKey := range codeKeys {
+			raw, err := redis.String(conn.Do("GET", codeKey))
+			if err == redis.ErrNil {
+				continue // expired or purchased in the meantime
+			}
+			if err != nil {
+				logger.Error("redis clear reservations | failed to get checkout code", "key", codeKey, "error", err)
+				return cleared, err
+			}
+
+			released, err := r.releaseReservation(ctx, conn, codeKey, raw)
+			if errors.Is(err, ErrMalformedCheckoutData) {
+				logger.Warn("redis clear reservations | skipping malformed checkout code", "key", codeKey, "error", err)
+				continue
+			}
+			if err != nil {
+				logger.Error("redis clear reservations | failed to clear checkout code", "key", codeKey, "error", err)
+				return cleared, err
+			}
+			if released {
+				cleared++
+			}
+		}
+
+		if cursor == 0 {
+			logger.Info("redis clear reservations | cleared reservations", "count", cleared)
+			return cleared, nil
+		}
+	}
+}
+
+// CloseSale stops the checkouts of the sale by deleting its ID key and records when it
+// ended. The other keys are kept, codes handed out before can still be purchased.
+func (r *RedisClient) CloseSale(ctx context.Context, saleID int) error {
+	logger := myLogger.FromContext(ctx, "redis")
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("DEL", r.saleKey(saleID, "id"))
+	conn.Send("SETEX", r.keyPrefix+"sale:current:ended_at", 3600, r.clock.Now().Unix())
+	if _, err := conn.Do("EXEC"); err != nil {
+		logger.Error("redis close sale | failed to delete sale ID", "sale_id", saleID, "error", err)
+		return err
+	}
+	logger.Info("redis close sale | closed sale", "sale_id", saleID)
+	return nil
+}
+
+// saleKeyNames are the per-sale keys that live as long as the sale, the per-user keys
+// and the end time aside
+var saleKeyNames = []string{"id", "stock", "initial_stock", "items_sold", "item_cap", "added_stock", "started_at", "item_name", "image_url", "item_ids", "reservations", "reserved_by"}
+
+// PurgeSaleKeys unlinks the keys of an ended sale once its final counts are stored,
+// instead of leaving them to expire. Checkout codes live under their own keys, so
+// the ones handed out before can still be purchased.
+func (r *RedisClient) PurgeSaleKeys(ctx context.Context, saleID int) error {
+	logger := myLogger.FromContext(ctx, "redis")
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	var keys []interface{}
+	for _, name := range saleKeyNames {
+		keys = append(keys, r.saleKey(saleID, name))
+	}
+	// UNLINK frees the memory in the background, the reservations set may be large
+	if _, err := conn.Do("UNLINK", keys...); err != nil {
+		logger.Error("redis purge | failed to purge sale keys", "sale_id", saleID, "error", err)
+		return err
+	}
+	logger.Info("redis purge | purged sale keys", "sale_id", saleID)
+	return nil
+}
+
+// RefreshSaleKeys renews the TTL of the keys of a running sale. A closed sale is left
+// alone, so its keys expire. Returns false if the sale is closed or gone.
+func (r *RedisClient) RefreshSaleKeys(ctx context.Context, saleID int, ttl time.Duration) (bool, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	keysAndArgs := []interface{}{}
+	for _, name := range saleKeyNames {
+		keysAndArgs = append(keysAndArgs, r.saleKey(saleID, name))
+	}
+	keysAndArgs = append(keysAndArgs, int64(ttl.Seconds()))
+
+	refreshed, err := redis.Int(r.runScript(ctx, conn, refreshSaleKeysScript, keysAndArgs...))
+	if err != nil {
+		return false, err
+	}
+	return refreshed == 1, nil
+}
+
+// refreshSaleKeysScript renews the TTL of the sale keys unless the sale ID key (KEYS[1])
+// is gone, i.e. the sale was closed. Returns 1 if the keys were refreshed.
+var refreshSaleKeysScript = redis.NewScript(len(saleKeyNames), `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+for i = 1, #KEYS do
+	redis.call('EXPIRE', KEYS[i], ARGV[1])
+end
+return 1
+`)
+
+// ClearActiveSalePointer deletes the active sale pointer if it still points at the
+// sale. Returns false if another sale became active in the meantime.
+func (r *RedisClient) ClearActiveSalePointer(ctx context.Context, saleID int) (bool, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	cleared, err := redis.Int(r.runScript(ctx, conn, clearPointerScript, r.keyPrefix+"sale:current:active_sale", saleID))
+	if err != nil {
+		return false, err
+	}
+	r.InvalidateSaleCache()
+	return cleared == 1, nil
+}
+
+// clearPointerScript deletes the pointer if it holds the sale ID
+var clearPointerScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
 // UpdateActiveSalePointer updates the active sale pointer
 func (r *RedisClient) UpdateActiveSalePointer(ctx context.Context, newSaleID int) error {
 	logger := myLogger.FromContext(ctx, "redis")
@@ -541,7 +1732,7 @@ func (r *RedisClient) UpdateActiveSalePointer(ctx context.Context, newSaleID int
 	conn := r.pool.Get()
 	defer conn.Close()
 
-	_, err := conn.Do("SET", "sale:current:active_sale", newSaleID)
+	_, err := conn.Do("SET", r.keyPrefix+"sale:current:active_sale", newSaleID)
 	if err != nil {
 		return err
 	}
@@ -549,3 +1740,49 @@ func (r *RedisClient) UpdateActiveSalePointer(ctx context.Context, newSaleID int
 	logger.Info("redis update | updated active sale pointer", "sale_id", newSaleID)
 	return nil
 }
+
+// AcquireLock takes the named lock for owner, or extends it if owner holds it already.
+// Returns false if another owner holds it. The lock expires after ttl, so a crashed
+// owner can't keep it.
+func (r *RedisClient) AcquireLock(ctx context.Context, name string, owner string, ttl time.Duration) (bool, error) {
+	logger := myLogger.FromContext(ctx, "redis")
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	acquired, err := redis.Int(r.runScript(ctx, conn, acquireLockScript, r.keyPrefix+"lock:"+name, owner, ttl.Milliseconds()))
+	if err != nil {
+		logger.Error("redis lock | failed to acquire lock", "lock", name, "error", err)
+		return false, err
+	}
+	return acquired == 1, nil
+}
+
+// ReleaseLock releases the named lock if owner still holds it
+func (r *RedisClient) ReleaseLock(ctx context.Context, name string, owner string) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	_, err := r.runScript(ctx, conn, releaseLockScript, r.keyPrefix+"lock:"+name, owner)
+	return err
+}
+
+// acquireLockScript sets the lock unless another owner holds it.
+// Returns 1 if the owner holds the lock now, 0 otherwise.
+var acquireLockScript = redis.NewScript(1, `
+local holder = redis.call('GET', KEYS[1])
+if holder and holder ~= ARGV[1] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return 1
+`)
+
+// releaseLockScript deletes the lock if the owner holds it, so an owner whose lock
+// expired can't release the lock of the next one
+var releaseLockScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
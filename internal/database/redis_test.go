@@ -0,0 +1,153 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestCheckoutKeysAndArgs(t *testing.T) {
+	r := &RedisClient{keyPrefix: "test:"}
+	keys := r.newSaleKeys(42)
+	limits := CheckoutLimits{MaxItemsPerUser: 10, MaxTotalItems: 10000, Cooldown: 1500 * time.Millisecond}
+
+	keysAndArgs := checkoutKeysAndArgs(keys, r.checkoutKey("abc"), "user1", "abc", 20, []byte(`{}`), limits)
+
+	// The script indexes are 1-based, KEYS come first
+	const numKeys = 8
+	if len(keysAndArgs) != numKeys+7 {
+		t.Fatalf("got %d keys and args, want %d", len(keysAndArgs), numKeys+7)
+	}
+	tests := []struct {
+		name string
+		arg  any
+		want any
+	}{
+		{"KEYS[1] stock", keysAndArgs[0], "test:sale:42:stock"},
+		{"KEYS[2] items sold", keysAndArgs[1], "test:sale:42:items_sold"},
+		{"KEYS[3] user count", keysAndArgs[2], "test:sale:42:user:user1:count"},
+		{"KEYS[4] checkout code", keysAndArgs[3], "test:checkout:abc"},
+		{"KEYS[5] reservations", keysAndArgs[4], "test:sale:42:reservations"},
+		{"KEYS[6] user cooldown", keysAndArgs[5], "test:sale:42:user:user1:cooldown"},
+		{"KEYS[7] item cap", keysAndArgs[6], "test:sale:42:item_cap"},
+		{"KEYS[8] reserved by", keysAndArgs[7], "test:sale:42:reserved_by"},
+		{"ARGV[1] max items per user", keysAndArgs[numKeys+0], 10},
+		{"ARGV[2] max total items", keysAndArgs[numKeys+1], 10000},
+		{"ARGV[3] code TTL", keysAndArgs[numKeys+2], 20},
+		{"ARGV[5] code", keysAndArgs[numKeys+4], "abc"},
+		{"ARGV[6] cooldown milliseconds", keysAndArgs[numKeys+5], int64(1500)},
+		{"ARGV[7] user ID", keysAndArgs[numKeys+6], "user1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.arg != tt.want {
+				t.Errorf("got %v (%T), want %v (%T)", tt.arg, tt.arg, tt.want, tt.want)
+			}
+		})
+	}
+	if data, ok := keysAndArgs[numKeys+3].([]byte); !ok || string(data) != `{}` {
+		t.Errorf("ARGV[4] checkout data: got %v, want {}", keysAndArgs[numKeys+3])
+	}
+}
+
+func TestExtendedTTL(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	const ttl = 20 * time.Second
+	const maxLifetime = 60 * time.Second
+
+	tests := []struct {
+		name    string
+		age     time.Duration
+		want    time.Duration
+		wantErr error
+	}{
+		{"new code gets its full TTL", 0, ttl, nil},
+		{"well within the lifetime", 30 * time.Second, ttl, nil},
+		{"cut to the rest of the lifetime", 50 * time.Second, 10 * time.Second, nil},
+		{"last second of the lifetime", 59 * time.Second, time.Second, nil},
+		{"less than a second left", 59*time.Second + 500*time.Millisecond, 0, ErrReservationLifetimeExceeded},
+		{"at the lifetime", maxLifetime, 0, ErrReservationLifetimeExceeded},
+		{"past the lifetime", 2 * maxLifetime, 0, ErrReservationLifetimeExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extendedTTL(now.Add(-tt.age), now, ttl, maxLifetime)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got TTL %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// checkoutKeysSink keeps the compiler from optimizing the benchmarked calls away
+var checkoutKeysSink []any
+
+func BenchmarkCheckoutKeys(b *testing.B) {
+	r := &RedisClient{keyPrefix: "test:"}
+	keys := r.newSaleKeys(42)
+	data := []byte(`{}`)
+	limits := CheckoutLimits{MaxItemsPerUser: 10, MaxTotalItems: 10000}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		checkoutKeysSink = checkoutKeysAndArgs(keys, r.checkoutKey("abc"), "user1", "abc", 20, data, limits)
+	}
+}
+
+// BenchmarkCheckoutKeysSprintf formats every key per checkout, as was done before the
+// keys of the active sale were built once. It's the baseline of BenchmarkCheckoutKeys.
+func BenchmarkCheckoutKeysSprintf(b *testing.B) {
+	const prefix, saleID, userID, code = "test:", 42, "user1", "abc"
+	data := []byte(`{}`)
+	limits := CheckoutLimits{MaxItemsPerUser: 10, MaxTotalItems: 10000}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		checkoutKeysSink = []any{
+			fmt.Sprintf("%ssale:%d:stock", prefix, saleID),
+			fmt.Sprintf("%ssale:%d:items_sold", prefix, saleID),
+			fmt.Sprintf("%ssale:%d:user:%s:count", prefix, saleID, userID),
+			fmt.Sprintf("%scheckout:%s", prefix, code),
+			fmt.Sprintf("%ssale:%d:reservations", prefix, saleID),
+			fmt.Sprintf("%ssale:%d:user:%s:cooldown", prefix, saleID, userID),
+			fmt.Sprintf("%ssale:%d:item_cap", prefix, saleID),
+			fmt.Sprintf("%ssale:%d:reserved_by", prefix, saleID),
+			limits.MaxItemsPerUser, limits.MaxTotalItems, 20, data, code, limits.Cooldown.Milliseconds(), userID,
+		}
+	}
+}
+
+func TestIsConnectionError(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"dial error", refused, true},
+		{"wrapped dial error", fmt.Errorf("failed to get checkout code: %w", refused), true},
+		{"connection closed", io.EOF, true},
+		{"truncated reply", io.ErrUnexpectedEOF, true},
+		{"pool exhausted", redis.ErrPoolExhausted, true},
+		{"missing key", redis.ErrNil, false},
+		{"code not found", ErrCheckoutCodeNotFound, false},
+		{"plain error", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsConnectionError(tt.err); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
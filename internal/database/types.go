@@ -2,10 +2,19 @@ package database
 
 import (
 	"database/sql"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
+	"github.com/pcristin/golang_contest/internal/utils"
+)
+
+// Column sizes of the sales table, longer values are rejected by Postgres
+const (
+	MaxItemNameLength = 255 // characters of sales.item_name
+	MaxImageURLLength = 500 // characters of sales.image_url
 )
 
 // RedisClient is a wrapper around the Redis client
@@ -13,16 +22,40 @@ type RedisClient struct {
 	// Connection pool to handle multiple connections
 	pool *redis.Pool
 
+	// Prepended to every key, empty by default
+	keyPrefix string
+
+	// Caps the Lua scripts running at once, nil is unlimited
+	scriptSlots     chan struct{}
+	scriptsInFlight atomic.Int64
+
+	// Limits of the checkouts, replaced when the config is reloaded
+	checkoutLimits atomic.Pointer[CheckoutLimits]
+
+	// Time of the stored sale and checkout times, the wall clock unless replaced
+	clock utils.Clock
+
 	// Cache current sale ID
-	currentSaleID  int
-	cachedSaleTime time.Time
-	cacheMutex     sync.RWMutex
+	currentSaleID   int
+	currentSaleKeys saleKeys
+	cachedSaleTime  time.Time
+	cacheMutex      sync.RWMutex
+}
+
+// CheckoutLimits are the limits a checkout is checked against, kept on the RedisClient
+type CheckoutLimits struct {
+	MaxItemsPerUser int           // items a user can check out in a sale
+	MaxTotalItems   int           // items that can be sold in a sale without an item cap key
+	Cooldown        time.Duration // time between checkouts of a user, 0 disables it
 }
 
 // PostgresClient is a wrapper around the Postgres client
 type PostgresClient struct {
 	// Connection pool to handle multiple connections
 	db *sql.DB
+
+	// Time of the stored sale and purchase times and the expiry cutoff, the wall clock unless replaced
+	clock utils.Clock
 }
 
 // CheckoutAttempt is a struct for transactions representing a checkout attempt
@@ -32,8 +65,127 @@ type CheckoutAttempt struct {
 	SaleID    int
 	ItemID    string
 	Code      *string
-	Status    string
+	Status    CheckoutStatus
 	CreatedAt time.Time
+	TTL       int // seconds the code reserves the item, 0 if unknown or unsuccessful
+}
+
+// CheckoutStatus is the outcome of a checkout attempt. It is stored both as the
+// readable status column and as the numeric outcome_code column, so existing
+// values must never be renumbered.
+type CheckoutStatus int
+
+const (
+	CheckoutStatusPending      CheckoutStatus = iota // not decided yet
+	CheckoutStatusSuccess                            // checked out, waiting for purchase
+	CheckoutStatusUserLimit                          // user reached the checkout limit
+	CheckoutStatusSaleLimit                          // sale reached the items cap
+	CheckoutStatusUnknownError                       // failed on an internal error
+	CheckoutStatusCompleted                          // purchased
+	CheckoutStatusExpired                            // code expired before the purchase
+	CheckoutStatusCooldown                           // user checked out too recently
+)
+
+var checkoutStatusNames = [...]string{
+	CheckoutStatusPending:      "pending",
+	CheckoutStatusSuccess:      "success",
+	CheckoutStatusUserLimit:    "user limit",
+	CheckoutStatusSaleLimit:    "sale limit",
+	CheckoutStatusUnknownError: "unknown error",
+	CheckoutStatusCompleted:    "completed",
+	CheckoutStatusExpired:      "expired",
+	CheckoutStatusCooldown:     "cooldown",
+}
+
+// String returns the value stored in the status column
+func (s CheckoutStatus) String() string {
+	if s < 0 || int(s) >= len(checkoutStatusNames) {
+		return "unknown"
+	}
+	return checkoutStatusNames[s]
+}
+
+// Resolved reports whether the status is final. Pending and successful attempts
+// may still change, e.g. on purchase or expiry.
+func (s CheckoutStatus) Resolved() bool {
+	return s != CheckoutStatusPending && s != CheckoutStatusSuccess
+}
+
+// resolvedCheckoutStatuses returns the status column values of the final statuses
+func resolvedCheckoutStatuses() []string {
+	var names []string
+	for status, name := range checkoutStatusNames {
+		if CheckoutStatus(status).Resolved() {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Scan reads a CheckoutStatus from the status column, which older rows without
+// an outcome_code also have
+func (s *CheckoutStatus) Scan(src any) error {
+	var name string
+	switch v := src.(type) {
+	case string:
+		name = v
+	case []byte:
+		name = string(v)
+	default:
+		return fmt.Errorf("unsupported checkout status type %T", src)
+	}
+	status, err := ParseCheckoutStatus(name)
+	if err != nil {
+		return err
+	}
+	*s = status
+	return nil
+}
+
+// ParseCheckoutStatus returns the CheckoutStatus stored as name in the status column
+func ParseCheckoutStatus(name string) (CheckoutStatus, error) {
+	for status, statusName := range checkoutStatusNames {
+		if statusName == name {
+			return CheckoutStatus(status), nil
+		}
+	}
+	return CheckoutStatusPending, fmt.Errorf("unknown checkout status %q", name)
+}
+
+// CheckoutData is the data stored in Redis for a checkout code
+type CheckoutData struct {
+	UserID    string `json:"user_id"`
+	SaleID    string `json:"sale_id"`
+	ItemID    string `json:"item_id"`
+	CreatedAt string `json:"created_at"`
+	TTL       int    `json:"ttl,omitempty"` // seconds the code reserves the item, 0 in older codes
+}
+
+// SaleReconciliation is the result of comparing the Redis and Postgres counts of a sale
+type SaleReconciliation struct {
+	SaleID         int
+	RedisItemsSold int64
+	Purchases      int64
+	CheckedAt      time.Time
+}
+
+// SaleCounters are the Redis counters of a sale
+type SaleCounters struct {
+	InitialStock int64
+	ItemsSold    int64
+	ItemCap      int64     // zero if the sale has no item cap key
+	StartedAt    time.Time // zero if the sale has no start time key
+}
+
+// SaleRecord is a sale as stored in Postgres
+type SaleRecord struct {
+	ID        int
+	ItemName  string
+	ImageURL  string
+	StartedAt time.Time
+	EndedAt   *time.Time // nil while the sale is running
+
+	AddedStock int // added through the admin API on top of the stock the sale started with
 }
 
 // Purchase is a struct for transactions representing a purchase
@@ -44,3 +196,11 @@ type Purchase struct {
 	ItemID      string
 	PurchasedAt time.Time
 }
+
+// StockTotals are the stock counters of a sale after stock was added
+type StockTotals struct {
+	Stock        int64 // stock left to check out
+	InitialStock int64 // stock the sale was created with plus all added stock
+	AddedStock   int64 // stock added after the sale was created
+	ItemCap      int64 // max items sold in the sale, zero if the sale has no item cap key
+}
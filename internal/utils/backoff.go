@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff computes retry delays that grow from Base by Multiplier up to Max.
+// Jitter (0..1) randomizes each delay by up to that fraction so replicas don't retry in lockstep.
+type Backoff struct {
+	Base       time.Duration
+	Multiplier float64
+	Max        time.Duration
+	Jitter     float64
+
+	// Source of the jitter, the global math/rand source if nil
+	Rand *Random
+}
+
+// Delay returns the delay before retrying after the given attempt (starting at 1)
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := float64(b.Base) * math.Pow(b.Multiplier, float64(attempt-1))
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+
+	// Spread the delay evenly within +/- Jitter
+	if b.Jitter > 0 {
+		delay += delay * b.Jitter * (2*b.float64() - 1)
+	}
+	return time.Duration(delay)
+}
+
+// float64 returns a number in [0, 1) from the jitter source
+func (b Backoff) float64() float64 {
+	if b.Rand == nil {
+		return rand.Float64()
+	}
+	return b.Rand.Float64()
+}
@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	backoff := Backoff{Base: time.Second, Multiplier: 2, Max: 5 * time.Second}
+
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{10, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := backoff.Delay(tt.attempt); got != tt.want {
+			t.Errorf("attempt %d: got %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestBackoffJitterSeeded(t *testing.T) {
+	delays := func(seed int64) []time.Duration {
+		backoff := Backoff{Base: time.Second, Multiplier: 2, Max: 30 * time.Second, Jitter: 0.2, Rand: NewRandom(seed)}
+		var delays []time.Duration
+		for attempt := 1; attempt <= 5; attempt++ {
+			delays = append(delays, backoff.Delay(attempt))
+		}
+		return delays
+	}
+
+	first, second := delays(42), delays(42)
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("attempt %d: got %v and %v with the same seed, want the same delay", i+1, first[i], second[i])
+		}
+	}
+	for i, delay := range first {
+		base := time.Second << i
+		if delay < base*8/10 || delay > base*12/10 {
+			t.Errorf("attempt %d: got %v, want within 20%% of %v", i+1, delay, base)
+		}
+	}
+}
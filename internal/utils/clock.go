@@ -0,0 +1,40 @@
+package utils
+
+import "time"
+
+// Clock tells the time and arms timers, so the time-dependent logic (sale schedule,
+// code TTLs, countdowns) can run on a fake clock instead of the wall clock
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the part of *time.Timer the callers use
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// RealClock is the wall clock
+type RealClock struct{}
+
+// Now returns the current time
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer creates a timer firing after d
+func (RealClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+// realTimer wraps a *time.Timer, whose channel is a field rather than a method
+type realTimer struct {
+	*time.Timer
+}
+
+// C returns the channel the time is sent on when the timer fires
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
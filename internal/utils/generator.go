@@ -3,24 +3,33 @@ package utils
 import (
 	"crypto/rand"
 	"encoding/base32"
-	"fmt"
+	"encoding/binary"
 	"sync/atomic"
-	"time"
 )
 
-var counter int64
+var counter uint32
 
-// GenerateCode function generates a random code for checkout handler
-// without external dependencies
-func GenerateCode() string {
-	timestamp := time.Now().UnixMicro()
-
-	count := atomic.AddInt64(&counter, 1)
+// processSalt tells apart the codes of different processes, since the counter
+// restarts from zero with every process
+var processSalt = func() [4]byte {
+	var salt [4]byte
+	rand.Read(salt[:])
+	return salt
+}()
 
-	random := make([]byte, 8)
-	rand.Read(random)
+// codeEncoding keeps codes free of padding characters
+var codeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
 
-	combined := fmt.Sprintf("%d-%d-%s", timestamp, count, random)
+// GenerateCode function generates a random code for checkout handler
+// without external dependencies.
+// Codes are unique within a process for 2^32 codes thanks to the counter, the
+// process salt keeps them apart across restarts and the random part makes them
+// hard to guess.
+func GenerateCode() string {
+	var material [16]byte
+	copy(material[0:4], processSalt[:])
+	binary.BigEndian.PutUint32(material[4:8], atomic.AddUint32(&counter, 1))
+	rand.Read(material[8:])
 
-	return base32.StdEncoding.EncodeToString([]byte(combined))[:16]
+	return codeEncoding.EncodeToString(material[:])
 }
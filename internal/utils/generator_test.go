@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestGenerateCodeUnique(t *testing.T) {
+	const goroutines, perGoroutine = 64, 2000
+	codes := make(chan string, goroutines*perGoroutine)
+	var wg sync.WaitGroup
+	for range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range perGoroutine {
+				codes <- GenerateCode()
+			}
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	seen := make(map[string]bool, goroutines*perGoroutine)
+	for code := range codes {
+		if seen[code] {
+			t.Fatalf("duplicate code %q", code)
+		}
+		seen[code] = true
+	}
+	if len(seen) != goroutines*perGoroutine {
+		t.Errorf("got %d codes, want %d", len(seen), goroutines*perGoroutine)
+	}
+}
@@ -1,10 +1,145 @@
 package utils
 
 import (
+	"encoding/json"
 	"fmt"
+	"math/rand"
+	"os"
 	"time"
 )
 
+// MaxSaleStock is the largest stock a sale can be created with. Redis counts
+// stock as a 64 bit integer, the bound just catches misconfigured values early.
+const MaxSaleStock = 1_000_000_000
+
+// CatalogItem is an item that can be put on sale
+type CatalogItem struct {
+	Name     string `json:"name"`
+	ImageURL string `json:"image_url"`
+	Stock    int    `json:"stock"` // 0 means the global initial stock is used
+
+	// Seconds a checkout code reserves the item, 0 means the default TTL is used.
+	// High-demand items can free their stock faster with a shorter one.
+	CheckoutTTL int `json:"checkout_ttl,omitempty"`
+
+	// Relative chance of the item being picked, 1 if not set
+	Weight *float64 `json:"weight,omitempty"`
+
+	// Item IDs that can be checked out while the item is on sale, any ID if empty
+	ItemIDs []int64 `json:"item_ids,omitempty"`
+}
+
+// weight returns the selection weight of the item
+func (i CatalogItem) weight() float64 {
+	if i.Weight == nil {
+		return 1
+	}
+	return *i.Weight
+}
+
+// ItemGenerator picks the item of each sale from a catalog
+type ItemGenerator struct {
+	catalog     []CatalogItem
+	totalWeight float64
+}
+
+// NewItemGenerator creates a new ItemGenerator. An empty catalog generates placeholder items.
+func NewItemGenerator(catalog []CatalogItem) *ItemGenerator {
+	generator := &ItemGenerator{catalog: catalog}
+	for _, item := range catalog {
+		generator.totalWeight += item.weight()
+	}
+	return generator
+}
+
+// LoadCatalog reads the catalog items from a JSON file
+func LoadCatalog(path string) ([]CatalogItem, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var catalog []CatalogItem
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return nil, fmt.Errorf("failed to parse catalog: %v", err)
+	}
+	totalWeight := 0.0
+	for i, item := range catalog {
+		if item.Name == "" {
+			return nil, fmt.Errorf("catalog item %d has no name", i)
+		}
+		if item.Stock < 0 || item.Stock > MaxSaleStock {
+			return nil, fmt.Errorf("catalog item %q has stock %d outside 0..%d", item.Name, item.Stock, MaxSaleStock)
+		}
+		if item.CheckoutTTL < 0 {
+			return nil, fmt.Errorf("catalog item %q has negative checkout TTL", item.Name)
+		}
+		for _, itemID := range item.ItemIDs {
+			if itemID <= 0 {
+				return nil, fmt.Errorf("catalog item %q has invalid item ID %d", item.Name, itemID)
+			}
+		}
+		if item.weight() < 0 {
+			return nil, fmt.Errorf("catalog item %q has negative weight", item.Name)
+		}
+		totalWeight += item.weight()
+	}
+	if len(catalog) > 0 && totalWeight <= 0 {
+		return nil, fmt.Errorf("catalog needs at least one item with a positive weight")
+	}
+	return catalog, nil
+}
+
+// GenerateItem picks the item for the sale from the catalog by weighted random.
+// The pick is seeded with the sale ID, so the same sale always gets the same item.
+func (g *ItemGenerator) GenerateItem(saleID int, startTime time.Time) (itemName, imageURL string, stock int) {
+	if len(g.catalog) == 0 || g.totalWeight <= 0 {
+		itemName, imageURL = GenerateItem(saleID, startTime)
+		return itemName, imageURL, 0
+	}
+
+	target := rand.New(rand.NewSource(int64(saleID))).Float64() * g.totalWeight
+	item := g.catalog[len(g.catalog)-1]
+	for _, candidate := range g.catalog {
+		if target < candidate.weight() {
+			item = candidate
+			break
+		}
+		target -= candidate.weight()
+	}
+	return item.Name, item.ImageURL, item.Stock
+}
+
+// StockFor returns the catalog stock of the item, 0 if it isn't in the catalog or has no stock set
+func (g *ItemGenerator) StockFor(itemName string) int {
+	for _, item := range g.catalog {
+		if item.Name == itemName {
+			return item.Stock
+		}
+	}
+	return 0
+}
+
+// CheckoutTTLFor returns the checkout TTL of the item in seconds, 0 if it isn't in the catalog or has none set
+func (g *ItemGenerator) CheckoutTTLFor(itemName string) int {
+	for _, item := range g.catalog {
+		if item.Name == itemName {
+			return item.CheckoutTTL
+		}
+	}
+	return 0
+}
+
+// ItemIDsFor returns the valid item IDs of the item, nil if any ID is valid
+func (g *ItemGenerator) ItemIDsFor(itemName string) []int64 {
+	for _, item := range g.catalog {
+		if item.Name == itemName {
+			return item.ItemIDs
+		}
+	}
+	return nil
+}
+
 func GenerateItem(saleID int, startTime time.Time) (itemName, imageURL string) {
 	// Generate a random item name
 	itemName = fmt.Sprintf("NOT-DEVELOPER-ITEM-%d", saleID)
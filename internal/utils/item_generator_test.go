@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func weight(w float64) *float64 {
+	return &w
+}
+
+func TestGenerateItemFollowsWeights(t *testing.T) {
+	catalog := []CatalogItem{
+		{Name: "common", Weight: weight(6)},
+		{Name: "uncommon", Weight: weight(3)},
+		{Name: "rare", Weight: weight(1)},
+		{Name: "never", Weight: weight(0)},
+	}
+	generator := NewItemGenerator(catalog)
+
+	const sales = 100000
+	counts := make(map[string]int)
+	for saleID := 1; saleID <= sales; saleID++ {
+		name, _, _ := generator.GenerateItem(saleID, time.Time{})
+		counts[name]++
+	}
+
+	for _, item := range catalog {
+		want := *item.Weight / 10
+		got := float64(counts[item.Name]) / sales
+		if math.Abs(got-want) > 0.01 {
+			t.Errorf("%s picked %.3f of the sales, want %.3f", item.Name, got, want)
+		}
+	}
+	if counts["never"] != 0 {
+		t.Errorf("item with weight 0 picked %d times", counts["never"])
+	}
+}
+
+func TestGenerateItemIsDeterministic(t *testing.T) {
+	generator := NewItemGenerator([]CatalogItem{{Name: "a"}, {Name: "b"}, {Name: "c"}})
+
+	for saleID := 1; saleID <= 100; saleID++ {
+		first, _, _ := generator.GenerateItem(saleID, time.Now())
+		again, _, _ := generator.GenerateItem(saleID, time.Now().Add(time.Hour))
+		if first != again {
+			t.Fatalf("sale %d got %q, then %q", saleID, first, again)
+		}
+	}
+}
+
+func TestLoadCatalogWeights(t *testing.T) {
+	tests := []struct {
+		name    string
+		catalog string
+		wantErr string
+	}{
+		{"weights default to 1", `[{"name": "a"}, {"name": "b"}]`, ""},
+		{"zero weight next to a positive one", `[{"name": "a", "weight": 0}, {"name": "b", "weight": 2}]`, ""},
+		{"negative weight", `[{"name": "a", "weight": -1}]`, "negative weight"},
+		{"no positive weight", `[{"name": "a", "weight": 0}, {"name": "b", "weight": 0}]`, "positive weight"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "catalog.json")
+			if err := os.WriteFile(path, []byte(tt.catalog), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := LoadCatalog(path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
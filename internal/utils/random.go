@@ -0,0 +1,47 @@
+package utils
+
+import (
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
+	"sync"
+)
+
+// Random is a concurrency-safe source for the randomness that doesn't need to be
+// unpredictable, like the purchase easter egg or retry jitter. A fixed seed makes
+// it reproducible. Checkout codes never use it, they stay on crypto/rand.
+type Random struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// NewRandom creates a Random seeded with seed, or from crypto/rand if seed is 0
+func NewRandom(seed int64) *Random {
+	if seed == 0 {
+		var material [8]byte
+		cryptorand.Read(material[:])
+		seed = int64(binary.BigEndian.Uint64(material[:]))
+	}
+	return &Random{rng: rand.New(rand.NewSource(seed))}
+}
+
+// Intn returns a number in [0, n)
+func (r *Random) Intn(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rng.Intn(n)
+}
+
+// Int63n returns a number in [0, n)
+func (r *Random) Int63n(n int64) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rng.Int63n(n)
+}
+
+// Float64 returns a number in [0, 1)
+func (r *Random) Float64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rng.Float64()
+}
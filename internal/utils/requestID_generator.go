@@ -4,12 +4,45 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"sync/atomic"
 	"time"
 )
 
+// uuidRequestIDs switches GenerateRequestID to UUIDv4, set once at startup
+var uuidRequestIDs atomic.Bool
+
+// UseUUIDRequestIDs makes GenerateRequestID return random UUIDv4s instead of
+// <unix nano>-<32 hex chars> IDs
+func UseUUIDRequestIDs(enabled bool) {
+	uuidRequestIDs.Store(enabled)
+}
+
 func GenerateRequestID() string {
+	if uuidRequestIDs.Load() {
+		return newUUID()
+	}
 	timestamp := time.Now().UnixNano()
 	randBytes := make([]byte, 16)
 	rand.Read(randBytes)
 	return fmt.Sprintf("%d-%s", timestamp, hex.EncodeToString(randBytes))
 }
+
+// newUUID returns a random (version 4) UUID as defined in RFC 9562
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // variant 10
+
+	var buf [36]byte
+	hex.Encode(buf[0:8], b[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], b[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], b[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], b[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], b[10:])
+	return string(buf[:])
+}
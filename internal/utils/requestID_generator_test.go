@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"regexp"
+	"sync"
+	"testing"
+)
+
+var (
+	defaultRequestID = regexp.MustCompile(`^\d+-[0-9a-f]{32}$`)
+	uuidV4RequestID  = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+)
+
+func TestGenerateRequestIDFormat(t *testing.T) {
+	defer UseUUIDRequestIDs(false)
+
+	tests := []struct {
+		name    string
+		uuid    bool
+		pattern *regexp.Regexp
+	}{
+		{"default", false, defaultRequestID},
+		{"UUIDv4", true, uuidV4RequestID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			UseUUIDRequestIDs(tt.uuid)
+			for range 100 {
+				if id := GenerateRequestID(); !tt.pattern.MatchString(id) {
+					t.Fatalf("request ID %q doesn't match %s", id, tt.pattern)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateRequestIDUnique(t *testing.T) {
+	defer UseUUIDRequestIDs(false)
+
+	for _, uuid := range []bool{false, true} {
+		UseUUIDRequestIDs(uuid)
+
+		const goroutines, perGoroutine = 8, 1000
+		ids := make(chan string, goroutines*perGoroutine)
+		var wg sync.WaitGroup
+		for range goroutines {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range perGoroutine {
+					ids <- GenerateRequestID()
+				}
+			}()
+		}
+		wg.Wait()
+		close(ids)
+
+		seen := make(map[string]bool)
+		for id := range ids {
+			if seen[id] {
+				t.Fatalf("duplicate request ID %q (uuid %v)", id, uuid)
+			}
+			seen[id] = true
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// SignatureHeader carries the HMAC signature of a callback request body
+const SignatureHeader = "X-Signature"
+
+// signaturePrefix names the hash of the signature, as in "sha256=<hex>"
+const signaturePrefix = "sha256="
+
+// SignBody returns the HMAC-SHA256 signature of the body, in the format
+// expected in the SignatureHeader
+func SignBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyBodySignature reports whether the signature matches the body, in constant time
+func VerifyBodySignature(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignBody(secret, body)), []byte(signature))
+}